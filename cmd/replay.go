@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/logging"
+	"github.com/dominicbreuker/pspy/internal/pspy"
+	"github.com/dominicbreuker/pspy/internal/session"
+	"github.com/spf13/cobra"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay session.pspy",
+	Short: "print the events of a session recorded with --record",
+	Long:  "Replays a session recorded with --record. Events are filtered and printed as if they happened now, with their original timestamps.",
+	Args:  cobra.ExactArgs(1),
+	Run:   replay,
+}
+
+var speed float64
+
+func init() {
+	replayCmd.Flags().Float64VarP(&speed, "speed", "", 0, "replay at this multiple of the original speed, e.g., 1 for real time, 0 for as fast as possible")
+	rootCmd.AddCommand(replayCmd)
+}
+
+// endOfSession makes the printer exit after it printed the last replayed event
+type endOfSession struct{}
+
+func (endOfSession) String() string { return "end of session" }
+func (endOfSession) Signal()        {}
+
+func replay(cmd *cobra.Command, args []string) {
+	cfg, err := loadConfig(cmd.Flags())
+	if err == nil && speed < 0 {
+		err = fmt.Errorf("invalid speed %v: must not be negative", speed)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// nothing to watch or drain, events come from the file
+	cfg.RDirs, cfg.Dirs, cfg.DrainFor = []string{}, []string{}, 0
+
+	r, err := session.Open(args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	logger := logging.NewLogger(debug)
+	setInfoOutput(logger, cfg)
+	logger.Infof("Replaying session recorded on %s since %s", r.Header.Host, r.Header.Started.Format("2006/01/02 15:04:05"))
+
+	player := session.NewPlayer(r, speed)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+
+	b := &pspy.Bindings{
+		Logger: logger,
+		FSW:    player.FSWatcher(),
+		PSS:    player.PSScanner(),
+		// writable files are checked on this machine as it is now
+		Checker: findings.NewChecker(),
+	}
+	exit := pspy.Start(cfg, b, sigCh)
+	select {
+	case <-exit:
+	case <-player.Done():
+		if err := player.Err(); err != nil {
+			logger.Infof("Replay stopped early: %v", err)
+		}
+		sigCh <- endOfSession{}
+		<-exit
+	}
+}
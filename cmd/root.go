@@ -5,15 +5,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/dominicbreuker/pspy/internal/config"
+	"github.com/dominicbreuker/pspy/internal/filter"
+	"github.com/dominicbreuker/pspy/internal/findings"
 	"github.com/dominicbreuker/pspy/internal/fswatcher"
 	"github.com/dominicbreuker/pspy/internal/logging"
 	"github.com/dominicbreuker/pspy/internal/pspy"
 	"github.com/dominicbreuker/pspy/internal/psscanner"
+	"github.com/dominicbreuker/pspy/internal/session"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 var banner = `
@@ -47,7 +52,8 @@ var rootCmd = &cobra.Command{
 	Run:   root,
 }
 
-var logPS, logFS bool
+var logPS, logFS, logExits, logMissed, logFindings, redact bool
+var colorBy string
 var rDirs, dirs []string
 var defaultRDirs = []string{
 	"/usr",
@@ -58,46 +64,89 @@ var defaultRDirs = []string{
 	"/opt",
 }
 var defaultDirs = []string{}
+
 var triggerInterval int
+var triggerMin int
+var triggerMax int
+var cpuBudget float64
 var colored bool
 var debug bool
 var ppid bool
+var ancestry int
+var tree bool
+var sessions bool
+var probe int
+var rescan int
+var recheck bool
 var cmdLength int
+var enrich []string
+var envAllow, envDeny []string
+var format string
+var scanner string
+var procRoot string
+var configFile string
+var profile string
+var filterExpr string
+var excludeExpr string
+var recordFile string
 
 func init() {
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "", "", "read options from this file, reloaded on SIGHUP; flags take precedence")
+	rootCmd.PersistentFlags().StringVarP(&profile, "profile", "", "", "use a predefined set of options: "+strings.Join(config.ProfileNames(), ", ")+" or a profile from the config file; other options take precedence")
 	rootCmd.PersistentFlags().BoolVarP(&logPS, "procevents", "p", true, "print new processes to stdout")
 	rootCmd.PersistentFlags().BoolVarP(&logFS, "fsevents", "f", false, "print file system events to stdout")
+	rootCmd.PersistentFlags().BoolVarP(&logExits, "exits", "", false, "print processes exiting, with their approximate lifetime")
+	rootCmd.PersistentFlags().BoolVarP(&logMissed, "missed", "", false, "print estimates of processes missed between scans, from gaps in the PIDs allocated by the kernel")
+	rootCmd.PersistentFlags().BoolVarP(&logFindings, "findings", "", false, "print findings: executables and scripts run by other users, e.g., root, that you can modify (use with --enrich exe,cwd), risky commands of root and secrets passed as arguments")
 	rootCmd.PersistentFlags().StringArrayVarP(&rDirs, "recursive_dirs", "r", defaultRDirs, "watch these dirs recursively")
 	rootCmd.PersistentFlags().StringArrayVarP(&dirs, "dirs", "d", defaultDirs, "watch these dirs")
 	rootCmd.PersistentFlags().IntVarP(&triggerInterval, "interval", "i", 100, "scan every 'interval' milliseconds for new processes")
+	rootCmd.PersistentFlags().IntVarP(&triggerMin, "interval-min", "", 0, "shortest scan interval in milliseconds while inotify is busy (default: --interval)")
+	rootCmd.PersistentFlags().IntVarP(&triggerMax, "interval-max", "", 0, "longest scan interval in milliseconds while the system is idle (default: --interval)")
+	rootCmd.PersistentFlags().Float64VarP(&cpuBudget, "cpu-budget", "", 0, "percentage of one CPU pspy may use before scanning less often, 0 for no limit")
 	rootCmd.PersistentFlags().BoolVarP(&colored, "color", "c", true, "color the printed events")
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "", false, "print detailed error messages")
 	rootCmd.PersistentFlags().BoolVarP(&ppid, "ppid", "", false, "record process ppids")
+	rootCmd.PersistentFlags().IntVarP(&ancestry, "ancestry", "", 0, "record this many ancestors of new processes (parent, grandparent, ...), including exited ones already seen")
+	rootCmd.PersistentFlags().BoolVarP(&tree, "tree", "", false, fmt.Sprintf("print new processes indented beneath their parents (implies --ancestry %d unless set)", config.DefaultTreeAncestry))
+	rootCmd.PersistentFlags().BoolVarP(&sessions, "sessions", "", false, "print commands grouped by login session under a header naming its terminal and login UID, like a transcript (implies --enrich session)")
+	rootCmd.PersistentFlags().IntVarP(&probe, "probe", "", 0, "before each scan, look up the PIDs the kernel allocates next, stopping after this many in a row without a new process; catches short-lived processes sooner")
+	rootCmd.PersistentFlags().IntVarP(&rescan, "rescan", "", 0, "every 'rescan' milliseconds, read the command lines and executables of all known processes again to report those that changed or exec'ed, 0 to disable")
+	rootCmd.PersistentFlags().BoolVarP(&recheck, "recheck", "", true, "read the command lines and executables of new processes again in the next two scans to report those that exec'ed or were still starting up, --recheck=false to turn off")
 	rootCmd.PersistentFlags().IntVarP(&cmdLength, "truncate", "t", 2048, "truncate process cmds longer than this")
+	rootCmd.PersistentFlags().StringSliceVarP(&enrich, "enrich", "e", []string{}, "record additional process details: "+strings.Join(psscanner.EnrichmentOptions, ", "))
+	rootCmd.PersistentFlags().StringSliceVarP(&envAllow, "env-allow", "", []string{}, "with --enrich env, record only environment variables matching these patterns, e.g., SUDO_*,SSH_CONNECTION")
+	rootCmd.PersistentFlags().StringSliceVarP(&envDeny, "env-deny", "", []string{}, "with --enrich env, never record environment variables matching these patterns, e.g., LS_COLORS")
+	rootCmd.PersistentFlags().StringVarP(&scanner, "scanner", "", config.ScannerAuto, "how to find new processes: 'procfs' scans /proc, 'netlink' subscribes to the kernel's proc connector (requires CAP_NET_ADMIN, falls back to 'procfs'), 'auto' uses 'netlink' if permitted")
+	rootCmd.PersistentFlags().StringVarP(&procRoot, "proc-root", "", "/proc", "where procfs is mounted, e.g., /host/proc to watch the host from a container")
+	rootCmd.PersistentFlags().StringVarP(&filterExpr, "filter", "", "", "only print events matching this expression, e.g., 'uid==0 && cmd=~\"passwd\"', or '@file' to read it from a file")
+	rootCmd.PersistentFlags().StringVarP(&excludeExpr, "exclude", "", "", "don't print events matching this expression, or '@file' to read it from a file")
+	rootCmd.PersistentFlags().StringVarP(&format, "format", "", config.FormatText, "output format for events: 'text' or 'json' (one JSON object per line)")
+	rootCmd.PersistentFlags().StringVarP(&colorBy, "color-by", "", "uid", "color process events by: "+strings.Join(config.ColorByOptions, ", ")+" (all but uid need --enrich cgroup)")
+	rootCmd.PersistentFlags().BoolVarP(&redact, "redact", "", false, "mask passwords, tokens and other secrets in command lines in all output, e.g., for reports you share")
+	rootCmd.Flags().StringVarP(&recordFile, "record", "", "", "also write all events to this session file, to be replayed with 'pspy replay'")
 
 	log.SetOutput(os.Stdout)
 }
 
 func root(cmd *cobra.Command, args []string) {
+	cfg, err := loadConfig(cmd.Flags())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	logger := logging.NewLogger(debug)
+	setInfoOutput(logger, cfg)
 
 	logger.Infof("%s", banner)
 
-	cfg := &config.Config{
-		RDirs:        rDirs,
-		Dirs:         dirs,
-		LogPS:        logPS,
-		LogFS:        logFS,
-		DrainFor:     1 * time.Second,
-		TriggerEvery: time.Duration(triggerInterval) * time.Millisecond,
-		Colored:      colored,
-	}
 	fsw := fswatcher.NewFSWatcher()
 	defer fsw.Close()
 
-	pss := psscanner.NewPSScanner(ppid, cmdLength)
+	pss := newPSScanner(logger, cfg)
 
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
 	b := &pspy.Bindings{
@@ -105,14 +154,154 @@ func root(cmd *cobra.Command, args []string) {
 		FSW:    fsw,
 		PSS:    pss,
 	}
+	// without a config file, there is nothing to reload and SIGHUP exits as before
+	if configFile != "" {
+		b.Reload = func() (*config.Config, error) {
+			newCfg, err := loadConfig(cmd.Flags())
+			if err != nil {
+				return nil, err
+			}
+			if ignored := newCfg.KeepStartupOptions(cfg); len(ignored) > 0 {
+				logger.Infof("Options only applied on restart: %s", strings.Join(ignored, ", "))
+			}
+			setInfoOutput(logger, newCfg)
+			return newCfg, nil
+		}
+	}
+	checker := findings.NewChecker()
+	if checker.Root() && cfg.Findings {
+		logger.Infof("Not looking for writable files: running as root, who can modify any file")
+	}
+	b.Checker = checker
+	var rec *session.Writer
+	if recordFile != "" {
+		if rec, err = session.Create(recordFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		b.Recorder = rec
+		logger.Infof("Recording events to %s", recordFile)
+	}
 	exit := pspy.Start(cfg, b, sigCh)
 	<-exit
+	if rec != nil {
+		rec.Close()
+	}
 	os.Exit(0)
 }
 
+// loadConfig builds the configuration from the flags, the config file and the profile.
+// Flags given on the command line take precedence over the file, which takes precedence over the profile.
+func loadConfig(flags *pflag.FlagSet) (*config.Config, error) {
+	cfg := &config.Config{
+		File:         configFile,
+		RDirs:        rDirs,
+		Dirs:         dirs,
+		LogPS:        logPS,
+		LogFS:        logFS,
+		LogExits:     logExits,
+		LogMissed:    logMissed,
+		Findings:     logFindings,
+		DrainFor:     1 * time.Second,
+		TriggerEvery: time.Duration(triggerInterval) * time.Millisecond,
+		TriggerMin:   time.Duration(triggerMin) * time.Millisecond,
+		TriggerMax:   time.Duration(triggerMax) * time.Millisecond,
+		CPUBudget:    cpuBudget,
+		Colored:      colored,
+		ColorBy:      colorBy,
+		Format:       format,
+		Redact:       redact,
+		Filter:       filterExpr,
+		Exclude:      excludeExpr,
+		Ppid:         ppid,
+		Ancestry:     ancestry,
+		Tree:         tree,
+		Sessions:     sessions,
+		Probe:        probe,
+		Rescan:       time.Duration(rescan) * time.Millisecond,
+		Recheck:      recheck,
+		CmdLength:    cmdLength,
+		Enrich:       enrich,
+		EnvAllow:     envAllow,
+		EnvDeny:      envDeny,
+		Scanner:      scanner,
+		ProcRoot:     procRoot,
+	}
+
+	values := map[string]interface{}{}
+	if configFile != "" {
+		var err error
+		if values, err = config.LoadFile(configFile); err != nil {
+			return nil, err
+		}
+	}
+	values, name, err := config.WithProfile(values, profile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Profile = name
+
+	for name := range values {
+		if f := flags.Lookup(name); f != nil && f.Changed {
+			delete(values, name)
+		}
+	}
+	if err := cfg.Apply(values); err != nil {
+		return nil, err
+	}
+	if cfg.Filter, err = filter.ReadExpr(cfg.Filter); err != nil {
+		return nil, err
+	}
+	if cfg.Exclude, err = filter.ReadExpr(cfg.Exclude); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func setInfoOutput(logger *logging.Logger, cfg *config.Config) {
+	if cfg.Format == config.FormatJSON {
+		// keep stdout clean for JSON Lines
+		logger.SetInfoOutput(os.Stderr)
+	} else {
+		logger.SetInfoOutput(os.Stdout)
+	}
+}
+
+func newPSScanner(logger *logging.Logger, cfg *config.Config) pspy.PSScanner {
+	// already validated
+	enrichment, _ := psscanner.ParseEnrichment(cfg.Enrich)
+	enrichment.EnvAllow, enrichment.EnvDeny = cfg.EnvAllow, cfg.EnvDeny
+	pss := psscanner.NewPSScanner(cfg.Ppid, cfg.Ancestry, cfg.Probe, cfg.Rescan, cfg.Recheck, cfg.CmdLength, enrichment, psscanner.NewProcFS(cfg.ProcRoot))
+	if cfg.ProcRoot != "/proc" && (cfg.Probe > 0 || cfg.LogMissed) {
+		// the last PID allocated is only known for our own namespace
+		logger.Infof("Not probing PIDs or estimating missed processes in %s", cfg.ProcRoot)
+	}
+	if cfg.Scanner == config.ScannerProcfs {
+		return pss
+	}
+	if cfg.ProcRoot != "/proc" {
+		// the proc connector reports PIDs of our own namespace, which may not match the alternate tree
+		logger.Infof("Scanning %s instead of using the proc connector", cfg.ProcRoot)
+		return pss
+	}
+
+	nls, err := psscanner.NewNetlinkScanner(pss)
+	if err != nil {
+		if cfg.Scanner == config.ScannerNetlink {
+			logger.Infof("Can't use the proc connector, falling back to scanning /proc: %v", err)
+		}
+		return pss
+	}
+	logger.Infof("Receiving process events from the kernel's proc connector")
+	return nls
+}
+
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
@@ -2,19 +2,241 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"time"
+
+	"github.com/dominicbreuker/pspy/internal/filter"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// ColorByOptions are the keys process events can be colored by. Keys other than uid come
+// from enrich cgroup, events without them are colored by uid.
+var ColorByOptions = []string{"uid", "container", "pod", "unit", "slice"}
+
+// DefaultTreeAncestry is the number of ancestors recorded for the tree view unless set explicitly
+const DefaultTreeAncestry = 8
+
+const (
+	ScannerAuto    = "auto"
+	ScannerProcfs  = "procfs"
+	ScannerNetlink = "netlink"
 )
 
 type Config struct {
+	File         string // config file the options were read from, if any
+	Profile      string
 	RDirs        []string
 	Dirs         []string
 	LogFS        bool
 	LogPS        bool
+	LogExits     bool
+	LogMissed    bool // estimate processes missed between scans
+	Findings     bool // report files run by other users that the current user can modify
 	DrainFor     time.Duration
 	TriggerEvery time.Duration
+	TriggerMin   time.Duration
+	TriggerMax   time.Duration
+	CPUBudget    float64
 	Colored      bool
+	ColorBy      string // what process events are colored by, one of ColorByOptions, uid if empty
+	Format       string
+	Redact       bool   // mask secrets in command lines
+	Filter       string // filter expression for printed events
+	Exclude      string // filter expression for events not to print
+	Ppid         bool
+	Ancestry     int           // levels of ancestors reported for new processes
+	Tree         bool          // print new processes indented beneath their parents
+	Sessions     bool          // group printed commands by login session
+	Probe        int           // PIDs after the last allocated one looked up before each scan
+	Rescan       time.Duration // how often known processes are checked for a new argv or executable
+	Recheck      bool          // check new processes for a new argv or executable in the next scans
+	CmdLength    int
+	Enrich       []string
+	EnvAllow     []string // patterns of environment variables recorded with enrich env, all if empty
+	EnvDeny      []string // patterns of environment variables never recorded
+	Scanner      string
+	ProcRoot     string
 }
 
 func (c Config) String() string {
-	return fmt.Sprintf("Printing events (colored=%t): processes=%t | file-system-events=%t ||| Scanning for processes every %v and on inotify events ||| Watching directories: %+v (recursive) | %+v (non-recursive)", c.Colored, c.LogPS, c.LogFS, c.TriggerEvery, c.RDirs, c.Dirs)
+	colored := fmt.Sprintf("%t", c.Colored)
+	if c.Colored && c.ColorBy != "" && c.ColorBy != "uid" {
+		colored += " by " + c.ColorBy
+	}
+	lines := []string{
+		fmt.Sprintf("Printing events (colored=%s, format=%s, tree=%t, sessions=%t, redact=%t): processes=%t | exits=%t | missed=%t | findings=%t | file-system-events=%t", colored, c.Format, c.Tree, c.Sessions, c.Redact, c.LogPS, c.LogExits, c.LogMissed, c.Findings, c.LogFS),
+		fmt.Sprintf("Scanning for processes every %v%s and on inotify events", c.TriggerEvery, c.schedule()),
+		fmt.Sprintf("Watching directories: %+v (recursive) | %+v (non-recursive)", c.RDirs, c.Dirs),
+	}
+	if c.Filter != "" || c.Exclude != "" {
+		lines = append(lines, fmt.Sprintf("Filtering events: include=%s | exclude=%s", orNone(c.Filter), orNone(c.Exclude)))
+	}
+	if c.Scanner != "" {
+		line := fmt.Sprintf("Process details: scanner=%s | proc=%s | probe=%d | rescan=%v | recheck=%t | ppid=%t | ancestry=%d | truncate=%d | enrich=%v", c.Scanner, c.ProcRoot, c.Probe, c.Rescan, c.Recheck, c.Ppid, c.Ancestry, c.CmdLength, c.Enrich)
+		if len(c.EnvAllow) > 0 || len(c.EnvDeny) > 0 {
+			line += fmt.Sprintf(" | env-allow=%v | env-deny=%v", c.EnvAllow, c.EnvDeny)
+		}
+		lines = append(lines, line)
+	}
+	if c.File != "" || c.Profile != "" {
+		lines = append(lines, fmt.Sprintf("Loaded from: file=%s | profile=%s", orNone(c.File), orNone(c.Profile)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (c Config) schedule() string {
+	s := ""
+	if c.TriggerMin < c.TriggerMax {
+		s += fmt.Sprintf(" (adapting between %v and %v)", c.TriggerMin, c.TriggerMax)
+	}
+	if c.CPUBudget > 0 {
+		s += fmt.Sprintf(" (cpu budget %v%%)", c.CPUBudget)
+	}
+	return s
+}
+
+// Validate checks the options for consistency. Scan interval bounds
+// left at zero default to the scan interval, ancestry defaults to
+// DefaultTreeAncestry levels for the tree view and the sessions view
+// adds the session details to the enrichment.
+func (c *Config) Validate() error {
+	if c.Format != FormatText && c.Format != FormatJSON {
+		return fmt.Errorf("invalid format '%s': must be '%s' or '%s'", c.Format, FormatText, FormatJSON)
+	}
+	if c.ColorBy != "" && !contains(ColorByOptions, c.ColorBy) {
+		return fmt.Errorf("invalid color-by '%s': must be one of %s", c.ColorBy, strings.Join(ColorByOptions, ", "))
+	}
+	if c.Scanner != ScannerAuto && c.Scanner != ScannerProcfs && c.Scanner != ScannerNetlink {
+		return fmt.Errorf("invalid scanner '%s': must be '%s', '%s' or '%s'", c.Scanner, ScannerAuto, ScannerProcfs, ScannerNetlink)
+	}
+	if c.ProcRoot == "" {
+		return fmt.Errorf("invalid proc root: must not be empty")
+	}
+	if c.Rescan < 0 {
+		return fmt.Errorf("invalid rescan %v: must not be negative", c.Rescan)
+	}
+	if c.Probe < 0 {
+		return fmt.Errorf("invalid probe %d: must not be negative", c.Probe)
+	}
+	if c.Ancestry < 0 {
+		return fmt.Errorf("invalid ancestry %d: must not be negative", c.Ancestry)
+	}
+	if c.Tree && c.Ancestry == 0 {
+		c.Ancestry = DefaultTreeAncestry
+	}
+	if c.Sessions && !contains(c.Enrich, "session") {
+		c.Enrich = append(c.Enrich[:len(c.Enrich):len(c.Enrich)], "session")
+	}
+	if c.CmdLength <= 0 {
+		return fmt.Errorf("invalid truncate %d: must be positive", c.CmdLength)
+	}
+	if _, err := psscanner.ParseEnrichment(c.Enrich); err != nil {
+		return err
+	}
+	for _, patterns := range [][]string{c.EnvAllow, c.EnvDeny} {
+		if err := psscanner.ValidateEnvPatterns(patterns); err != nil {
+			return err
+		}
+	}
+	if _, err := filter.New(c.Filter, c.Exclude); err != nil {
+		return err
+	}
+	if c.TriggerEvery <= 0 {
+		return fmt.Errorf("invalid interval %v: must be positive", c.TriggerEvery)
+	}
+	if c.TriggerMin == 0 {
+		c.TriggerMin = c.TriggerEvery
+	}
+	if c.TriggerMax == 0 {
+		c.TriggerMax = c.TriggerEvery
+	}
+	if c.TriggerMin < 0 || c.TriggerMin > c.TriggerEvery || c.TriggerMax < c.TriggerEvery {
+		return fmt.Errorf("invalid intervals: need 0 < interval-min (%v) <= interval (%v) <= interval-max (%v)", c.TriggerMin, c.TriggerEvery, c.TriggerMax)
+	}
+	if c.CPUBudget < 0 {
+		return fmt.Errorf("invalid cpu budget %v: must not be negative", c.CPUBudget)
+	}
+	return nil
+}
+
+// KeepStartupOptions resets options that can't change while running to their values
+// in the running configuration and returns the names of those that differed
+func (c *Config) KeepStartupOptions(running *Config) []string {
+	ignored := make([]string, 0)
+	keep := func(name string, v, r interface{}) {
+		if fmt.Sprintf("%v", v) != fmt.Sprintf("%v", r) {
+			ignored = append(ignored, name)
+		}
+	}
+	keep("ppid", c.Ppid, running.Ppid)
+	keep("ancestry", c.Ancestry, running.Ancestry)
+	// the tree and sessions views need ancestors and session details recorded from the start
+	keep("tree", c.Tree, running.Tree)
+	keep("sessions", c.Sessions, running.Sessions)
+	keep("probe", c.Probe, running.Probe)
+	keep("rescan", c.Rescan, running.Rescan)
+	keep("recheck", c.Recheck, running.Recheck)
+	keep("truncate", c.CmdLength, running.CmdLength)
+	keep("enrich", c.Enrich, running.Enrich)
+	keep("env-allow", c.EnvAllow, running.EnvAllow)
+	keep("env-deny", c.EnvDeny, running.EnvDeny)
+	keep("scanner", c.Scanner, running.Scanner)
+	keep("proc-root", c.ProcRoot, running.ProcRoot)
+
+	c.Ppid, c.Ancestry, c.Probe, c.Rescan, c.CmdLength, c.Enrich, c.Scanner, c.ProcRoot = running.Ppid, running.Ancestry, running.Probe, running.Rescan, running.CmdLength, running.Enrich, running.Scanner, running.ProcRoot
+	c.Recheck, c.EnvAllow, c.EnvDeny = running.Recheck, running.EnvAllow, running.EnvDeny
+	c.Tree, c.Sessions = running.Tree, running.Sessions
+	return ignored
+}
+
+// Changes describes the differences between two configurations, one entry per changed option
+func Changes(old, new *Config) []string {
+	changes := make([]string, 0)
+	add := func(name string, o, n interface{}) {
+		if before, after := fmt.Sprintf("%v", o), fmt.Sprintf("%v", n); before != after {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", name, before, after))
+		}
+	}
+	add("recursive dirs", old.RDirs, new.RDirs)
+	add("dirs", old.Dirs, new.Dirs)
+	add("processes", old.LogPS, new.LogPS)
+	add("file-system-events", old.LogFS, new.LogFS)
+	add("exits", old.LogExits, new.LogExits)
+	add("missed", old.LogMissed, new.LogMissed)
+	add("findings", old.Findings, new.Findings)
+	add("colored", old.Colored, new.Colored)
+	add("color-by", old.ColorBy, new.ColorBy)
+	add("format", old.Format, new.Format)
+	add("tree", old.Tree, new.Tree)
+	add("sessions", old.Sessions, new.Sessions)
+	add("redact", old.Redact, new.Redact)
+	add("interval", old.TriggerEvery, new.TriggerEvery)
+	add("interval-min", old.TriggerMin, new.TriggerMin)
+	add("interval-max", old.TriggerMax, new.TriggerMax)
+	add("cpu-budget", old.CPUBudget, new.CPUBudget)
+	add("filter", old.Filter, new.Filter)
+	add("exclude", old.Exclude, new.Exclude)
+	add("profile", old.Profile, new.Profile)
+	return changes
 }
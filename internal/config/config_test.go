@@ -0,0 +1,289 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected map[string]interface{}
+		err      string
+	}{
+		{name: "empty", input: "# nothing\n\n", expected: map[string]interface{}{}},
+		{name: "scalars", input: "interval: 200 # ms\nformat: \"json\"\ncolor: 'false'\n", expected: map[string]interface{}{"interval": "200", "format": "json", "color": "false"}},
+		{name: "lists", input: "dirs: [/tmp, \"/var/my dir\"]\nrecursive_dirs:\n  - /usr\n  - '/etc'\nempty: []\n", expected: map[string]interface{}{
+			"dirs":           []string{"/tmp", "/var/my dir"},
+			"recursive_dirs": []string{"/usr", "/etc"},
+			"empty":          []string{},
+		}},
+		{name: "unindented-list", input: "dirs:\n- /tmp\n- /opt\nexits: true\n", expected: map[string]interface{}{"dirs": []string{"/tmp", "/opt"}, "exits": "true"}},
+		{name: "nested", input: "a:\n  b: 1\n  c:\n    d: [x]\ne:\n", expected: map[string]interface{}{
+			"a": map[string]interface{}{"b": "1", "c": map[string]interface{}{"d": []string{"x"}}},
+			"e": nil,
+		}},
+		{name: "quoted-hash", input: "filter: 'cmd=~\"#x\"' # comment\n", expected: map[string]interface{}{"filter": "cmd=~\"#x\""}},
+		{name: "bad-indent", input: "a: 1\n  b: 2\n", err: "line 2: unexpected indentation"},
+		{name: "no-key", input: "just text\n", err: "line 1: expected 'key: value'"},
+		{name: "duplicate", input: "a: 1\na: 2\n", err: "line 2: duplicate key 'a'"},
+		{name: "bad-list", input: "a: [x, y\n", err: "line 1: unterminated list '[x, y'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := parseYAML(strings.NewReader(tt.input))
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("Wrong error: got %v but wanted %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(m, tt.expected) {
+				t.Errorf("Wrong result: got %#v but wanted %#v", m, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	cfg := &Config{RDirs: []string{"/usr"}, LogPS: true, Format: FormatText}
+	err := cfg.Apply(map[string]interface{}{
+		"recursive_dirs": []string{"/opt"},
+		"dirs":           "/tmp",
+		"fsevents":       "true",
+		"procevents":     "false",
+		"interval":       "250",
+		"cpu-budget":     "2.5",
+		"format":         "json",
+		"redact":         "true",
+		"sessions":       "true",
+		"recheck":        "true",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &Config{RDirs: []string{"/opt"}, Dirs: []string{"/tmp"}, LogFS: true, TriggerEvery: 250 * time.Millisecond, CPUBudget: 2.5, Format: FormatJSON, Redact: true, Sessions: true, Recheck: true}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Wrong config: got %+v but wanted %+v", cfg, expected)
+	}
+
+	for values, msg := range map[string]string{
+		"interval: fast":  "option 'interval': strconv.Atoi: parsing \"fast\": invalid syntax",
+		"color: [a, b]":   "option 'color': expected a single value but got [a b]",
+		"unknown: 1":      "option 'unknown': unknown option",
+		"dirs:\n  a: b\n": "option 'dirs': expected a list but got map[a:b]",
+	} {
+		m, err := parseYAML(strings.NewReader(values))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if err := cfg.Apply(m); err == nil || err.Error() != msg {
+			t.Errorf("Wrong error for '%s': got %v but wanted %s", values, err, msg)
+		}
+	}
+}
+
+func TestChanges(t *testing.T) {
+	old := &Config{RDirs: []string{"/usr"}, Dirs: []string{}, LogPS: true, TriggerEvery: 100 * time.Millisecond}
+	new := &Config{RDirs: []string{"/usr", "/opt"}, Dirs: []string{}, LogPS: true, LogFS: true, TriggerEvery: 100 * time.Millisecond}
+
+	changes := Changes(old, new)
+	expected := []string{"recursive dirs [/usr] -> [/usr /opt]", "file-system-events false -> true"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Errorf("Wrong changes: got %v but wanted %v", changes, expected)
+	}
+	if changes := Changes(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes but got %v", changes)
+	}
+}
+
+func TestWithProfile(t *testing.T) {
+	file := map[string]interface{}{
+		"profile":  "ctf",
+		"interval": "20",
+		"profiles": map[string]interface{}{
+			"mine": map[string]interface{}{"exits": "true", "interval": "1000"},
+		},
+	}
+	tests := []struct {
+		name     string
+		values   map[string]interface{}
+		profile  string
+		expected map[string]interface{}
+		used     string
+		err      string
+	}{
+		{name: "none", values: map[string]interface{}{"exits": "true"}, expected: map[string]interface{}{"exits": "true"}},
+		{name: "builtin-from-flag", values: map[string]interface{}{}, profile: "ctf", used: "ctf", expected: Profiles["ctf"]},
+		{name: "file-overrides-profile", values: file, used: "ctf", expected: map[string]interface{}{
+			"interval": "20", "interval-min": "10", "ppid": "true", "ancestry": "5", "probe": "16", "findings": "true", "enrich": []string{"exe", "cwd", "ids"},
+		}},
+		{name: "custom-profile", values: file, profile: "mine", used: "mine", expected: map[string]interface{}{"exits": "true", "interval": "20"}},
+		{name: "unknown", values: file, profile: "nope", err: "unknown profile 'nope': must be one of ctf, forensics, low-noise or defined in the config file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, used, err := WithProfile(tt.values, tt.profile)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("Wrong error: got %v but wanted %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if used != tt.used {
+				t.Errorf("Wrong profile: got '%s' but wanted '%s'", used, tt.used)
+			}
+			if !reflect.DeepEqual(values, tt.expected) {
+				t.Errorf("Wrong options: got %v but wanted %v", values, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBuiltinProfilesValid(t *testing.T) {
+	for _, name := range ProfileNames() {
+		cfg := validConfig()
+		if err := cfg.Apply(Profiles[name]); err != nil {
+			t.Errorf("Profile %s: %v", name, err)
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("Profile %s: %v", name, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *Config)
+		err    string
+	}{
+		{name: "valid", change: func(c *Config) {}},
+		{name: "format", change: func(c *Config) { c.Format = "xml" }, err: "invalid format 'xml': must be 'text' or 'json'"},
+		{name: "scanner", change: func(c *Config) { c.Scanner = "ebpf" }, err: "invalid scanner 'ebpf': must be 'auto', 'procfs' or 'netlink'"},
+		{name: "enrich", change: func(c *Config) { c.Enrich = []string{"net"} }, err: "unknown process detail 'net': must be one of exe, cwd, comm, start, ids, cgroup, ns, session, pipes, env"},
+		{name: "env-deny", change: func(c *Config) { c.EnvDeny = []string{"AWS_[*"} }, err: "invalid pattern 'AWS_[*' for environment variables: syntax error in pattern"},
+		{name: "color-by", change: func(c *Config) { c.ColorBy = "user" }, err: "invalid color-by 'user': must be one of uid, container, pod, unit, slice"},
+		{name: "filter", change: func(c *Config) { c.Filter = "uid==" }, err: "parsing filter: expected a value after '==' at position 4 but got end of expression"},
+		{name: "exclude", change: func(c *Config) { c.Exclude = "cmd<1" }, err: "parsing exclude filter: can't compare text field 'cmd' with '<' at position 4"},
+		{name: "truncate", change: func(c *Config) { c.CmdLength = 0 }, err: "invalid truncate 0: must be positive"},
+		{name: "rescan", change: func(c *Config) { c.Rescan = -time.Second }, err: "invalid rescan -1s: must not be negative"},
+		{name: "probe", change: func(c *Config) { c.Probe = -2 }, err: "invalid probe -2: must not be negative"},
+		{name: "ancestry", change: func(c *Config) { c.Ancestry = -1 }, err: "invalid ancestry -1: must not be negative"},
+		{name: "interval", change: func(c *Config) { c.TriggerEvery = 0 }, err: "invalid interval 0s: must be positive"},
+		{name: "bounds", change: func(c *Config) { c.TriggerMax = 50 * time.Millisecond }, err: "invalid intervals: need 0 < interval-min (100ms) <= interval (100ms) <= interval-max (50ms)"},
+		{name: "budget", change: func(c *Config) { c.CPUBudget = -1 }, err: "invalid cpu budget -1: must not be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig()
+			tt.change(cfg)
+			err := cfg.Validate()
+			if tt.err == "" && err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if tt.err != "" && (err == nil || err.Error() != tt.err) {
+				t.Fatalf("Wrong error: got %v but wanted %s", err, tt.err)
+			}
+		})
+	}
+
+	cfg := validConfig()
+	cfg.Validate()
+	if cfg.TriggerMin != cfg.TriggerEvery || cfg.TriggerMax != cfg.TriggerEvery {
+		t.Errorf("Interval bounds not defaulted: %v %v", cfg.TriggerMin, cfg.TriggerMax)
+	}
+	if cfg.Ancestry != 0 {
+		t.Errorf("Ancestry enabled without tree view: %d", cfg.Ancestry)
+	}
+
+	cfg = validConfig()
+	cfg.Sessions = true
+	cfg.Validate()
+	if !reflect.DeepEqual(cfg.Enrich, []string{"session"}) {
+		t.Errorf("Session details not enabled for sessions view: %v", cfg.Enrich)
+	}
+
+	cfg = validConfig()
+	cfg.Tree = true
+	cfg.Validate()
+	if cfg.Ancestry != DefaultTreeAncestry {
+		t.Errorf("Ancestry not defaulted for tree view: %d", cfg.Ancestry)
+	}
+	cfg = validConfig()
+	cfg.Tree, cfg.Ancestry = true, 2
+	cfg.Validate()
+	if cfg.Ancestry != 2 {
+		t.Errorf("Ancestry overridden for tree view: %d", cfg.Ancestry)
+	}
+}
+
+func TestKeepStartupOptions(t *testing.T) {
+	running := validConfig()
+	cfg := validConfig()
+	cfg.Enrich = []string{"exe"}
+	cfg.ProcRoot = "/host/proc"
+	cfg.Sessions = true
+	cfg.LogFS = true
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ignored := cfg.KeepStartupOptions(running)
+	if !reflect.DeepEqual(ignored, []string{"sessions", "enrich", "proc-root"}) {
+		t.Errorf("Wrong ignored options: %v", ignored)
+	}
+	expected := validConfig()
+	expected.LogFS = true
+	if err := expected.Validate(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Errorf("Wrong config: got %+v but wanted %+v", cfg, expected)
+	}
+}
+
+func TestString(t *testing.T) {
+	cfg := validConfig()
+	cfg.File = "pspy.yaml"
+	cfg.Profile = "ctf"
+	cfg.TriggerMin = 10 * time.Millisecond
+	cfg.TriggerMax = time.Second
+	cfg.CPUBudget = 2.5
+
+	expected := `Printing events (colored=true, format=text, tree=false, sessions=false, redact=false): processes=true | exits=false | missed=false | findings=false | file-system-events=false
+Scanning for processes every 100ms (adapting between 10ms and 1s) (cpu budget 2.5%) and on inotify events
+Watching directories: [/usr] (recursive) | [] (non-recursive)
+Process details: scanner=auto | proc=/proc | probe=0 | rescan=0s | recheck=false | ppid=false | ancestry=0 | truncate=2048 | enrich=[]
+Loaded from: file=pspy.yaml | profile=ctf`
+	if cfg.String() != expected {
+		t.Errorf("Wrong string:\n%s\nwanted:\n%s", cfg, expected)
+	}
+}
+
+func validConfig() *Config {
+	return &Config{
+		RDirs:        []string{"/usr"},
+		Dirs:         []string{},
+		LogPS:        true,
+		TriggerEvery: 100 * time.Millisecond,
+		Colored:      true,
+		Format:       FormatText,
+		CmdLength:    2048,
+		Enrich:       []string{},
+		Scanner:      ScannerAuto,
+		ProcRoot:     "/proc",
+	}
+}
@@ -0,0 +1,448 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadFile reads options from a configuration file. Options are named like the
+// command line flags, e.g., "recursive_dirs" or "interval".
+func LoadFile(path string) (map[string]interface{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening config file: %v", err)
+	}
+	defer f.Close()
+
+	values, err := parseYAML(f)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// Profiles are predefined sets of options for common use cases
+var Profiles = map[string]map[string]interface{}{
+	// catch short-lived processes such as cron jobs and show who really runs them
+	"ctf": {
+		"interval":     "50",
+		"interval-min": "10",
+		"ppid":         "true",
+		"ancestry":     "5",
+		"probe":        "16",
+		"findings":     "true",
+		"enrich":       []string{"exe", "cwd", "ids"},
+	},
+	// few watchers and a CPU budget, for leaving pspy running on busy production machines
+	"low-noise": {
+		"recursive_dirs": []string{},
+		"dirs":           []string{"/usr/bin", "/usr/sbin", "/usr/local/bin", "/etc", "/tmp"},
+		"interval":       "500",
+		"interval-max":   "2000",
+		"cpu-budget":     "2",
+		"fsevents":       "false",
+	},
+	// record everything in machine readable form
+	"forensics": {
+		"format":   "json",
+		"color":    "false",
+		"exits":    "true",
+		"missed":   "true",
+		"fsevents": "true",
+		"ppid":     "true",
+		"ancestry": "8",
+		"rescan":   "5000",
+		"truncate": "16384",
+		"enrich":   []string{"exe", "cwd", "comm", "start", "ids"},
+	},
+}
+
+// WithProfile merges the options of a profile into the options of a config file, which take
+// precedence. The profile is given by name or, if name is empty, by the file's "profile" option.
+// Files may define their own profiles in a "profiles" section, replacing built-in ones of the same name.
+// Returns the options without "profile" and "profiles" as well as the name of the profile used.
+func WithProfile(values map[string]interface{}, name string) (map[string]interface{}, string, error) {
+	merged := make(map[string]interface{})
+	for k, v := range values {
+		if k != "profile" && k != "profiles" {
+			merged[k] = v
+		}
+	}
+
+	if name == "" {
+		if v, ok := values["profile"]; ok {
+			n, err := toString(v)
+			if err != nil {
+				return nil, "", fmt.Errorf("option 'profile': %v", err)
+			}
+			name = n
+		}
+	}
+	if name == "" {
+		return merged, "", nil
+	}
+
+	profile, ok := Profiles[name]
+	if custom, isMap := values["profiles"].(map[string]interface{}); isMap {
+		if p, isMap := custom[name].(map[string]interface{}); isMap {
+			profile, ok = p, true
+		}
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unknown profile '%s': must be one of %s or defined in the config file", name, strings.Join(ProfileNames(), ", "))
+	}
+	for k, v := range profile {
+		if _, ok := merged[k]; !ok {
+			merged[k] = v
+		}
+	}
+	return merged, name, nil
+}
+
+// ProfileNames returns the names of the built-in profiles
+func ProfileNames() []string {
+	names := make([]string, 0, len(Profiles))
+	for name := range Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Apply sets the options found in a configuration file
+func (c *Config) Apply(values map[string]interface{}) error {
+	for key, v := range values {
+		var err error
+		switch key {
+		case "recursive_dirs":
+			c.RDirs, err = toStrings(v)
+		case "dirs":
+			c.Dirs, err = toStrings(v)
+		case "procevents":
+			c.LogPS, err = toBool(v)
+		case "fsevents":
+			c.LogFS, err = toBool(v)
+		case "exits":
+			c.LogExits, err = toBool(v)
+		case "missed":
+			c.LogMissed, err = toBool(v)
+		case "findings":
+			c.Findings, err = toBool(v)
+		case "color":
+			c.Colored, err = toBool(v)
+		case "format":
+			c.Format, err = toString(v)
+		case "color-by":
+			c.ColorBy, err = toString(v)
+		case "redact":
+			c.Redact, err = toBool(v)
+		case "interval":
+			c.TriggerEvery, err = toMillis(v)
+		case "interval-min":
+			c.TriggerMin, err = toMillis(v)
+		case "interval-max":
+			c.TriggerMax, err = toMillis(v)
+		case "cpu-budget":
+			c.CPUBudget, err = toFloat(v)
+		case "filter":
+			c.Filter, err = toString(v)
+		case "exclude":
+			c.Exclude, err = toString(v)
+		case "ppid":
+			c.Ppid, err = toBool(v)
+		case "ancestry":
+			c.Ancestry, err = toInt(v)
+		case "rescan":
+			c.Rescan, err = toMillis(v)
+		case "recheck":
+			c.Recheck, err = toBool(v)
+		case "probe":
+			c.Probe, err = toInt(v)
+		case "tree":
+			c.Tree, err = toBool(v)
+		case "sessions":
+			c.Sessions, err = toBool(v)
+		case "truncate":
+			c.CmdLength, err = toInt(v)
+		case "enrich":
+			c.Enrich, err = toStrings(v)
+			c.Enrich = splitCommas(c.Enrich)
+		case "env-allow":
+			c.EnvAllow, err = toStrings(v)
+			c.EnvAllow = splitCommas(c.EnvAllow)
+		case "env-deny":
+			c.EnvDeny, err = toStrings(v)
+			c.EnvDeny = splitCommas(c.EnvDeny)
+		case "scanner":
+			c.Scanner, err = toString(v)
+		case "proc-root":
+			c.ProcRoot, err = toString(v)
+		default:
+			err = fmt.Errorf("unknown option")
+		}
+		if err != nil {
+			return fmt.Errorf("option '%s': %v", key, err)
+		}
+	}
+	return nil
+}
+
+func toString(v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected a single value but got %v", v)
+	}
+	return s, nil
+}
+
+func toStrings(v interface{}) ([]string, error) {
+	switch l := v.(type) {
+	case []string:
+		return l, nil
+	case string:
+		return []string{l}, nil
+	case nil:
+		return []string{}, nil
+	}
+	return nil, fmt.Errorf("expected a list but got %v", v)
+}
+
+func toBool(v interface{}) (bool, error) {
+	s, err := toString(v)
+	if err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(s)
+}
+
+func toFloat(v interface{}) (float64, error) {
+	s, err := toString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+func toInt(v interface{}) (int, error) {
+	s, err := toString(v)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+func toMillis(v interface{}) (time.Duration, error) {
+	ms, err := toInt(v)
+	return time.Duration(ms) * time.Millisecond, err
+}
+
+// splitCommas allows lists to be written like flags, e.g., "exe,ids"
+func splitCommas(l []string) []string {
+	items := make([]string, 0, len(l))
+	for _, s := range l {
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// parseYAML understands the subset of YAML used by pspy config files: nested mappings,
+// lists of scalars in block ("- a") or flow ("[a, b]") style, quoted scalars and comments.
+// Scalars are returned as strings, lists as []string and mappings as map[string]interface{}.
+func parseYAML(r io.Reader) (map[string]interface{}, error) {
+	lines := make([]yamlLine, 0)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimRight(stripComment(scanner.Text()), " \t")
+		content := strings.TrimLeft(text, " ")
+		if content == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", n)
+		}
+		lines = append(lines, yamlLine{n: n, indent: len(text) - len(content), content: content})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	p := &yamlParser{lines: lines}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+	m, err := p.parseMap(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.pos].n)
+	}
+	return m, nil
+}
+
+type yamlLine struct {
+	n       int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+func (p *yamlParser) parseMap(indent int) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) {
+		l := p.lines[p.pos]
+		if l.indent < indent {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", l.n)
+		}
+		if strings.HasPrefix(l.content, "- ") || l.content == "-" {
+			return nil, fmt.Errorf("line %d: unexpected list item", l.n)
+		}
+		i := strings.Index(l.content, ":")
+		if i <= 0 || (i+1 < len(l.content) && l.content[i+1] != ' ') {
+			return nil, fmt.Errorf("line %d: expected 'key: value'", l.n)
+		}
+		key := strings.TrimSpace(l.content[:i])
+		if _, ok := m[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key '%s'", l.n, key)
+		}
+		rest := strings.TrimSpace(l.content[i+1:])
+		p.pos++
+
+		var err error
+		switch {
+		case rest != "":
+			m[key], err = parseValue(rest)
+		case p.pos < len(p.lines) && p.lines[p.pos].indent > indent:
+			next := p.lines[p.pos]
+			if strings.HasPrefix(next.content, "- ") || next.content == "-" {
+				m[key], err = p.parseList(next.indent)
+			} else {
+				m[key], err = p.parseMap(next.indent)
+			}
+		case p.pos < len(p.lines) && p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].content, "- "):
+			// lists are commonly not indented below their key
+			m[key], err = p.parseList(indent)
+		default:
+			m[key] = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.n, err)
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseList(indent int) ([]string, error) {
+	l := make([]string, 0)
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent != indent || !strings.HasPrefix(line.content, "- ") {
+			break
+		}
+		s, err := parseScalar(strings.TrimSpace(line.content[2:]))
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, s)
+		p.pos++
+	}
+	return l, nil
+}
+
+func parseValue(s string) (interface{}, error) {
+	if !strings.HasPrefix(s, "[") {
+		return parseScalar(s)
+	}
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list '%s'", s)
+	}
+	l := make([]string, 0)
+	for _, item := range splitFlow(s[1 : len(s)-1]) {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		v, err := parseScalar(item)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, v)
+	}
+	return l, nil
+}
+
+func parseScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	}
+	return s, nil
+}
+
+// splitFlow splits the items of a flow list at commas outside of quotes
+func splitFlow(s string) []string {
+	items := make([]string, 0)
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripComment removes a '#' comment that is not part of a quoted string
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
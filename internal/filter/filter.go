@@ -0,0 +1,331 @@
+// Package filter selects events with expressions such as
+//
+//	uid==0 && cmd=~"passwd" || op==CREATE && path=="/etc/*"
+//
+// Comparisons test a field of an event against a value. Strings compare with glob
+// patterns (== and !=) or regular expressions (=~ and !~), numbers with == != < <= > >=.
+// Comparisons are combined with && (and), || (or), ! (not) and parentheses.
+// A comparison on a field an event does not have, e.g., uid of a file system event, is false.
+package filter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// Fields lists the names usable in expressions
+var Fields = []string{"kind", "uid", "user", "pid", "ppid", "cmd", "exe", "cwd", "comm", "container", "pod", "unit", "slice", "cgroup", "pidns", "mntns", "userns", "tty", "sid", "pgrp", "loginuid", "sessionid", "op", "path", "reason"}
+
+// Filter decides which events to print
+type Filter struct {
+	include node // nil to include everything
+	exclude node // nil to exclude nothing
+	users   map[int]string
+}
+
+// New compiles filter expressions. Events are printed if they match include and do not
+// match exclude. Empty expressions include everything and exclude nothing respectively.
+func New(include, exclude string) (*Filter, error) {
+	f := &Filter{users: make(map[int]string)}
+	var err error
+	if f.include, err = parse(include); err != nil {
+		return nil, fmt.Errorf("parsing filter: %v", err)
+	}
+	if f.exclude, err = parse(exclude); err != nil {
+		return nil, fmt.Errorf("parsing exclude filter: %v", err)
+	}
+	return f, nil
+}
+
+// ReadExpr returns the expression itself or, if it starts with '@', the content of the
+// file it names. Lines of a file are joined and '#' starts a comment until the end of the line.
+func ReadExpr(s string) (string, error) {
+	if !strings.HasPrefix(s, "@") {
+		return s, nil
+	}
+	b, err := ioutil.ReadFile(s[1:])
+	if err != nil {
+		return "", fmt.Errorf("reading filter file: %v", err)
+	}
+	lines := strings.Split(string(b), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines[i] = ""
+		}
+	}
+	return strings.Join(lines, " "), nil
+}
+
+// MatchPS returns true if a process event should be printed
+func (f *Filter) MatchPS(pe psscanner.PSEvent) bool {
+	return f.match(&event{
+		kind:    pe.Kind.String(),
+		uid:     pe.UID,
+		pid:     pe.PID,
+		ppid:    pe.PPID,
+		cmd:     pe.CMD,
+		exe:     pe.Exe,
+		cwd:     pe.Cwd,
+		comm:    pe.Comm,
+		cgroup:  pe.Cgroup,
+		ns:      pe.NS,
+		session: pe.Session,
+	})
+}
+
+// MatchFS returns true if a file system event should be printed
+func (f *Filter) MatchFS(fe fswatcher.FSEvent) bool {
+	return f.match(&event{
+		kind: "FS",
+		uid:  -1,
+		pid:  -1,
+		ppid: -1,
+		op:   fe.Op,
+		path: fe.Path,
+		fs:   true,
+	})
+}
+
+// MatchFinding returns true if a finding should be printed. Its kind is FINDING, RISK or SECRET.
+func (f *Filter) MatchFinding(fd findings.Finding) bool {
+	return f.match(&event{
+		kind:   fd.Kind.String(),
+		uid:    fd.UID,
+		pid:    fd.PID,
+		ppid:   -1,
+		cmd:    fd.CMD,
+		path:   fd.Path,
+		reason: fd.Reason,
+	})
+}
+
+func (f *Filter) match(e *event) bool {
+	if f == nil {
+		return true
+	}
+	e.filter = f
+	if f.include != nil && !f.include.eval(e) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.eval(e)
+}
+
+// hook for testing
+var lookupUser = func(uid int) string {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+func (f *Filter) userName(uid int) string {
+	name, ok := f.users[uid]
+	if !ok {
+		name = lookupUser(uid)
+		f.users[uid] = name
+	}
+	return name
+}
+
+// event holds the fields of a process or file system event, -1 marks unknown numbers
+type event struct {
+	kind                string
+	uid, pid, ppid      int
+	cmd, exe, cwd, comm string
+	cgroup              *psscanner.Cgroup
+	ns                  *psscanner.Namespaces
+	session             *psscanner.Session
+	op, path, reason    string
+	fs                  bool
+	filter              *Filter
+}
+
+// field returns the value of a field as a number or string and whether the event has it
+func (e *event) field(name string) (int, string, bool) {
+	switch name {
+	case "kind":
+		return 0, e.kind, true
+	case "uid":
+		return e.uid, "", e.uid >= 0
+	case "user":
+		if e.uid < 0 {
+			return 0, "", false
+		}
+		name := e.filter.userName(e.uid)
+		return 0, name, name != ""
+	case "pid":
+		return e.pid, "", e.pid >= 0
+	case "ppid":
+		return e.ppid, "", e.ppid >= 0
+	case "cmd":
+		return 0, e.cmd, !e.fs
+	case "exe":
+		return 0, e.exe, e.exe != ""
+	case "cwd":
+		return 0, e.cwd, e.cwd != ""
+	case "comm":
+		return 0, e.comm, e.comm != ""
+	case "container", "pod", "unit", "slice", "cgroup":
+		return 0, e.cgroupField(name), e.cgroupField(name) != ""
+	case "pidns", "mntns", "userns":
+		return e.nsField(name), "", e.ns != nil
+	case "tty":
+		if e.session == nil {
+			return 0, "", false
+		}
+		return 0, e.session.TTY, e.session.TTY != ""
+	case "sid", "pgrp", "loginuid", "sessionid":
+		v := e.sessionField(name)
+		return v, "", v >= 0
+	case "op":
+		return 0, e.op, e.fs
+	case "path":
+		return 0, e.path, e.fs || e.path != ""
+	case "reason":
+		return 0, e.reason, e.reason != ""
+	}
+	return 0, "", false
+}
+
+func (e *event) cgroupField(name string) string {
+	if e.cgroup == nil {
+		return ""
+	}
+	switch name {
+	case "container":
+		return e.cgroup.Container
+	case "pod":
+		return e.cgroup.Pod
+	case "unit":
+		return e.cgroup.Unit
+	case "slice":
+		return e.cgroup.Slice
+	default:
+		return e.cgroup.Path
+	}
+}
+
+func (e *event) nsField(name string) int {
+	if e.ns == nil {
+		return 0
+	}
+	switch name {
+	case "pidns":
+		return int(e.ns.PID)
+	case "mntns":
+		return int(e.ns.Mount)
+	default:
+		return int(e.ns.User)
+	}
+}
+
+// sessionField returns a number of the session, -1 if unknown or unset
+func (e *event) sessionField(name string) int {
+	if e.session == nil {
+		return -1
+	}
+	switch name {
+	case "sid":
+		return e.session.SID
+	case "pgrp":
+		return e.session.PGRP
+	case "loginuid":
+		return e.session.LoginUID
+	default:
+		return e.session.SessionID
+	}
+}
+
+func isNumeric(field string) bool {
+	switch field {
+	case "uid", "pid", "ppid", "pidns", "mntns", "userns", "sid", "pgrp", "loginuid", "sessionid":
+		return true
+	}
+	return false
+}
+
+type node interface {
+	eval(e *event) bool
+}
+
+type and struct{ l, r node }
+
+func (n and) eval(e *event) bool { return n.l.eval(e) && n.r.eval(e) }
+
+type or struct{ l, r node }
+
+func (n or) eval(e *event) bool { return n.l.eval(e) || n.r.eval(e) }
+
+type not struct{ n node }
+
+func (n not) eval(e *event) bool { return !n.n.eval(e) }
+
+type numCmp struct {
+	field string
+	op    string
+	value int
+}
+
+func (n numCmp) eval(e *event) bool {
+	v, _, ok := e.field(n.field)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "==":
+		return v == n.value
+	case "!=":
+		return v != n.value
+	case "<":
+		return v < n.value
+	case "<=":
+		return v <= n.value
+	case ">":
+		return v > n.value
+	case ">=":
+		return v >= n.value
+	}
+	return false
+}
+
+type strCmp struct {
+	field  string
+	negate bool
+	re     *regexp.Regexp
+}
+
+func (n strCmp) eval(e *event) bool {
+	_, v, ok := e.field(n.field)
+	if !ok {
+		return false
+	}
+	return n.re.MatchString(v) != n.negate
+}
+
+// globToRegexp translates a glob pattern, in which '*' matches any characters including '/'
+// and '?' matches a single character, to an anchored regular expression
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
@@ -0,0 +1,233 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+var rootPasswd = psscanner.PSEvent{Kind: psscanner.KindNew, UID: 0, PID: 42, PPID: 1, CMD: "passwd alice", Exe: "/usr/bin/passwd"}
+var userCron = psscanner.PSEvent{Kind: psscanner.KindNew, UID: 1000, PID: 4242, PPID: -1, CMD: "/bin/sh -c /opt/backup.sh"}
+var userExit = psscanner.PSEvent{Kind: psscanner.KindExit, UID: 1000, PID: 4242, PPID: -1, CMD: "/bin/sh -c /opt/backup.sh", Lifetime: time.Second}
+var etcCreate = fswatcher.FSEvent{Op: "CREATE", Path: "/etc/cron.d/job"}
+var tmpOpen = fswatcher.FSEvent{Op: "OPEN", Path: "/tmp/x"}
+
+func TestMatch(t *testing.T) {
+	defer mockLookupUser(map[int]string{0: "root", 1000: "alice"})()
+
+	tests := []struct {
+		include string
+		exclude string
+		ps      []bool // rootPasswd, userCron, userExit
+		fs      []bool // etcCreate, tmpOpen
+	}{
+		{include: "", ps: []bool{true, true, true}, fs: []bool{true, true}},
+		{include: `uid==0 && cmd=~"passwd"`, ps: []bool{true, false, false}, fs: []bool{false, false}},
+		{include: `uid>=1000`, ps: []bool{false, true, true}, fs: []bool{false, false}},
+		{include: `user==root`, ps: []bool{true, false, false}, fs: []bool{false, false}},
+		{include: `user=~"^ali"`, ps: []bool{false, true, true}, fs: []bool{false, false}},
+		{include: `pid==42 or ppid==1`, ps: []bool{true, false, false}, fs: []bool{false, false}},
+		{include: `op==CREATE && path=="/etc/*"`, ps: []bool{false, false, false}, fs: []bool{true, false}},
+		{include: `kind==FS`, ps: []bool{false, false, false}, fs: []bool{true, true}},
+		{include: `not kind==EXIT`, ps: []bool{true, true, false}, fs: []bool{true, true}},
+		{include: `!(uid==0 || path=="/tmp/*")`, ps: []bool{false, true, true}, fs: []bool{true, false}},
+		{include: `exe!="/usr/bin/*"`, ps: []bool{false, false, false}, fs: []bool{false, false}},
+		{include: `cmd=="*backup*" and kind==CMD`, ps: []bool{false, true, false}, fs: []bool{false, false}},
+		{exclude: `uid==1000 || op==OPEN`, ps: []bool{true, false, false}, fs: []bool{true, false}},
+		{include: `kind==CMD || kind==FS`, exclude: `path!~"^/etc"`, ps: []bool{true, true, false}, fs: []bool{true, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.include+"/"+tt.exclude, func(t *testing.T) {
+			f, err := New(tt.include, tt.exclude)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for i, pe := range []psscanner.PSEvent{rootPasswd, userCron, userExit} {
+				if m := f.MatchPS(pe); m != tt.ps[i] {
+					t.Errorf("Wrong result for %+v: got %t", pe, m)
+				}
+			}
+			for i, fe := range []fswatcher.FSEvent{etcCreate, tmpOpen} {
+				if m := f.MatchFS(fe); m != tt.fs[i] {
+					t.Errorf("Wrong result for %+v: got %t", fe, m)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchCgroup(t *testing.T) {
+	cronJob := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 10, CMD: "/bin/sh -c backup", Cgroup: &psscanner.Cgroup{Path: "/system.slice/cron.service", Unit: "cron.service", Slice: "system.slice"}, NS: &psscanner.Namespaces{PID: 4026531836, Mount: 4026531841, User: 4026531837}}
+	container := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 11, CMD: "nginx", Cgroup: &psscanner.Cgroup{Path: "/docker/3f4e1a9c2b7d", Container: "3f4e1a9c2b7d"}, NS: &psscanner.Namespaces{PID: 4026532400, Mount: 4026532398, User: 4026531837}}
+	plain := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 12, CMD: "id"}
+	tests := []struct {
+		include  string
+		expected []bool // cronJob, container, plain
+	}{
+		{include: `unit=="cron.service"`, expected: []bool{true, false, false}},
+		{include: `slice=~"^system"`, expected: []bool{true, false, false}},
+		{include: `container!=""`, expected: []bool{false, true, false}},
+		{include: `container=="3f4e*"`, expected: []bool{false, true, false}},
+		{include: `pidns!=4026531836`, expected: []bool{false, true, false}},
+		{include: `userns==4026531837 && cgroup=="/docker/*"`, expected: []bool{false, true, false}},
+		{include: `not unit=="*"`, expected: []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		f, err := New(tt.include, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pe := range []psscanner.PSEvent{cronJob, container, plain} {
+			if m := f.MatchPS(pe); m != tt.expected[i] {
+				t.Errorf("Wrong result of '%s' for %+v: got %t", tt.include, pe, m)
+			}
+		}
+	}
+}
+
+func TestMatchSession(t *testing.T) {
+	ssh := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 4250, CMD: "vim", Session: &psscanner.Session{TTY: "pts/0", SID: 4200, PGRP: 4250, LoginUID: 1000, SessionID: 3}}
+	daemon := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 700, CMD: "sshd", Session: &psscanner.Session{SID: 700, PGRP: 700, LoginUID: -1, SessionID: -1}}
+	plain := psscanner.PSEvent{Kind: psscanner.KindNew, PID: 12, CMD: "id"}
+	tests := []struct {
+		include  string
+		expected []bool // ssh, daemon, plain
+	}{
+		{include: `tty=="pts/*"`, expected: []bool{true, false, false}},
+		{include: `loginuid==1000 && sessionid==3`, expected: []bool{true, false, false}},
+		{include: `loginuid>=0`, expected: []bool{true, false, false}},
+		{include: `sid==pgrp`, expected: nil},
+		{include: `sid==700 || pgrp==4250`, expected: []bool{true, true, false}},
+		{include: `not tty=="*"`, expected: []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		f, err := New(tt.include, "")
+		if tt.expected == nil {
+			if err == nil {
+				t.Errorf("Expected error for '%s'", tt.include)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pe := range []psscanner.PSEvent{ssh, daemon, plain} {
+			if m := f.MatchPS(pe); m != tt.expected[i] {
+				t.Errorf("Wrong result of '%s' for %+v: got %t", tt.include, pe, m)
+			}
+		}
+	}
+}
+
+func TestMatchFinding(t *testing.T) {
+	writable := findings.Finding{PID: 23, UID: 0, CMD: "bash /opt/job.sh", Path: "/opt/job.sh", Reason: "is writable"}
+	risk := findings.Finding{Kind: findings.KindRisk, PID: 24, UID: 0, CMD: "sh -c 'tar cf /b.tar *'", Reason: "unquoted wildcard * in arguments of tar allows option injection"}
+	tests := []struct {
+		include  string
+		exclude  string
+		expected []bool
+	}{
+		{include: `kind==RISK`, expected: []bool{false, true}},
+		{include: `kind=="FINDING" && path=="/opt/*"`, expected: []bool{true, false}},
+		{include: `reason=~"wildcard"`, expected: []bool{false, true}},
+		{include: `uid==0 && cmd=~"tar"`, expected: []bool{false, true}},
+		{exclude: `ppid>0 || op==CREATE`, expected: []bool{true, true}},
+	}
+	for _, tt := range tests {
+		f, err := New(tt.include, tt.exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, fd := range []findings.Finding{writable, risk} {
+			if m := f.MatchFinding(fd); m != tt.expected[i] {
+				t.Errorf("Wrong result of '%s' for %+v: got %t", tt.include+tt.exclude, fd, m)
+			}
+		}
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	if !f.MatchPS(rootPasswd) || !f.MatchFS(etcCreate) {
+		t.Errorf("Nil filter must match everything")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		err  string
+	}{
+		{expr: `uid==`, err: "parsing filter: expected a value after '==' at position 4 but got end of expression"},
+		{expr: `name=="x"`, err: "parsing filter: unknown field 'name' at position 1: must be one of kind, uid, user, pid, ppid, cmd, exe, cwd, comm, container, pod, unit, slice, cgroup, pidns, mntns, userns, tty, sid, pgrp, loginuid, sessionid, op, path, reason"},
+		{expr: `uid==root`, err: "parsing filter: field 'uid' needs a number but got 'root' at position 6"},
+		{expr: `uid=~"0"`, err: "parsing filter: can't match number field 'uid' with '=~' at position 4"},
+		{expr: `cmd<"a"`, err: "parsing filter: can't compare text field 'cmd' with '<' at position 4"},
+		{expr: `cmd=~"("`, err: "parsing filter: invalid pattern '(' at position 6: error parsing regexp: missing closing ): `(`"},
+		{expr: `(uid==0`, err: "parsing filter: expected ')' but got end of expression"},
+		{expr: `uid==0 pid==1`, err: "parsing filter: unexpected 'pid' at position 8"},
+		{expr: `cmd=="abc`, err: "parsing filter: unterminated string at position 6"},
+		{expr: `&& uid==0`, err: "parsing filter: expected a field name or '(' but got '&&' at position 1"},
+		{expr: `uid 0`, err: "parsing filter: expected a comparison after 'uid' at position 1 but got '0' at position 5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := New(tt.expr, "")
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Wrong error: got %v but wanted %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestQuotedStrings(t *testing.T) {
+	f, err := New(`cmd=~'\d+ "x"' || cmd=='it\'s'`, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !f.MatchPS(psscanner.PSEvent{CMD: `sleep 10 "x"`, UID: -1, PPID: -1}) || !f.MatchPS(psscanner.PSEvent{CMD: "it's", UID: -1, PPID: -1}) {
+		t.Errorf("Quoted strings not matched")
+	}
+}
+
+func TestReadExpr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pspy-filter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "filter")
+	ioutil.WriteFile(path, []byte("# only root\nuid==0\n  # and no cron\n&& cmd!~cron\n"), 0644)
+
+	expr, err := ReadExpr("@" + path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := New(expr, ""); err != nil {
+		t.Errorf("Can't parse filter from file: %v", err)
+	}
+	if expr, _ := ReadExpr("uid==0"); expr != "uid==0" {
+		t.Errorf("Wrong expression: %s", expr)
+	}
+	if _, err := ReadExpr("@" + filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("Expected error for missing file")
+	}
+}
+
+func mockLookupUser(users map[int]string) func() {
+	old := lookupUser
+	lookupUser = func(uid int) string {
+		return users[uid]
+	}
+	return func() {
+		lookupUser = old
+	}
+}
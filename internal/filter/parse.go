@@ -0,0 +1,286 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokNumber
+	tokString
+	tokOp    // comparison operator
+	tokAnd   // && or "and"
+	tokOr    // || or "or"
+	tokNot   // ! or "not"
+	tokOpen  // (
+	tokClose // )
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of expression"
+	}
+	return fmt.Sprintf("'%s' at position %d", t.text, t.pos+1)
+}
+
+var comparisons = []string{"==", "!=", "=~", "!~", "<=", ">=", "<", ">"}
+
+func tokenize(s string) ([]token, error) {
+	tokens := make([]token, 0)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokOpen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokClose, ")", i})
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, token{tokAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{tokOr, "||", i})
+			i += 2
+		case c == '"' || c == '\'':
+			end, text, err := scanString(s, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokString, text, i})
+			i = end
+		default:
+			if op := comparisonAt(s, i); op != "" {
+				tokens = append(tokens, token{tokOp, op, i})
+				i += len(op)
+				continue
+			}
+			if c == '!' {
+				tokens = append(tokens, token{tokNot, "!", i})
+				i++
+				continue
+			}
+			start := i
+			for i < len(s) && isWordChar(s[i]) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected '%c' at position %d", c, i+1)
+			}
+			tokens = append(tokens, word(s[start:i], start))
+		}
+	}
+	return append(tokens, token{tokEOF, "", len(s)}), nil
+}
+
+func comparisonAt(s string, i int) string {
+	for _, op := range comparisons {
+		if strings.HasPrefix(s[i:], op) {
+			return op
+		}
+	}
+	return ""
+}
+
+// words are unquoted values such as CREATE or /etc/passwd as well as field names and keywords
+func isWordChar(c byte) bool {
+	return c > ' ' && !strings.ContainsRune("()!=<>~&|\"'", rune(c))
+}
+
+func word(text string, pos int) token {
+	switch strings.ToLower(text) {
+	case "and":
+		return token{tokAnd, text, pos}
+	case "or":
+		return token{tokOr, text, pos}
+	case "not":
+		return token{tokNot, text, pos}
+	}
+	if _, err := strconv.Atoi(text); err == nil {
+		return token{tokNumber, text, pos}
+	}
+	return token{tokIdent, text, pos}
+}
+
+// scanString reads a quoted string starting at i. Backslash escapes the quote and itself,
+// other characters are taken literally so that regular expressions need no double escaping.
+func scanString(s string, i int) (int, string, error) {
+	quote := s[i]
+	var b strings.Builder
+	for j := i + 1; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case c == '\\' && j+1 < len(s) && (s[j+1] == quote || s[j+1] == '\\'):
+			b.WriteByte(s[j+1])
+			j++
+		case c == quote:
+			return j + 1, b.String(), nil
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return 0, "", fmt.Errorf("unterminated string at position %d", i+1)
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse compiles an expression, returning nil for an empty one
+func parse(s string) (node, error) {
+	tokens, err := tokenize(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, nil
+	}
+	p := &parser{tokens: tokens}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+	return n, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (node, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = or{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseAnd() (node, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = and{l, r}
+	}
+	return l, nil
+}
+
+func (p *parser) parseNot() (node, error) {
+	if p.peek().kind == tokNot {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return not{n}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokOpen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokClose {
+			return nil, fmt.Errorf("expected ')' but got %s", c)
+		}
+		return n, nil
+	case tokIdent:
+		return p.parseComparison(t)
+	}
+	return nil, fmt.Errorf("expected a field name or '(' but got %s", t)
+}
+
+func (p *parser) parseComparison(field token) (node, error) {
+	name := strings.ToLower(field.text)
+	if !isField(name) {
+		return nil, fmt.Errorf("unknown field %s: must be one of %s", field, strings.Join(Fields, ", "))
+	}
+	op := p.next()
+	if op.kind != tokOp {
+		return nil, fmt.Errorf("expected a comparison after %s but got %s", field, op)
+	}
+	value := p.next()
+	if value.kind != tokIdent && value.kind != tokNumber && value.kind != tokString {
+		return nil, fmt.Errorf("expected a value after %s but got %s", op, value)
+	}
+
+	if isNumeric(name) {
+		if op.text == "=~" || op.text == "!~" {
+			return nil, fmt.Errorf("can't match number field '%s' with %s", name, op)
+		}
+		if value.kind != tokNumber {
+			return nil, fmt.Errorf("field '%s' needs a number but got %s", name, value)
+		}
+		v, _ := strconv.Atoi(value.text)
+		return numCmp{field: name, op: op.text, value: v}, nil
+	}
+
+	var pattern string
+	switch op.text {
+	case "==", "!=":
+		pattern = globToRegexp(value.text)
+	case "=~", "!~":
+		pattern = value.text
+	default:
+		return nil, fmt.Errorf("can't compare text field '%s' with %s", name, op)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", value, err)
+	}
+	return strCmp{field: name, negate: op.text[0] == '!', re: re}, nil
+}
+
+func isField(name string) bool {
+	for _, f := range Fields {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,256 @@
+// Package findings looks for privilege escalation paths in the processes pspy sees,
+// such as root running a script that the user running pspy can modify, or command
+// lines of root that are risky, such as wildcards that allow option injection.
+package findings
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+	"golang.org/x/sys/unix"
+)
+
+// interpreters run the script given as their first argument that is not an option
+var interpreters = regexp.MustCompile(`^(sh|bash|dash|zsh|ksh|ash|python[0-9.]*|perl[0-9.]*|ruby[0-9.]*|php[0-9.]*|node|nodejs|lua[0-9.]*|tclsh[0-9.]*)$`)
+
+// inlineOptions make interpreters run code from the command line instead of a script
+var inlineOptions = map[string]bool{"-c": true, "-e": true, "-E": true, "-r": true, "-m": true}
+
+// Kind tells what was found
+type Kind int
+
+const (
+	// KindWritable is a file run by another user that the current user can modify
+	KindWritable Kind = iota
+	// KindRisk is a risky pattern in the command line of a privileged process
+	KindRisk
+	// KindSecret is a secret such as a password in the command line of another user
+	KindSecret
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindWritable:
+		return "FINDING"
+	case KindRisk:
+		return "RISK"
+	case KindSecret:
+		return "SECRET"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Finding is a file that a process of another user runs and the user running pspy can
+// modify, or replace since it can write to a directory on the way to it. For KindRisk
+// and KindSecret, Path is empty and Reason describes the risk.
+type Finding struct {
+	Kind   Kind   `json:"-"`
+	PID    int    `json:"pid"`
+	UID    int    `json:"uid"`
+	CMD    string `json:"cmd"`
+	Path   string `json:"path,omitempty"`
+	Reason string `json:"reason"`
+	// when the process event it was found in was captured, zero if unknown
+	Time time.Time `json:"-"`
+}
+
+func (f Finding) String() string {
+	if f.Path == "" {
+		return fmt.Sprintf("UID=%-5d PID=%-6d | %s (running %s)", f.UID, f.PID, f.Reason, f.CMD)
+	}
+	return fmt.Sprintf("UID=%-5d PID=%-6d | %s %s (running %s)", f.UID, f.PID, f.Path, f.Reason, f.CMD)
+}
+
+// Checker finds files executed by other users that are writable by the current user,
+// risky command lines and secrets in them. Each file and each risk of a command line is reported once.
+// Secrets are reported once per kind of secret and command line.
+type Checker struct {
+	uid      int
+	reported map[string]bool
+
+	// hooks for testing
+	writable func(path string) bool
+	lstat    func(path string) (os.FileInfo, error)
+	resolve  func(path string) (string, error)
+}
+
+// NewChecker creates a checker for the effective user of this process
+func NewChecker() *Checker {
+	return &Checker{
+		uid:      os.Geteuid(),
+		reported: make(map[string]bool),
+		writable: func(path string) bool { return unix.Access(path, unix.W_OK) == nil },
+		lstat:    os.Lstat,
+		resolve:  filepath.EvalSymlinks,
+	}
+}
+
+// Root returns true if the checker runs as root, who can write anything,
+// so there are no writable files to find
+func (c *Checker) Root() bool {
+	return c.uid == 0
+}
+
+// Check returns the findings for a new process or one that changed its command.
+// Writable files only matter for processes of other users, risks and secrets for all.
+func (c *Checker) Check(pe psscanner.PSEvent) []Finding {
+	if pe.UID == -1 || pe.KernelThread {
+		return nil
+	}
+
+	var found []Finding
+	report := func(kind Kind, reasons []string) {
+		for _, reason := range reasons {
+			key := kind.String() + "\x00" + reason + "\x00" + pe.Command()
+			if c.reported[key] {
+				continue
+			}
+			c.reported[key] = true
+			found = append(found, Finding{Kind: kind, PID: pe.PID, UID: pe.UID, CMD: pe.Command(), Reason: reason, Time: pe.Time})
+		}
+	}
+	switch pe.Kind {
+	case psscanner.KindNew, psscanner.KindExec, psscanner.KindChanged:
+	case psscanner.KindPipeline:
+		// its members were checked on their own
+		report(KindSecret, PipelineSecrets(pe))
+		return found
+	default:
+		return nil
+	}
+
+	if !c.Root() && pe.UID != c.uid {
+		for _, path := range c.executed(pe) {
+			if c.reported[path] {
+				continue
+			}
+			if reason := c.check(path); reason != "" {
+				c.reported[path] = true
+				found = append(found, Finding{Kind: KindWritable, PID: pe.PID, UID: pe.UID, CMD: pe.Command(), Path: path, Reason: reason, Time: pe.Time})
+			}
+		}
+	}
+	report(KindRisk, c.risks(pe))
+	report(KindSecret, Secrets(pe.Argv))
+	report(KindSecret, EnvSecrets(pe.Env))
+	return found
+}
+
+// executed returns the absolute paths of the executable and the script a process runs,
+// as far as they can be told from the event, and of symlinks to them it was started by
+func (c *Checker) executed(pe psscanner.PSEvent) []string {
+	paths := make([]string, 0, 2)
+	once := func(path string) {
+		for _, p := range paths {
+			if p == path {
+				return
+			}
+		}
+		paths = append(paths, path)
+	}
+	add := func(path string) {
+		if !filepath.IsAbs(path) {
+			if pe.Cwd == "" {
+				return
+			}
+			path = filepath.Join(pe.Cwd, path)
+		}
+		if info, err := c.lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			// replacing the link works as well as replacing what it points to
+			once(path)
+		}
+		if resolved, err := c.resolve(path); err == nil {
+			path = resolved
+		}
+		once(path)
+	}
+
+	if pe.Exe != "" {
+		add(psscanner.ExePath(pe.Exe))
+	}
+	argv := pe.Argv
+	if len(argv) > 0 && filepath.Base(argv[0]) == "env" {
+		argv = skipEnv(argv[1:])
+	}
+	if len(argv) > 0 && strings.Contains(argv[0], "/") {
+		add(argv[0])
+	}
+	if script := scriptOf(argv); script != "" {
+		add(script)
+	}
+	return paths
+}
+
+// skipEnv returns the command env runs, without its options and variable assignments
+func skipEnv(argv []string) []string {
+	for i, arg := range argv {
+		if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+			return argv[i:]
+		}
+	}
+	return nil
+}
+
+// scriptOf returns the script an interpreter runs, if any
+func scriptOf(argv []string) string {
+	if len(argv) < 2 || !interpreters.MatchString(filepath.Base(argv[0])) {
+		return ""
+	}
+	for i, arg := range argv[1:] {
+		switch {
+		case inlineOptions[arg]:
+			return ""
+		case arg == "--" && i+2 < len(argv):
+			return argv[i+2]
+		case !strings.HasPrefix(arg, "-"):
+			return arg
+		}
+	}
+	return ""
+}
+
+// check tells why the current user can modify the file at path, or returns "" if it can't.
+// A writable directory on the way allows to replace the file or a directory containing it,
+// unless the directory is sticky like /tmp and the entry belongs to someone else.
+func (c *Checker) check(path string) string {
+	info, err := c.lstat(path)
+	if err != nil {
+		return ""
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		// only where it is matters, as writing to it writes its target, which is checked on its own
+	case !info.Mode().IsRegular():
+		return ""
+	case c.writable(path):
+		return "is writable"
+	}
+	for entry := path; entry != filepath.Dir(entry); entry = filepath.Dir(entry) {
+		dir := filepath.Dir(entry)
+		dirInfo, err := c.lstat(dir)
+		if err != nil || !c.writable(dir) {
+			continue
+		}
+		if dirInfo.Mode()&os.ModeSticky != 0 && !c.owns(entry) {
+			continue
+		}
+		return fmt.Sprintf("is in writable directory %s", dir)
+	}
+	return ""
+}
+
+func (c *Checker) owns(path string) bool {
+	info, err := c.lstat(path)
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(stat.Uid) == c.uid
+}
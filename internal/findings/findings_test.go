@@ -0,0 +1,160 @@
+package findings
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// newTestChecker checks as an unprivileged user who can write the given paths only
+func newTestChecker(writable ...string) *Checker {
+	c := NewChecker()
+	c.uid = 1000
+	c.writable = func(path string) bool {
+		for _, w := range writable {
+			if path == w {
+				return true
+			}
+		}
+		return false
+	}
+	return c
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := filepath.Join(dir, "opt")
+	tmp := filepath.Join(dir, "tmp")
+	for _, d := range []string{opt, tmp} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chmod(tmp, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"opt/job.sh", "opt/backup", "opt/x.py", "tmp/job.sh"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newTestChecker(filepath.Join(opt, "job.sh"), tmp)
+
+	tests := []struct {
+		name     string
+		pe       psscanner.PSEvent
+		expected []Finding
+	}{
+		{
+			name: "writable-script",
+			pe:   psscanner.PSEvent{UID: 0, PID: 23, Argv: []string{"/bin/bash", opt + "/job.sh"}, Exe: "/bin/bash"},
+			expected: []Finding{
+				{PID: 23, UID: 0, CMD: "/bin/bash " + opt + "/job.sh", Path: opt + "/job.sh", Reason: "is writable"},
+			},
+		},
+		{
+			name: "reported-once",
+			pe:   psscanner.PSEvent{UID: 0, PID: 24, Argv: []string{"bash", opt + "/job.sh"}},
+		},
+		{
+			name: "sticky-dir-of-others",
+			pe:   psscanner.PSEvent{UID: 0, PID: 25, Argv: []string{"sh", "-e", tmp + "/job.sh"}},
+		},
+		{
+			name: "inline-code",
+			pe:   psscanner.PSEvent{UID: 0, PID: 26, Argv: []string{"sh", "-c", opt + "/backup"}},
+		},
+		{
+			name: "own-process",
+			pe:   psscanner.PSEvent{UID: 1000, PID: 27, Argv: []string{"sh", opt + "/backup"}},
+		},
+		{
+			name: "not-writable",
+			pe:   psscanner.PSEvent{UID: 0, PID: 28, Argv: []string{opt + "/backup"}},
+		},
+		{
+			name: "exits-ignored",
+			pe:   psscanner.PSEvent{Kind: psscanner.KindExit, UID: 0, PID: 23, Argv: []string{opt + "/job.sh"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found := c.Check(tt.pe)
+			if !reflect.DeepEqual(found, tt.expected) {
+				t.Errorf("Wrong findings: got %+v but want %+v", found, tt.expected)
+			}
+		})
+	}
+
+	// the user can replace files in a directory
+	c = newTestChecker(opt)
+	found := c.Check(psscanner.PSEvent{Kind: psscanner.KindExec, UID: 0, PID: 30, Argv: []string{"env", "-i", "PATH=/bin", "python3", "-u", "x.py"}, Cwd: opt})
+	expected := []Finding{{PID: 30, UID: 0, CMD: "env -i PATH=/bin python3 -u x.py", Path: opt + "/x.py", Reason: "is in writable directory " + opt}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+
+	// or in a parent directory
+	c = newTestChecker(dir)
+	found = c.Check(psscanner.PSEvent{UID: 0, PID: 31, Argv: []string{opt + "/backup", "--all"}})
+	expected = []Finding{{PID: 31, UID: 0, CMD: opt + "/backup --all", Path: opt + "/backup", Reason: "is in writable directory " + dir}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+	// symlinks are checked where they are, not only where they point to
+	bin := filepath.Join(dir, "bin")
+	if err := os.Mkdir(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(opt+"/backup", bin+"/backup"); err != nil {
+		t.Fatal(err)
+	}
+	c = newTestChecker(bin)
+	found = c.Check(psscanner.PSEvent{UID: 0, PID: 33, Argv: []string{bin + "/backup"}})
+	expected = []Finding{{PID: 33, UID: 0, CMD: bin + "/backup", Path: bin + "/backup", Reason: "is in writable directory " + bin}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+	c = newTestChecker(dir)
+	// executables replaced since the process started are checked at their path
+	found = c.Check(psscanner.PSEvent{UID: 0, PID: 32, Argv: []string{"job"}, Exe: opt + "/x.py (deleted)"})
+	expected = []Finding{{PID: 32, UID: 0, CMD: "job", Path: opt + "/x.py", Reason: "is in writable directory " + dir}}
+	if !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+}
+
+func TestScriptOf(t *testing.T) {
+	tests := []struct {
+		argv     []string
+		expected string
+	}{
+		{[]string{"/bin/sh", "/etc/cron.daily/logrotate"}, "/etc/cron.daily/logrotate"},
+		{[]string{"python3", "-u", "-B", "job.py", "--verbose"}, "job.py"},
+		{[]string{"perl", "-e", "print 1"}, ""},
+		{[]string{"python3", "-m", "http.server"}, ""},
+		{[]string{"bash", "--", "-weird.sh"}, "-weird.sh"},
+		{[]string{"bash"}, ""},
+		{[]string{"cp", "a", "b"}, ""},
+	}
+	for _, tt := range tests {
+		if script := scriptOf(tt.argv); script != tt.expected {
+			t.Errorf("Wrong script for %v: got '%s' but want '%s'", tt.argv, script, tt.expected)
+		}
+	}
+}
+
+func TestFindingString(t *testing.T) {
+	f := Finding{PID: 23, UID: 0, CMD: "bash /opt/job.sh", Path: "/opt/job.sh", Reason: "is writable"}
+	expected := "UID=0     PID=23     | /opt/job.sh is writable (running bash /opt/job.sh)"
+	if f.String() != expected {
+		t.Errorf("Wrong string: got '%s' but want '%s'", f.String(), expected)
+	}
+}
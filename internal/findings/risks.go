@@ -0,0 +1,260 @@
+package findings
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// shells run the script given with -c
+var shells = regexp.MustCompile(`^(sh|bash|dash|zsh|ksh|mksh|ash|busybox)$`)
+
+// wildcardTools have options that run commands or change files other than the ones given,
+// so a file named like an option, e.g., "--checkpoint-action=exec=sh x.sh", injects it
+var wildcardTools = regexp.MustCompile(`^(chown|chmod|chgrp|tar|rsync|7z|7za|zip|scp)$`)
+
+// builtins are not looked up in PATH
+var builtins = map[string]bool{
+	"cd": true, "echo": true, "printf": true, "test": true, "[": true, "[[": true, "read": true,
+	"export": true, "set": true, "unset": true, "exit": true, "return": true, "source": true, ".": true,
+	"exec": true, "eval": true, "true": true, "false": true, ":": true, "local": true, "shift": true,
+	"if": true, "then": true, "else": true, "elif": true, "fi": true, "for": true, "while": true, "until": true,
+	"do": true, "done": true, "case": true, "esac": true, "in": true, "!": true, "{": true, "}": true,
+	"umask": true, "wait": true, "trap": true, "pwd": true, "command": true, "type": true,
+}
+
+// defaultPath is the PATH cron and most init systems give to root
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// risks returns the risky patterns in the shell script of a privileged process,
+// which can be tricked into running our code
+func (c *Checker) risks(pe psscanner.PSEvent) []string {
+	if pe.UID != 0 && (pe.UIDs == nil || pe.UIDs.Effective != 0) {
+		return nil
+	}
+	argv := pe.Argv
+	if len(argv) > 0 && filepath.Base(argv[0]) == "env" {
+		argv = skipEnv(argv[1:])
+	}
+	i := scriptIndex(argv)
+	if i < 0 {
+		return nil
+	}
+
+	var reasons []string
+	add := func(reason string) {
+		reasons = appendOnce(reasons, reason)
+	}
+	cmds := commands(splitShell(argv[i]))
+	path := defaultPath
+	for _, cmd := range cmds {
+		cmdPath := path
+		if p, ok := cmd.env["PATH"]; ok {
+			cmdPath = p
+			if len(cmd.words) == 0 {
+				path = p
+			}
+		}
+		name := cmd.name()
+		switch {
+		case name == "":
+		case name == "export":
+			for _, w := range cmd.words[1:] {
+				if v := strings.TrimPrefix(w.text, "PATH="); v != w.text {
+					path = v
+				}
+			}
+		case wildcardTools.MatchString(filepath.Base(name)):
+			for _, w := range cmd.words[1:] {
+				if w.glob {
+					add(fmt.Sprintf("unquoted wildcard %s in arguments of %s allows option injection", w.text, filepath.Base(name)))
+				}
+			}
+		case name == "cd" && !c.Root():
+			if len(cmd.words) > 1 && filepath.IsAbs(cmd.words[1].text) && c.isWritableDir(cmd.words[1].text) {
+				add(fmt.Sprintf("changes into writable directory %s", cmd.words[1].text))
+			}
+		}
+		if name != "" && !builtins[name] && !strings.Contains(name, "/") && !c.Root() {
+			if dir := c.writableBefore(name, cmdPath); dir != "" {
+				add(fmt.Sprintf("command %s is looked up in writable directory %s of PATH", name, dir))
+			}
+		}
+	}
+	return reasons
+}
+
+// scriptIndex returns the index of the script a shell runs with -c, or -1 if there is none
+func scriptIndex(argv []string) int {
+	if len(argv) < 3 || !shells.MatchString(filepath.Base(argv[0])) {
+		return -1
+	}
+	first := 1
+	if filepath.Base(argv[0]) == "busybox" {
+		if !shells.MatchString(argv[1]) {
+			return -1
+		}
+		first = 2
+	}
+	for i := first; i+1 < len(argv); i++ {
+		arg := argv[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return -1
+		}
+		if !strings.HasPrefix(arg, "--") && strings.Contains(arg, "c") {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// writableBefore returns the first writable directory in path that a command is looked up in
+// before it is found, or "" if there is none
+func (c *Checker) writableBefore(name, path string) string {
+	for _, dir := range strings.Split(path, ":") {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		if c.isWritableDir(dir) {
+			return dir
+		}
+		if info, err := c.lstat(filepath.Join(dir, name)); err == nil && !info.IsDir() {
+			return ""
+		}
+	}
+	return ""
+}
+
+func (c *Checker) isWritableDir(dir string) bool {
+	info, err := c.lstat(dir)
+	return err == nil && info.IsDir() && c.writable(dir)
+}
+
+// word is a word of a shell script or an operator such as | or &&
+type word struct {
+	text string
+	glob bool // contains unquoted *, ? or [
+	op   bool
+}
+
+// splitShell splits a shell script into words and operators. It understands quotes, escapes
+// and comments, which is enough to tell commands and unquoted wildcards apart, but does not
+// expand variables or substitutions.
+func splitShell(script string) []word {
+	var words []word
+	var cur strings.Builder
+	inWord, glob := false, false
+	flush := func() {
+		if inWord {
+			words = append(words, word{text: cur.String(), glob: glob})
+		}
+		cur.Reset()
+		inWord, glob = false, false
+	}
+
+	for i := 0; i < len(script); i++ {
+		ch := script[i]
+		switch {
+		case ch == '\\' && i+1 < len(script):
+			i++
+			if script[i] != '\n' {
+				cur.WriteByte(script[i])
+				inWord = true
+			}
+		case ch == '\'':
+			end := strings.IndexByte(script[i+1:], '\'')
+			if end < 0 {
+				end = len(script) - i - 1
+			}
+			cur.WriteString(script[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case ch == '"':
+			inWord = true
+			for i++; i < len(script) && script[i] != '"'; i++ {
+				if script[i] == '\\' && i+1 < len(script) && strings.IndexByte("\"\\$`", script[i+1]) >= 0 {
+					i++
+				}
+				cur.WriteByte(script[i])
+			}
+		case ch == '#' && !inWord:
+			for i+1 < len(script) && script[i+1] != '\n' {
+				i++
+			}
+		case ch == ' ' || ch == '\t':
+			flush()
+		case strings.IndexByte(";&|()<>\n", ch) >= 0:
+			flush()
+			op := string(ch)
+			if i+1 < len(script) && (ch == '&' || ch == '|' || ch == '>' || ch == '<' || ch == ';') && script[i+1] == ch {
+				op += op
+				i++
+			}
+			words = append(words, word{text: op, op: true})
+		default:
+			if ch == '*' || ch == '?' || ch == '[' {
+				glob = true
+			}
+			cur.WriteByte(ch)
+			inWord = true
+		}
+	}
+	flush()
+	return words
+}
+
+// command is a simple command of a shell script: the variables assigned for it,
+// its words without redirections, and the operator following it
+type command struct {
+	env   map[string]string
+	words []word
+	op    string
+}
+
+func (c command) name() string {
+	if len(c.words) == 0 {
+		return ""
+	}
+	return c.words[0].text
+}
+
+func (c command) args() []string {
+	args := make([]string, len(c.words))
+	for i, w := range c.words {
+		args[i] = w.text
+	}
+	return args
+}
+
+var assignment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// commands splits the words of a shell script into simple commands
+func commands(words []word) []command {
+	var cmds []command
+	cur := command{env: map[string]string{}}
+	for i := 0; i < len(words); i++ {
+		w := words[i]
+		switch {
+		case w.op && (strings.HasPrefix(w.text, "<") || strings.HasPrefix(w.text, ">")):
+			i++ // skip the file redirected to or from
+		case w.op:
+			if len(cur.words) > 0 || len(cur.env) > 0 {
+				cur.op = w.text
+				cmds = append(cmds, cur)
+			}
+			cur = command{env: map[string]string{}}
+		case len(cur.words) == 0 && assignment.MatchString(w.text):
+			name, value, _ := strings.Cut(w.text, "=")
+			cur.env[name] = value
+		default:
+			cur.words = append(cur.words, w)
+		}
+	}
+	if len(cur.words) > 0 || len(cur.env) > 0 {
+		cmds = append(cmds, cur)
+	}
+	return cmds
+}
@@ -0,0 +1,154 @@
+package findings
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+func TestSplitShell(t *testing.T) {
+	tests := []struct {
+		script   string
+		expected []word
+	}{
+		{`cd /var/www && chown www-data *`, []word{{text: "cd"}, {text: "/var/www"}, {text: "&&", op: true}, {text: "chown"}, {text: "www-data"}, {text: "*", glob: true}}},
+		{`tar cf '/b/*.tar' "a b" c\ d`, []word{{text: "tar"}, {text: "cf"}, {text: "/b/*.tar"}, {text: "a b"}, {text: "c d"}}},
+		{`echo "x\"y" | passwd # comment`, []word{{text: "echo"}, {text: `x"y`}, {text: "|", op: true}, {text: "passwd"}}},
+		{"a;b\nc>>log", []word{{text: "a"}, {text: ";", op: true}, {text: "b"}, {text: "\n", op: true}, {text: "c"}, {text: ">>", op: true}, {text: "log"}}},
+		{`echo a#b 'unterminated`, []word{{text: "echo"}, {text: "a#b"}, {text: "unterminated"}}},
+	}
+	for _, tt := range tests {
+		if words := splitShell(tt.script); !reflect.DeepEqual(words, tt.expected) {
+			t.Errorf("Wrong words for %q: got %+v but want %+v", tt.script, words, tt.expected)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	cmds := commands(splitShell(`PATH=/opt/bin; LANG=C sort < in > out | uniq`))
+	expected := []command{
+		{env: map[string]string{"PATH": "/opt/bin"}, op: ";"},
+		{env: map[string]string{"LANG": "C"}, words: []word{{text: "sort"}}, op: "|"},
+		{env: map[string]string{}, words: []word{{text: "uniq"}}},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("Wrong commands: got %+v but want %+v", cmds, expected)
+	}
+}
+
+func TestScriptIndex(t *testing.T) {
+	tests := []struct {
+		argv     []string
+		expected int
+	}{
+		{[]string{"/bin/sh", "-c", "id"}, 2},
+		{[]string{"bash", "-ec", "id", "name"}, 2},
+		{[]string{"busybox", "sh", "-c", "id"}, 3},
+		{[]string{"bash", "script.sh", "-c"}, -1},
+		{[]string{"python3", "-c", "print(1)"}, -1},
+		{[]string{"sh", "-c"}, -1},
+	}
+	for _, tt := range tests {
+		if i := scriptIndex(tt.argv); i != tt.expected {
+			t.Errorf("Wrong script index for %v: got %d but want %d", tt.argv, i, tt.expected)
+		}
+	}
+}
+
+func TestRisks(t *testing.T) {
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	www := filepath.Join(dir, "www")
+	bin := filepath.Join(dir, "bin")
+	for _, d := range []string{www, bin} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(bin, "backup"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestChecker(www, dir)
+
+	tests := []struct {
+		name     string
+		pe       psscanner.PSEvent
+		expected []string
+	}{
+		{
+			name: "wildcard-and-cd",
+			pe:   psscanner.PSEvent{UID: 0, Argv: []string{"/bin/sh", "-c", "cd " + www + " && chown nobody:nobody *"}},
+			expected: []string{
+				"changes into writable directory " + www,
+				"unquoted wildcard * in arguments of chown allows option injection",
+			},
+		},
+		{
+			name: "quoted-wildcard",
+			pe:   psscanner.PSEvent{UID: 0, Argv: []string{"sh", "-c", "tar czf /backup.tgz '*.log'"}},
+		},
+		{
+			name:     "writable-dir-in-path",
+			pe:       psscanner.PSEvent{UID: 0, Argv: []string{"sh", "-c", "PATH=" + www + ":" + bin + "; backup"}},
+			expected: []string{"command backup is looked up in writable directory " + www + " of PATH"},
+		},
+		{
+			name: "found-before-writable-dir",
+			pe:   psscanner.PSEvent{UID: 0, Argv: []string{"sh", "-c", "export PATH=" + bin + ":" + www + "; backup; cd /"}},
+		},
+		{
+			name: "unprivileged",
+			pe:   psscanner.PSEvent{UID: 33, Argv: []string{"sh", "-c", "cd " + www + " && chown nobody:nobody *"}},
+		},
+		{
+			name:     "setuid",
+			pe:       psscanner.PSEvent{UID: 33, UIDs: &psscanner.IDs{Real: 33, Effective: 0}, Argv: []string{"sh", "-c", "tar cf /b.tar *"}},
+			expected: []string{"unquoted wildcard * in arguments of tar allows option injection"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reasons := c.risks(tt.pe); !reflect.DeepEqual(reasons, tt.expected) {
+				t.Errorf("Wrong risks: got %q but want %q", reasons, tt.expected)
+			}
+		})
+	}
+
+	// root can write anything, so only patterns that do not depend on the user are risky
+	c.uid = 0
+	reasons := c.risks(psscanner.PSEvent{UID: 0, Argv: []string{"/bin/sh", "-c", "cd " + www + " && chown nobody:nobody *"}})
+	if expected := []string{"unquoted wildcard * in arguments of chown allows option injection"}; !reflect.DeepEqual(reasons, expected) {
+		t.Errorf("Wrong risks as root: got %q but want %q", reasons, expected)
+	}
+}
+
+func TestCheckRisks(t *testing.T) {
+	c := newTestChecker()
+	pe := psscanner.PSEvent{UID: 0, PID: 23, Argv: []string{"sh", "-c", "mysqldump -phunter2 db > /b/db.sql; tar czf /b.tgz /b/*"}}
+	expected := []Finding{
+		{Kind: KindRisk, PID: 23, UID: 0, CMD: "sh -c 'mysqldump -phunter2 db > /b/db.sql; tar czf /b.tgz /b/*'", Reason: "unquoted wildcard /b/* in arguments of tar allows option injection"},
+		{Kind: KindSecret, PID: 23, UID: 0, CMD: "sh -c 'mysqldump -phunter2 db > /b/db.sql; tar czf /b.tgz /b/*'", Reason: "password of mysqldump passed as argument"},
+	}
+	if found := c.Check(pe); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+	// the same command line is reported once
+	if found := c.Check(pe); found != nil {
+		t.Errorf("Risk reported again: %+v", found)
+	}
+}
+
+func TestCheckRisksAsRoot(t *testing.T) {
+	c := newTestChecker()
+	c.uid = 0
+	pe := psscanner.PSEvent{UID: 0, PID: 23, Argv: []string{"/bin/sh", "-c", "cd /var/www && chown www-data *"}}
+	expected := []Finding{{Kind: KindRisk, PID: 23, UID: 0, CMD: "/bin/sh -c 'cd /var/www && chown www-data *'", Reason: "unquoted wildcard * in arguments of chown allows option injection"}}
+	if found := c.Check(pe); !reflect.DeepEqual(found, expected) {
+		t.Errorf("Wrong findings: got %+v but want %+v", found, expected)
+	}
+}
@@ -0,0 +1,409 @@
+package findings
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// Mask replaces secrets in redacted output
+const Mask = "***"
+
+// secretVariable matches environment variables named after a password, token or key, e.g., PGPASSWORD
+var secretVariable = regexp.MustCompile(`(?i)(pass|passwd|password|pwd|secret|token|api[-_]?key|credential)`)
+
+// secretOption matches options named after a password, token or key, e.g., --db-password
+var secretOption = regexp.MustCompile(`(?i)^--?[a-z0-9_-]*(pass|passwd|password|pwd|secret|token|api[-_]?key)$`)
+
+// shortPasswordOption are commands taking the password as -p<pass>, or -p <pass> for sshpass
+var shortPasswordOption = regexp.MustCompile(`^(mysql|mysqldump|mysqladmin|mariadb|mariadb-dump|sshpass)$`)
+
+// userPasswordOption are commands taking user:password after -u or --user
+var userPasswordOption = regexp.MustCompile(`^(curl|wget)$`)
+
+// textSecrets are secrets recognized anywhere in an argument. The last submatch, or the
+// whole match if there is none, is the secret. A name before it replaces %s in the reason.
+var textSecrets = []struct {
+	re     *regexp.Regexp
+	reason string
+}{
+	{regexp.MustCompile(`(?i)(?:^|[\s'"])(-{0,2}[a-z0-9_-]*(?:pass|passwd|password|pwd|secret|token|api[-_]?key|secret[-_]access[-_]key))=([^\s'"&;|<>()]+)`), "secret in %s"},
+	{regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^/\s@]+)@`), "credentials in URL"},
+	{regexp.MustCompile(`(?i)\b(?:proxy-)?authorization:\s*(?:(?:basic|bearer|digest|token)\s+)?([^\s'"&;|<>()]+)`), "authorization header"},
+	{regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`), "AWS access key"},
+	{regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`), "GitHub token"},
+	{regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`), "Slack token"},
+}
+
+// secret is the part of an argument from start to end that holds a secret
+type secret struct {
+	arg        int
+	start, end int
+	what       string
+}
+
+// Secrets tells which secrets a command line reveals, once for each kind of secret
+func Secrets(argv []string) []string {
+	var reasons []string
+	for _, s := range argvSecrets(argv) {
+		reasons = appendOnce(reasons, s.what+" passed as argument")
+	}
+	return reasons
+}
+
+// PipelineSecrets tells which secrets the command line of a pipeline reveals that those
+// of its members don't, such as a password echoed into passwd
+func PipelineSecrets(pe psscanner.PSEvent) []string {
+	known := make(map[string]bool)
+	for _, m := range pe.Pipeline {
+		if m.Argv == nil {
+			for _, s := range scriptSecrets(m.CMD) {
+				known[s.what] = true
+			}
+			continue
+		}
+		for _, s := range argvSecrets(m.Argv) {
+			known[s.what] = true
+		}
+	}
+	var reasons []string
+	for _, s := range scriptSecrets(pipelineScript(pe.Pipeline)) {
+		if !known[s.what] {
+			reasons = appendOnce(reasons, s.what+" passed as argument")
+		}
+	}
+	return reasons
+}
+
+// EnvSecrets tells which environment variables hold secrets, sorted by name
+func EnvSecrets(env map[string]string) []string {
+	var reasons []string
+	for _, name := range sortedNames(env) {
+		if len(envSecrets(name, env[name])) > 0 {
+			reasons = append(reasons, "secret in variable "+name+" of environment")
+		}
+	}
+	return reasons
+}
+
+// envSecrets returns the secrets in the value of an environment variable, which is secret
+// as a whole if the name suggests so
+func envSecrets(name, value string) []secret {
+	if value == "" {
+		return nil
+	}
+	if secretVariable.MatchString(name) {
+		return []secret{whole(0, value, "secret in variable "+name)}
+	}
+	return textSecretsOf(0, value)
+}
+
+func sortedNames(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Redact returns argv with its secrets replaced by Mask. It returns argv itself if there
+// are none and a copy otherwise.
+func Redact(argv []string) []string {
+	redacted, _ := redact(argv)
+	return redacted
+}
+
+func redact(argv []string) ([]string, bool) {
+	found := argvSecrets(argv)
+	if len(found) == 0 {
+		return argv, false
+	}
+	byArg := make(map[int][]secret)
+	for _, s := range found {
+		byArg[s.arg] = append(byArg[s.arg], s)
+	}
+	redacted := make([]string, len(argv))
+	copy(redacted, argv)
+	for i, secrets := range byArg {
+		redacted[i] = mask(argv[i], secrets)
+	}
+	return redacted, true
+}
+
+// RedactText masks the secrets in a command line given as text, such as the previous
+// command of a process, which is split into arguments like a shell would
+func RedactText(cmd string) string {
+	if found := scriptSecrets(cmd); len(found) > 0 {
+		return mask(cmd, found)
+	}
+	return cmd
+}
+
+// pipelineScript renders the members of a pipeline as a shell script with arguments in plain
+// single quotes, unlike the ANSI-C quotes of the printed command, so that the secrets found in
+// the words of the script can be located by their text
+func pipelineScript(members []psscanner.PipelineMember) string {
+	cmds := make([]string, len(members))
+	for i, m := range members {
+		if m.Argv == nil {
+			cmds[i] = m.CMD
+			continue
+		}
+		args := make([]string, len(m.Argv))
+		for j, arg := range m.Argv {
+			args[j] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		cmds[i] = strings.Join(args, " ")
+	}
+	return strings.Join(cmds, " | ")
+}
+
+// redactPipeline masks the secrets of the members of a pipeline. Those found in the command
+// line of the whole pipeline, such as a password echoed into passwd, are masked wherever
+// their value appears in the arguments of a member.
+func redactPipeline(members []psscanner.PipelineMember, found []secret, cmd string) []psscanner.PipelineMember {
+	redacted := make([]psscanner.PipelineMember, len(members))
+	for i, m := range members {
+		if m.Argv == nil {
+			m.CMD = RedactText(m.CMD)
+			redacted[i] = m
+			continue
+		}
+		argv, _ := redact(m.Argv)
+		changed := false
+		for _, s := range found {
+			value := cmd[s.start:s.end]
+			if value == "" {
+				continue
+			}
+			for j, arg := range argv {
+				if strings.Contains(arg, value) {
+					if !changed {
+						argv = append([]string(nil), argv...)
+						changed = true
+					}
+					argv[j] = strings.ReplaceAll(arg, value, Mask)
+				}
+			}
+		}
+		m.Argv, m.CMD = argv, strings.Join(argv, " ")
+		redacted[i] = m
+	}
+	return redacted
+}
+
+// RedactEvent masks the secrets in the command lines of a process event and its ancestors
+// and in its environment
+func RedactEvent(pe psscanner.PSEvent) psscanner.PSEvent {
+	if pe.Argv == nil {
+		pe.CMD = RedactText(pe.CMD)
+	} else if argv, ok := redact(pe.Argv); ok {
+		pe.Argv, pe.CMD = argv, strings.Join(argv, " ")
+	}
+	if pe.Previous != "" {
+		pe.Previous = RedactText(pe.Previous)
+	}
+	if len(pe.Pipeline) > 0 {
+		script := pipelineScript(pe.Pipeline)
+		pe.Pipeline = redactPipeline(pe.Pipeline, scriptSecrets(script), script)
+		pe.CMD = psscanner.PipelineCommand(pe.Pipeline)
+	}
+	if len(pe.Ancestors) > 0 {
+		ancestors := make([]psscanner.Ancestor, len(pe.Ancestors))
+		for i, a := range pe.Ancestors {
+			if a.Argv == nil {
+				a.CMD = RedactText(a.CMD)
+			} else if argv, ok := redact(a.Argv); ok {
+				a.Argv, a.CMD = argv, strings.Join(argv, " ")
+			}
+			ancestors[i] = a
+		}
+		pe.Ancestors = ancestors
+	}
+	if len(pe.Env) > 0 {
+		env := make(map[string]string, len(pe.Env))
+		for name, value := range pe.Env {
+			if found := envSecrets(name, value); len(found) > 0 {
+				value = mask(value, found)
+			}
+			env[name] = value
+		}
+		pe.Env = env
+	}
+	return pe
+}
+
+// argvSecrets returns the secrets in the arguments of a process, including the variables
+// env sets and the commands of shell scripts
+func argvSecrets(argv []string) []secret {
+	offset := 0
+	var found []secret
+	if len(argv) > 0 && filepath.Base(argv[0]) == "env" {
+		offset = len(argv) - len(skipEnv(argv[1:]))
+		for i := 1; i < offset; i++ {
+			found = append(found, textSecretsOf(i, argv[i])...)
+		}
+	}
+	for _, s := range findSecrets(argv[offset:]) {
+		s.arg += offset
+		found = append(found, s)
+	}
+	if i := scriptIndex(argv[offset:]); i >= 0 {
+		for _, s := range scriptSecrets(argv[offset+i]) {
+			s.arg = offset + i
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// findSecrets returns the secrets in the arguments of a command, args[0] being its name
+func findSecrets(args []string) []secret {
+	var found []secret
+	command := ""
+	if len(args) > 0 {
+		command = filepath.Base(args[0])
+	}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case command == "sshpass" && !strings.HasPrefix(arg, "-"):
+			// the command run by sshpass, with options of its own
+			for _, s := range findSecrets(args[i:]) {
+				s.arg += i
+				found = append(found, s)
+			}
+			return found
+		case command == "sshpass" && arg == "-p" && i+1 < len(args):
+			found = append(found, whole(i+1, args[i+1], "password of sshpass"))
+			i++
+		case secretOption.MatchString(arg) && i+1 < len(args):
+			found = append(found, whole(i+1, args[i+1], "secret in option "+arg))
+			i++
+		case userPasswordOption.MatchString(command) && (arg == "-u" || arg == "--user") && i+1 < len(args):
+			if colon := strings.IndexByte(args[i+1], ':'); colon >= 0 && colon+1 < len(args[i+1]) {
+				found = append(found, secret{arg: i + 1, start: colon + 1, end: len(args[i+1]), what: "password of " + command})
+			}
+			i++
+		case shortPasswordOption.MatchString(command) && len(arg) > 2 && arg[:2] == "-p":
+			found = append(found, secret{arg: i, start: 2, end: len(arg), what: "password of " + command})
+		default:
+			found = append(found, textSecretsOf(i, arg)...)
+		}
+	}
+	return found
+}
+
+func whole(i int, arg, what string) secret {
+	return secret{arg: i, start: 0, end: len(arg), what: what}
+}
+
+// textSecretsOf returns the secrets recognized in the text of an argument
+func textSecretsOf(i int, arg string) []secret {
+	var found []secret
+	for _, ts := range textSecrets {
+		for _, m := range ts.re.FindAllStringSubmatchIndex(arg, -1) {
+			s := secret{arg: i, start: m[0], end: m[1], what: ts.reason}
+			if n := len(m); n > 2 {
+				s.start, s.end = m[n-2], m[n-1]
+			}
+			if len(m) > 4 {
+				name := arg[m[2]:m[3]]
+				if strings.HasPrefix(name, "-") {
+					s.what = strings.Replace(s.what, "%s", "option "+name, 1)
+				} else {
+					s.what = strings.Replace(s.what, "%s", "variable "+name, 1)
+				}
+			}
+			found = append(found, s)
+		}
+	}
+	return found
+}
+
+// scriptSecrets returns the secrets in the commands of a shell script. Secrets are found in
+// the words of the script, which loses quotes, so they are located by searching their text.
+func scriptSecrets(script string) []secret {
+	type located struct{ text, what string }
+	var values []located
+	add := func(text, what string) {
+		values = append(values, located{text, what})
+	}
+
+	cmds := commands(splitShell(script))
+	for i, cmd := range cmds {
+		args := cmd.args()
+		for _, s := range findSecrets(args) {
+			add(args[s.arg][s.start:s.end], s.what)
+		}
+		if j := scriptIndex(args); j >= 0 {
+			for _, s := range scriptSecrets(args[j]) {
+				add(args[j][s.start:s.end], s.what)
+			}
+		}
+		for _, name := range sortedNames(cmd.env) {
+			assigned := name + "=" + cmd.env[name]
+			for _, s := range textSecretsOf(0, assigned) {
+				add(assigned[s.start:s.end], s.what)
+			}
+		}
+		if name := filepath.Base(cmd.name()); (name == "echo" || name == "printf") && cmd.op == "|" && i+1 < len(cmds) {
+			if next := filepath.Base(cmds[i+1].name()); next == "passwd" || next == "chpasswd" {
+				for _, arg := range args[1:] {
+					if !strings.HasPrefix(arg, "-") {
+						add(arg, "password for "+next)
+					}
+				}
+			}
+		}
+	}
+
+	var found []secret
+	pos := 0
+	for _, v := range values {
+		if v.text == "" {
+			continue
+		}
+		start := strings.Index(script[pos:], v.text)
+		if start >= 0 {
+			start += pos
+		} else if start = strings.Index(script, v.text); start < 0 {
+			continue
+		}
+		found = append(found, secret{start: start, end: start + len(v.text), what: v.what})
+		pos = start + len(v.text)
+	}
+	return found
+}
+
+// mask replaces the secrets of an argument, which may overlap, with Mask
+func mask(arg string, secrets []secret) string {
+	sort.Slice(secrets, func(i, j int) bool { return secrets[i].start < secrets[j].start })
+	var b strings.Builder
+	pos := 0
+	for _, s := range secrets {
+		if s.end <= pos {
+			continue
+		}
+		if s.start >= pos {
+			b.WriteString(arg[pos:s.start])
+			b.WriteString(Mask)
+		}
+		pos = s.end
+	}
+	b.WriteString(arg[pos:])
+	return b.String()
+}
+
+func appendOnce(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -2,14 +2,22 @@ package fswatcher
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/dominicbreuker/pspy/internal/fswatcher/inotify"
 	"github.com/dominicbreuker/pspy/internal/fswatcher/walker"
+	"golang.org/x/sys/unix"
 )
 
 type Inotify interface {
 	Init() error
 	Watch(dir string) error
+	Forget(wd int)
+	Unwatch(wd int) error
+	Watched() map[int]string
 	NumWatchers() int
 	Read(buf []byte) (int, error)
 	ParseNextEvent(buf []byte) (*inotify.Event, uint32, error)
@@ -20,12 +28,30 @@ type Walker interface {
 	Walk(dir string, depth int) (chan string, chan error, chan struct{})
 }
 
+// FSEvent is a single file system event reported by inotify
+type FSEvent struct {
+	Op   string
+	Path string
+	// when the event was captured
+	Time time.Time
+}
+
+func (evt FSEvent) String() string {
+	return fmt.Sprintf("%20s | %s", evt.Op, evt.Path)
+}
+
 type FSWatcher struct {
 	i           Inotify
 	w           Walker
 	maxWatchers int
 	eventSize   int
 	drain       bool
+
+	mu    sync.Mutex // guards rdirs and dirs, which may change while running
+	rdirs []string
+	dirs  []string
+
+	walks sync.WaitGroup // walks of directories created while running
 }
 
 func NewFSWatcher() *FSWatcher {
@@ -65,7 +91,40 @@ func (fs *FSWatcher) Init(rdirs, dirs []string) (chan error, chan struct{}) {
 	return errCh, doneCh
 }
 
+// Update changes the watched directories while running. Watchers no longer
+// covered by rdirs or dirs are removed, new directories are added.
+func (fs *FSWatcher) Update(rdirs, dirs []string) (chan error, chan struct{}) {
+	errCh := make(chan error)
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		fs.setDirs(rdirs, dirs)
+		for wd, dir := range fs.i.Watched() {
+			if fs.isCovered(dir) {
+				continue
+			}
+			if err := fs.i.Unwatch(wd); err != nil {
+				errCh <- fmt.Errorf("removing watcher of %s: %v", dir, err)
+			}
+		}
+		// watching a directory twice is harmless, inotify returns the existing watch descriptor
+		fs.addWatchers(rdirs, dirs, errCh)
+	}()
+
+	return errCh, doneCh
+}
+
+func (fs *FSWatcher) setDirs(rdirs, dirs []string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.rdirs = rdirs
+	fs.dirs = dirs
+}
+
 func (fs *FSWatcher) addWatchers(rdirs, dirs []string, errCh chan error) {
+	fs.setDirs(rdirs, dirs)
 	for _, dir := range rdirs {
 		fs.addWatchersToDir(dir, -1, errCh)
 	}
@@ -108,8 +167,8 @@ func (fs *FSWatcher) handleNextWalkerResult(dirCh chan string, walkErrCh chan er
 	return false
 }
 
-func (fs *FSWatcher) Run() (chan struct{}, chan string, chan error) {
-	triggerCh, dataCh, eventCh, errCh := make(chan struct{}), make(chan []byte), make(chan string), make(chan error)
+func (fs *FSWatcher) Run() (chan struct{}, chan FSEvent, chan error) {
+	triggerCh, dataCh, eventCh, errCh := make(chan struct{}), make(chan []byte), make(chan FSEvent), make(chan error)
 
 	go fs.observe(triggerCh, dataCh, errCh)
 	go fs.parseEvents(dataCh, eventCh, errCh)
@@ -137,13 +196,15 @@ func (fs *FSWatcher) observe(triggerCh chan struct{}, dataCh chan []byte, errCh
 	}
 }
 
-func (fs *FSWatcher) parseEvents(dataCh chan []byte, eventCh chan string, errCh chan error) {
+func (fs *FSWatcher) parseEvents(dataCh chan []byte, eventCh chan FSEvent, errCh chan error) {
 	for buf := range dataCh {
 		fs.handleChunk(buf, eventCh, errCh)
 	}
 }
 
-func (fs *FSWatcher) handleChunk(buf []byte, eventCh chan string, errCh chan error) {
+func (fs *FSWatcher) handleChunk(buf []byte, eventCh chan FSEvent, errCh chan error) {
+	// the chunk was read just now, as reading waits for it to be parsed
+	captured := time.Now()
 	var ptr uint32
 	for len(buf[ptr:]) > 0 {
 		event, size, err := fs.i.ParseNextEvent(buf[ptr:])
@@ -152,6 +213,54 @@ func (fs *FSWatcher) handleChunk(buf []byte, eventCh chan string, errCh chan err
 			errCh <- fmt.Errorf("parsing events: %v", err)
 			continue
 		}
-		eventCh <- fmt.Sprintf("%20s | %s", event.Op, event.Name)
+
+		if event.Mask&unix.IN_IGNORED != 0 {
+			fs.i.Forget(event.WD)
+			continue
+		}
+		if event.Mask&unix.IN_DELETE_SELF != 0 {
+			fs.i.Forget(event.WD)
+		}
+		if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 && fs.isRecursive(event.Name) {
+			// walking a large tree, e.g., one just unpacked, must not hold up reading events
+			fs.walks.Add(1)
+			go func(dir string) {
+				defer fs.walks.Done()
+				fs.addWatchersToDir(dir, -1, errCh)
+			}(event.Name)
+		}
+
+		eventCh <- FSEvent{Op: event.Op, Path: event.Name, Time: captured}
+	}
+}
+
+// isRecursive returns true if dir lies within one of the recursively watched directories
+func (fs *FSWatcher) isRecursive(dir string) bool {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, rdir := range fs.rdirs {
+		if strings.HasPrefix(dir, strings.TrimSuffix(rdir, "/")+"/") {
+			return true
+		}
 	}
+	return false
+}
+
+// isCovered returns true if dir is one of the watched directories or lies within a recursively watched one
+func (fs *FSWatcher) isCovered(dir string) bool {
+	dir = filepath.Clean(dir)
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, d := range fs.dirs {
+		if filepath.Clean(d) == dir {
+			return true
+		}
+	}
+	for _, rdir := range fs.rdirs {
+		rdir = filepath.Clean(rdir)
+		if rdir == dir || strings.HasPrefix(dir, strings.TrimSuffix(rdir, "/")+"/") {
+			return true
+		}
+	}
+	return false
 }
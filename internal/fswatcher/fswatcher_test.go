@@ -4,11 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/dominicbreuker/pspy/internal/fswatcher/inotify"
+	"golang.org/x/sys/unix"
 )
 
 func initObjs() (*MockInotify, *MockWalker, *FSWatcher) {
@@ -83,6 +86,85 @@ func TestRun(t *testing.T) {
 	expectEvent(t, eventCh, "type2 | name2")
 }
 
+func TestFSEvent(t *testing.T) {
+	e := FSEvent{Op: "CREATE", Path: "/tmp/file"}
+	if e.String() != "              CREATE | /tmp/file" {
+		t.Errorf("Wrong string representation: '%s'", e)
+	}
+}
+
+func TestRunWatchesNewDirs(t *testing.T) {
+	i, w, fs := initObjs()
+	i.initialized = true
+	fs.rdirs = []string{"mydir1/"}
+	w.subdirs["mydir1/new"] = []string{"mydir1/new/sub"}
+	i.events["newdir:____"] = &inotify.Event{Name: "mydir1/new", Op: "CREATE DIR", Mask: unix.IN_CREATE | unix.IN_ISDIR, WD: 1}
+	i.events["outdir:____"] = &inotify.Event{Name: "mydir2/new", Op: "CREATE DIR", Mask: unix.IN_CREATE | unix.IN_ISDIR, WD: 2}
+	i.events["movdir:____"] = &inotify.Event{Name: "mydir1/mov", Op: "MOVED_TO DIR", Mask: unix.IN_MOVED_TO | unix.IN_ISDIR, WD: 1}
+	i.events["delete:____"] = &inotify.Event{Name: "mydir1/new/", Op: "DELETE_SELF", Mask: unix.IN_DELETE_SELF, WD: 3}
+	i.events["ignore:____"] = &inotify.Event{Op: "IGNORED", Mask: unix.IN_IGNORED, WD: 3}
+	i.events["create:____"] = &inotify.Event{Name: "mydir1/file", Op: "CREATE", Mask: unix.IN_CREATE, WD: 1}
+	triggerCh, eventCh, _ := fs.Run()
+
+	go func() {
+		sendInotifyData(t, i.bufReads, "newdir:____outdir:____movdir:____delete:____ignore:____")
+		sendInotifyData(t, i.bufReads, "create:____")
+	}()
+
+	expectTrigger(t, triggerCh)
+	expectEvent(t, eventCh, "CREATE DIR | mydir1/new")
+	expectEvent(t, eventCh, "CREATE DIR | mydir2/new")
+	expectEvent(t, eventCh, "MOVED_TO DIR | mydir1/mov")
+	expectEvent(t, eventCh, "DELETE_SELF | mydir1/new/")
+	// the IGNORED event was handled before the next chunk
+	expectTrigger(t, triggerCh)
+	expectEvent(t, eventCh, "CREATE | mydir1/file")
+	fs.walks.Wait()
+
+	// new directories are walked concurrently
+	sort.Strings(i.watching)
+	if !reflect.DeepEqual(i.watching, []string{"mydir1/mov", "mydir1/new", "mydir1/new/sub"}) {
+		t.Errorf("Watching wrong directories: %+v", i.watching)
+	}
+	if !reflect.DeepEqual(i.forgotten, []int{3, 3}) {
+		t.Errorf("Forgot wrong watchers: %+v", i.forgotten)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	i, w, fs := initObjs()
+	i.initialized = true
+	fs.rdirs = []string{"/etc"}
+	fs.dirs = []string{"/tmp"}
+	w.subdirs["/usr/"] = []string{"/usr/bin"}
+	i.watched = map[int]string{1: "/etc", 2: "/etc/cron.d", 3: "/tmp", 4: "/usr/bin", 5: "/home/user"}
+
+	errCh, doneCh := fs.Update([]string{"/usr/", "/home"}, []string{"/tmp"})
+
+loop:
+	for {
+		select {
+		case <-doneCh:
+			break loop
+		case err := <-errCh:
+			t.Errorf("Unexpected error: %v", err)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("Test timeout")
+		}
+	}
+
+	sort.Ints(i.unwatched)
+	if !reflect.DeepEqual(i.unwatched, []int{1, 2}) {
+		t.Errorf("Removed wrong watchers: %+v", i.unwatched)
+	}
+	if !reflect.DeepEqual(i.watching, []string{"/usr/", "/usr/bin", "/home", "/tmp"}) {
+		t.Errorf("Watching wrong directories: %+v", i.watching)
+	}
+	if !fs.isRecursive("/usr/local") || fs.isRecursive("/etc/cron.d") {
+		t.Errorf("Recursive dirs not updated: %+v", fs.rdirs)
+	}
+}
+
 const timeout = 500 * time.Millisecond
 
 func sendInotifyData(t *testing.T, dataCh chan []byte, s string) {
@@ -101,10 +183,10 @@ func expectTrigger(t *testing.T, triggerCh chan struct{}) {
 	}
 }
 
-func expectEvent(t *testing.T, eventCh chan string, exp string) {
+func expectEvent(t *testing.T, eventCh chan FSEvent, exp string) {
 	select {
 	case e := <-eventCh:
-		if strings.TrimSpace(e) != exp {
+		if strings.TrimSpace(e.String()) != exp || e.Time.IsZero() {
 			t.Errorf("Wrong event: %+v", e)
 		}
 	case <-time.After(timeout):
@@ -128,16 +210,25 @@ func expectError(t *testing.T, errCh chan error, exp string) {
 // Mock Inotify
 
 type MockInotify struct {
+	mu          sync.Mutex // guards the watchers, which change while events are parsed
 	initialized bool
 	watching    []string
+	forgotten   []int
+	unwatched   []int
+	watched     map[int]string
 	bufReads    chan []byte
+	events      map[string]*inotify.Event
 }
 
 func NewMockInotify() *MockInotify {
 	return &MockInotify{
 		initialized: false,
 		watching:    make([]string, 0),
+		forgotten:   make([]int, 0),
+		unwatched:   make([]int, 0),
+		watched:     make(map[int]string),
 		bufReads:    make(chan []byte),
+		events:      make(map[string]*inotify.Event),
 	}
 }
 
@@ -150,11 +241,34 @@ func (i *MockInotify) Watch(dir string) error {
 	if !i.initialized {
 		return errors.New("Not yet initialized")
 	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.watching = append(i.watching, dir)
 	return nil
 }
 
+func (i *MockInotify) Forget(wd int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.forgotten = append(i.forgotten, wd)
+}
+
+func (i *MockInotify) Unwatch(wd int) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.unwatched = append(i.unwatched, wd)
+	return nil
+}
+
+func (i *MockInotify) Watched() map[int]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.watched
+}
+
 func (i *MockInotify) NumWatchers() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	return len(i.watching)
 }
 
@@ -170,6 +284,9 @@ func (i *MockInotify) Read(buf []byte) (int, error) {
 
 func (i *MockInotify) ParseNextEvent(buf []byte) (*inotify.Event, uint32, error) {
 	s := string(buf[:11])
+	if e, ok := i.events[s]; ok {
+		return e, 11, nil
+	}
 	t := strings.Split(s, ":")
 	if t[0] == "error" && t[1] == "parse" {
 		return nil, uint32(len(buf)), fmt.Errorf("parse-event-error")
@@ -15,6 +15,7 @@ var InotifyEvents = map[uint32]string{
 	unix.IN_MOVED_TO:                        "MOVED_TO",
 	unix.IN_MOVE_SELF:                       "MOVE_SELF",
 	unix.IN_OPEN:                            "OPEN",
+	unix.IN_IGNORED:                         "IGNORED",
 	(unix.IN_ACCESS | unix.IN_ISDIR):        "ACCESS DIR",
 	(unix.IN_ATTRIB | unix.IN_ISDIR):        "ATTRIB DIR",
 	(unix.IN_CLOSE_NOWRITE | unix.IN_ISDIR): "CLOSE_NOWRITE DIR",
@@ -24,6 +25,7 @@ var InotifyEvents = map[uint32]string{
 	(unix.IN_DELETE_SELF | unix.IN_ISDIR):   "DELETE_SELF DIR",
 	(unix.IN_MODIFY | unix.IN_ISDIR):        "MODIFY DIR",
 	(unix.IN_MOVED_FROM | unix.IN_ISDIR):    "MOVED_FROM DIR",
+	(unix.IN_MOVED_TO | unix.IN_ISDIR):      "MOVED_TO DIR",
 	(unix.IN_MOVE_SELF | unix.IN_ISDIR):     "MODE_SELF DIR",
 	(unix.IN_OPEN | unix.IN_ISDIR):          "OPEN DIR",
 }
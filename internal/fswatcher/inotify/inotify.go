@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -31,6 +32,7 @@ func init() {
 type Inotify struct {
 	FD       int
 	Watchers map[int]*Watcher
+	mu       sync.Mutex // guards Watchers, which change while events are parsed
 }
 
 type Watcher struct {
@@ -41,6 +43,8 @@ type Watcher struct {
 type Event struct {
 	Name string
 	Op   string
+	Mask uint32
+	WD   int
 }
 
 func NewInotify() *Inotify {
@@ -64,6 +68,8 @@ func (i *Inotify) Watch(dir string) error {
 	if wd < 0 {
 		return fmt.Errorf("adding watch to %s: errno: %d", dir, errno)
 	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	i.Watchers[wd] = &Watcher{
 		WD:  wd,
 		Dir: dir,
@@ -71,6 +77,33 @@ func (i *Inotify) Watch(dir string) error {
 	return nil
 }
 
+// Forget removes a watcher from the list, e.g., after the kernel dropped it since the directory is gone
+func (i *Inotify) Forget(wd int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	delete(i.Watchers, wd)
+}
+
+// Unwatch removes a watcher from the kernel and the list
+func (i *Inotify) Unwatch(wd int) error {
+	i.Forget(wd)
+	if _, err := unix.InotifyRmWatch(i.FD, uint32(wd)); err != nil {
+		return fmt.Errorf("removing watch %d: %v", wd, err)
+	}
+	return nil
+}
+
+// Watched returns the watched directories by watch descriptor
+func (i *Inotify) Watched() map[int]string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	dirs := make(map[int]string, len(i.Watchers))
+	for wd, w := range i.Watchers {
+		dirs[wd] = w.Dir
+	}
+	return dirs
+}
+
 var errno22Counter = 0
 
 func (i *Inotify) Read(buf []byte) (int, error) {
@@ -105,14 +138,22 @@ func (i *Inotify) ParseNextEvent(buf []byte) (*Event, uint32, error) {
 		return nil, offset, fmt.Errorf("possible inotify event overflow")
 	}
 
+	i.mu.Lock()
 	watcher, ok := i.Watchers[int(sys.Wd)]
+	i.mu.Unlock()
 	if !ok {
+		if sys.Mask&unix.IN_IGNORED != 0 {
+			// the kernel confirms removal of a watcher we already forgot
+			return &Event{Op: getEventOp(sys), Mask: sys.Mask, WD: int(sys.Wd)}, offset, nil
+		}
 		return nil, offset, fmt.Errorf("unknown watcher ID: %d", sys.Wd)
 	}
 
 	return &Event{
 		Name: getEventName(watcher, sys, buf, offset),
 		Op:   getEventOp(sys),
+		Mask: sys.Mask,
+		WD:   int(sys.Wd),
 	}, offset, nil
 }
 
@@ -140,6 +181,8 @@ func (i *Inotify) Close() error {
 }
 
 func (i *Inotify) NumWatchers() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	return len(i.Watchers)
 }
 
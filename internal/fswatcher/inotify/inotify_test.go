@@ -51,6 +51,9 @@ func TestInotify(t *testing.T) {
 	if e.Op != "CREATE" {
 		t.Fatalf("Wrong op: %s", e.Op)
 	}
+	if e.Mask != unix.IN_CREATE {
+		t.Fatalf("Wrong mask: %b", e.Mask)
+	}
 	if offset != 32 {
 		t.Fatalf("Wrong offset: %d", offset)
 	}
@@ -66,6 +69,76 @@ func TestInotify(t *testing.T) {
 	}
 }
 
+func TestInotifyForget(t *testing.T) {
+	i := NewInotify()
+	expectNoError(t, i.Init())
+	defer i.Close()
+
+	dir, err := ioutil.TempDir("", "pspy-inotify")
+	expectNoError(t, err)
+	expectNoError(t, i.Watch(dir))
+	expectNoError(t, os.Remove(dir))
+
+	ops := make([]string, 0)
+	buf := make([]byte, 5*EventSize)
+	for len(ops) < 2 {
+		n, err := i.Read(buf)
+		expectNoError(t, err)
+		var ptr uint32
+		for ptr < uint32(n) {
+			e, size, err := i.ParseNextEvent(buf[ptr:n])
+			expectNoError(t, err)
+			ptr += size
+			ops = append(ops, e.Op)
+			i.Forget(e.WD)
+		}
+	}
+
+	if ops[0] != "DELETE_SELF" || ops[1] != "IGNORED" {
+		t.Errorf("Wrong ops: %v", ops)
+	}
+	if i.NumWatchers() != 0 {
+		t.Errorf("Expected no watchers but have %d", i.NumWatchers())
+	}
+}
+
+func TestInotifyUnwatch(t *testing.T) {
+	i := NewInotify()
+	expectNoError(t, i.Init())
+	defer i.Close()
+
+	dir, err := ioutil.TempDir("", "pspy-inotify")
+	expectNoError(t, err)
+	defer os.Remove(dir)
+	expectNoError(t, i.Watch(dir))
+
+	watched := i.Watched()
+	if len(watched) != 1 {
+		t.Fatalf("Wrong watchers: %v", watched)
+	}
+	for wd, d := range watched {
+		if d != dir {
+			t.Errorf("Wrong dir watched: %s", d)
+		}
+		expectNoError(t, i.Unwatch(wd))
+		if err := i.Unwatch(wd); err == nil {
+			t.Errorf("Expected error when removing watch twice")
+		}
+	}
+
+	buf := make([]byte, 5*EventSize)
+	n, err := i.Read(buf)
+	expectNoError(t, err)
+	e, _, err := i.ParseNextEvent(buf[:n])
+	expectNoError(t, err)
+	if e.Op != "IGNORED" {
+		t.Errorf("Wrong op: %s", e.Op)
+	}
+	if i.NumWatchers() != 0 {
+		t.Errorf("Expected no watchers but have %d", i.NumWatchers())
+	}
+}
+
 func expectNoError(t *testing.T, err error) {
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
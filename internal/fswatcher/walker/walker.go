@@ -37,7 +37,7 @@ func (w *Walker) Walk(root string, depth int) (dirCh chan string, errCh chan err
 	c := newChans()
 
 	go func() {
-		defer close(dirCh)
+		defer close(c.dirCh)
 		descent(root, depth-1, c)
 	}()
 	return c.dirCh, c.errCh, c.doneCh
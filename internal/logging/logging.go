@@ -3,9 +3,14 @@ package logging
 import (
 	"fmt"
 	"hash/fnv"
+	"io"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -22,6 +27,7 @@ type Logger struct {
 	infoLogger  *log.Logger
 	errorLogger *log.Logger
 	eventLogger *log.Logger
+	rawLogger   *log.Logger
 	debug       bool
 }
 
@@ -30,10 +36,16 @@ func NewLogger(debug bool) *Logger {
 		infoLogger:  log.New(os.Stdout, "", 0),
 		errorLogger: log.New(os.Stderr, "", 0),
 		eventLogger: log.New(os.Stdout, "", log.Ldate|log.Ltime),
+		rawLogger:   log.New(os.Stdout, "", 0),
 		debug:       debug,
 	}
 }
 
+// SetInfoOutput redirects info messages, e.g., to keep stdout free for machine readable events
+func (l *Logger) SetInfoOutput(w io.Writer) {
+	l.infoLogger.SetOutput(w)
+}
+
 // Infof writes an info message to stdout
 func (l *Logger) Infof(format string, v ...interface{}) {
 	l.infoLogger.Printf(format, v...)
@@ -48,16 +60,79 @@ func (l *Logger) Errorf(debug bool, format string, v ...interface{}) {
 
 // Eventf writes an event with timestamp to stdout
 func (l *Logger) Eventf(color int, format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	if color != ColorNone {
-		msg = fmt.Sprintf("\x1b[%d;1m%s\x1b[0m", 30+color, msg)
+	l.eventLogger.Printf("%s", colorize(color, fmt.Sprintf(format, v...)))
+}
+
+// EventAtf writes an event with the given timestamp to stdout, e.g., when replaying a recorded event
+func (l *Logger) EventAtf(t time.Time, color int, format string, v ...interface{}) {
+	l.rawLogger.Printf("%s %s", t.Local().Format("2006/01/02 15:04:05"), colorize(color, fmt.Sprintf(format, v...)))
+}
+
+func colorize(color int, msg string) string {
+	if color == ColorNone {
+		return msg
+	}
+	return fmt.Sprintf("\x1b[%d;1m%s\x1b[0m", 30+color, msg)
+}
+
+// Rawf writes a message to stdout without timestamp or color
+func (l *Logger) Rawf(format string, v ...interface{}) {
+	l.rawLogger.Printf(format, v...)
+}
+
+// Escape makes untrusted text safe to print on a terminal. Control characters, including
+// the ESC of escape sequences, and bidirectional overrides become visible escapes such as
+// \x1b, \r or \u202e, and bytes that are not valid UTF-8 are written as \xNN.
+func Escape(s string) string {
+	if isPrintable(s) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			fmt.Fprintf(&b, "\\x%02x", s[i])
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r < utf8.RuneSelf && unicode.IsControl(r):
+			fmt.Fprintf(&b, "\\x%02x", r)
+		case unicode.IsControl(r) || isBidi(r):
+			fmt.Fprintf(&b, "\\u%04x", r)
+		default:
+			b.WriteString(s[i : i+size])
+		}
+		i += size
 	}
+	return b.String()
+}
 
-	l.eventLogger.Printf("%s", msg)
+func isPrintable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isBidi reports characters that reorder the text around them, which may hide parts of a line
+func isBidi(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
 }
 
 func GetColorByUID(uid int) int {
+	return GetColorByKey(strconv.Itoa(uid))
+}
+
+// GetColorByKey picks one of the colors from ColorRed to ColorTeal for a key, such as a
+// container ID, the same for every event with that key
+func GetColorByKey(key string) int {
 	h := fnv.New32a()
-	h.Write([]byte(strconv.Itoa(uid)))
+	h.Write([]byte(key))
 	return (int(h.Sum32()) % (ColorTeal)) + 1
 }
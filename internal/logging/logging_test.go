@@ -6,6 +6,7 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 const dateFormatPattern = `[\d]{4}/[\d]{2}/[\d]{2} [\d]{2}:[\d]{2}:[\d]{2}`
@@ -28,6 +29,9 @@ var logTests = []struct {
 	{l.eventLogger, func() { l.Eventf(ColorNone, "Event message") }, dateFormatPattern + " Event message\n", nil},
 	{l.eventLogger, func() { l.Eventf(ColorRed, "Event message") }, dateFormatPattern + " Event message\n", [][]byte{[]byte("\x1b[31;1m"), []byte("\x1b[0m")}},
 	{l.eventLogger, func() { l.Eventf(ColorGreen, "Event message") }, dateFormatPattern + " Event message\n", [][]byte{[]byte("\x1b[32;1m"), []byte("\x1b[0m")}},
+	{l.rawLogger, func() { l.Rawf(`{"kind":"%s"}`, "CMD") }, `^\{"kind":"CMD"\}\n$`, nil},
+	{l.rawLogger, func() { l.EventAtf(time.Date(2018, 2, 18, 21, 1, 1, 0, time.Local), ColorNone, "Event message") }, "^2018/02/18 21:01:01 Event message\n$", nil},
+	{l.rawLogger, func() { l.EventAtf(time.Date(2018, 2, 18, 21, 1, 1, 0, time.Local), ColorRed, "Event message") }, "^2018/02/18 21:01:01 Event message\n$", [][]byte{[]byte("\x1b[31;1m"), []byte("\x1b[0m")}},
 }
 
 func TestLogging(t *testing.T) {
@@ -99,3 +103,36 @@ func TestGetColorByUID(t *testing.T) {
 		t.Errorf("GetColorByUID returned maximum color %d, not %d, on 1000 trials, which is extremely unlikely", maxColor, ColorTeal)
 	}
 }
+
+func TestGetColorByKey(t *testing.T) {
+	if GetColorByKey("0") != GetColorByUID(0) {
+		t.Errorf("GetColorByUID(0)=%d differs from GetColorByKey(\"0\")=%d", GetColorByUID(0), GetColorByKey("0"))
+	}
+	for _, key := range []string{"", "cron.service", "3f4e1a9c2b7d"} {
+		if color := GetColorByKey(key); color < 1 || color > ColorTeal {
+			t.Errorf("GetColorByKey(%q)=%d but this is out of range [%d, %d]", key, color, ColorRed, ColorTeal)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{in: "/usr/bin/ls -la", expected: "/usr/bin/ls -la"},
+		{in: "grüße", expected: "grüße"},
+		{in: "\x1b[2Jcleared", expected: `\x1b[2Jcleared`},
+		{in: "a\rb\nc\td", expected: `a\rb\nc\td`},
+		{in: "nul\x00del\x7f", expected: `nul\x00del\x7f`},
+		{in: "invalid\xff\xfe", expected: `invalid\xff\xfe`},
+		{in: "c1\u009bcsi", expected: `c1\u009bcsi`},
+		{in: "txt.\u202eexe", expected: `txt.\u202eexe`},
+	}
+
+	for _, tt := range tests {
+		if got := Escape(tt.in); got != tt.expected {
+			t.Errorf("Escape(%q): got %s but wanted %s", tt.in, got, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package pspy
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/dominicbreuker/pspy/internal/config"
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/logging"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// hook for testing
+var now = time.Now
+
+type printer interface {
+	printPS(pe psscanner.PSEvent)
+	printFS(fe fswatcher.FSEvent)
+	printFinding(f findings.Finding)
+}
+
+func newPrinter(cfg *config.Config, logger Logger) printer {
+	if cfg.Format == config.FormatJSON {
+		return &jsonPrinter{logger: logger}
+	}
+	return &textPrinter{logger: logger, colored: cfg.Colored, colorBy: cfg.ColorBy, tree: cfg.Tree, sessions: cfg.Sessions}
+}
+
+// textPrinter writes human readable events with timestamps and colors.
+// Command lines and paths are escaped so they can't inject terminal escape sequences.
+type textPrinter struct {
+	logger  Logger
+	colored bool
+	colorBy string
+	tree    bool
+	// group commands by login session, last is the key of the session printed before
+	sessions    bool
+	lastSession string
+}
+
+func (p *textPrinter) printPS(pe psscanner.PSEvent) {
+	color := logging.ColorNone
+	if p.colored && pe.Kind != psscanner.KindMissed {
+		color = p.color(pe)
+	}
+	if p.sessions {
+		pe = p.session(pe, color)
+	}
+	s := pe.String()
+	if p.tree {
+		s = pe.TreeString()
+	}
+	p.event(pe.Time, color, "%s: %s", pe.Kind, logging.Escape(s))
+}
+
+// session prints a header when an event belongs to another login session than the event
+// before, so that the commands of a session read like a transcript beneath it. The event is
+// returned without the login UID and audit session, which the header shows.
+func (p *textPrinter) session(pe psscanner.PSEvent, color int) psscanner.PSEvent {
+	key := ""
+	if pe.Session != nil {
+		key = pe.Session.Key()
+	}
+	if key == "" {
+		p.lastSession = ""
+		return pe
+	}
+	if key != p.lastSession {
+		p.lastSession = key
+		header := key
+		if pe.Session.LoginUID >= 0 {
+			header += fmt.Sprintf(" LOGINUID=%d", pe.Session.LoginUID)
+		}
+		if pe.Session.TTY != "" {
+			header += " TTY=" + pe.Session.TTY
+		}
+		if color != logging.ColorNone {
+			color = logging.GetColorByKey(key)
+		}
+		p.event(pe.Time, color, "SESSION: %s", header)
+	}
+	session := *pe.Session
+	session.LoginUID, session.SessionID = -1, -1
+	pe.Session = &session
+	return pe
+}
+
+// color picks the color of a process event by the key configured with color-by,
+// falling back to the UID for events without the key
+func (p *textPrinter) color(pe psscanner.PSEvent) int {
+	key := ""
+	if pe.Cgroup != nil {
+		switch p.colorBy {
+		case "container":
+			key = pe.Cgroup.Container
+		case "pod":
+			key = pe.Cgroup.Pod
+		case "unit":
+			key = pe.Cgroup.Unit
+		case "slice":
+			key = pe.Cgroup.Slice
+		}
+	}
+	if key == "" {
+		return logging.GetColorByUID(pe.UID)
+	}
+	return logging.GetColorByKey(key)
+}
+
+func (p *textPrinter) printFS(fe fswatcher.FSEvent) {
+	p.event(fe.Time, logging.ColorNone, "FS: %s", logging.Escape(fe.String()))
+}
+
+// printFinding highlights findings in red, regardless of the colors of the user
+func (p *textPrinter) printFinding(f findings.Finding) {
+	color := logging.ColorNone
+	if p.colored {
+		color = logging.ColorRed
+	}
+	p.event(f.Time, color, "%s: %s", f.Kind, logging.Escape(f.String()))
+}
+
+// event prints events with the time they were captured, if known
+func (p *textPrinter) event(t time.Time, color int, format string, v ...interface{}) {
+	if t.IsZero() {
+		p.logger.Eventf(color, format, v...)
+	} else {
+		p.logger.EventAtf(t, color, format, v...)
+	}
+}
+
+// jsonPrinter writes one JSON object per event (JSON Lines)
+type jsonPrinter struct {
+	logger Logger
+}
+
+type jsonEvent struct {
+	Timestamp    time.Time                  `json:"timestamp"`
+	Kind         string                     `json:"kind"`
+	UID          *int                       `json:"uid,omitempty"`
+	PID          int                        `json:"pid,omitempty"`
+	PPID         *int                       `json:"ppid,omitempty"`
+	CMD          string                     `json:"cmd,omitempty"`
+	Argv         []string                   `json:"argv,omitempty"`
+	Lifetime     float64                    `json:"lifetime,omitempty"` // seconds
+	Exe          string                     `json:"exe,omitempty"`
+	Cwd          string                     `json:"cwd,omitempty"`
+	Comm         string                     `json:"comm,omitempty"`
+	StartTime    *time.Time                 `json:"start_time,omitempty"`
+	UIDs         *psscanner.IDs             `json:"uids,omitempty"`
+	GIDs         *psscanner.IDs             `json:"gids,omitempty"`
+	Cgroup       *psscanner.Cgroup          `json:"cgroup,omitempty"`
+	NS           *psscanner.Namespaces      `json:"ns,omitempty"`
+	Session      *psscanner.Session         `json:"session,omitempty"`
+	Pipes        *psscanner.Pipes           `json:"pipes,omitempty"`
+	Env          map[string]string          `json:"env,omitempty"`
+	KernelThread bool                       `json:"kernel_thread,omitempty"`
+	Previous     string                     `json:"previous,omitempty"`
+	Pipeline     []psscanner.PipelineMember `json:"pipeline,omitempty"`
+	Ancestors    []psscanner.Ancestor       `json:"ancestors,omitempty"`
+	Missed       *psscanner.Missed          `json:"missed,omitempty"`
+	Op           string                     `json:"op,omitempty"`
+	Path         string                     `json:"path,omitempty"`
+	Reason       string                     `json:"reason,omitempty"`
+	// exact bytes of fields that are not valid UTF-8, which JSON strings can't hold
+	Raw map[string][]byte `json:"raw,omitempty"`
+}
+
+func (p *jsonPrinter) printPS(pe psscanner.PSEvent) {
+	e := &jsonEvent{
+		Timestamp:    timestamp(pe.Time),
+		Kind:         pe.Kind.String(),
+		UID:          optionalInt(pe.UID),
+		PID:          pe.PID,
+		PPID:         optionalInt(pe.PPID),
+		Argv:         pe.Argv,
+		Lifetime:     pe.Lifetime.Seconds(),
+		Exe:          pe.Exe,
+		Cwd:          pe.Cwd,
+		Comm:         pe.Comm,
+		UIDs:         pe.UIDs,
+		GIDs:         pe.GIDs,
+		Cgroup:       pe.Cgroup,
+		NS:           pe.NS,
+		Session:      pe.Session,
+		Pipes:        pe.Pipes,
+		Env:          pe.Env,
+		KernelThread: pe.KernelThread,
+		Previous:     pe.Previous,
+		Pipeline:     pe.Pipeline,
+		Ancestors:    pe.Ancestors,
+		Missed:       pe.Missed,
+	}
+	if pe.CMD != psscanner.UnknownCMD {
+		e.CMD = pe.CMD
+	}
+	if !pe.StartTime.IsZero() {
+		e.StartTime = &pe.StartTime
+	}
+	e.keepRaw("argv", strings.Join(pe.Argv, "\x00"))
+	e.keepRaw("exe", pe.Exe)
+	e.keepRaw("cwd", pe.Cwd)
+	e.keepRaw("comm", pe.Comm)
+	for name, value := range pe.Env {
+		e.keepRaw("env."+name, value)
+	}
+	p.print(e)
+}
+
+func (p *jsonPrinter) printFS(fe fswatcher.FSEvent) {
+	e := &jsonEvent{
+		Timestamp: timestamp(fe.Time),
+		Kind:      "FS",
+		Op:        fe.Op,
+		Path:      fe.Path,
+	}
+	e.keepRaw("path", fe.Path)
+	p.print(e)
+}
+
+func (p *jsonPrinter) printFinding(f findings.Finding) {
+	e := &jsonEvent{
+		Timestamp: timestamp(f.Time),
+		Kind:      f.Kind.String(),
+		UID:       &f.UID,
+		PID:       f.PID,
+		CMD:       f.CMD,
+		Path:      f.Path,
+		Reason:    f.Reason,
+	}
+	e.keepRaw("path", f.Path)
+	p.print(e)
+}
+
+// keepRaw records the bytes of a field that encoding/json would alter, since it
+// replaces invalid UTF-8 with U+FFFD. Argv is recorded NUL separated as in /proc.
+func (e *jsonEvent) keepRaw(field, s string) {
+	if utf8.ValidString(s) {
+		return
+	}
+	if e.Raw == nil {
+		e.Raw = make(map[string][]byte)
+	}
+	e.Raw[field] = []byte(s)
+}
+
+func (p *jsonPrinter) print(e *jsonEvent) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		p.logger.Errorf(true, "ERROR: encoding event: %v", err)
+		return
+	}
+	p.logger.Rawf("%s", b)
+}
+
+// timestamp returns the capture time of events and the current time for those without
+func timestamp(t time.Time) time.Time {
+	if t.IsZero() {
+		return now()
+	}
+	return t
+}
+
+// optionalInt maps the scanner's "unknown" marker -1 to nil
+func optionalInt(i int) *int {
+	if i == -1 {
+		return nil
+	}
+	return &i
+}
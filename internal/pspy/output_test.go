@@ -0,0 +1,220 @@
+package pspy
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/config"
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/logging"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+func TestJSONPrinter(t *testing.T) {
+	defer mockNow(time.Date(2018, 2, 18, 21, 1, 1, 500, time.UTC))()
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatJSON}, l)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 23, PPID: 22, CMD: "sh -c echo a b", Argv: []string{"sh", "-c", "echo a b"}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":23,"ppid":22,"cmd":"sh -c echo a b","argv":["sh","-c","echo a b"]}`)
+
+	p.printPS(psscanner.PSEvent{UID: -1, PID: 24, PPID: -1, CMD: "???"})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","pid":24}`)
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindExit, UID: 0, PID: 23, PPID: 22, CMD: "sleep 1", Argv: []string{"sleep", "1"}, Lifetime: 1500 * time.Millisecond})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"EXIT","uid":0,"pid":23,"ppid":22,"cmd":"sleep 1","argv":["sleep","1"],"lifetime":1.5}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 25, PPID: -1, CMD: "sudo id", Argv: []string{"sudo", "id"}, Exe: "/usr/bin/sudo", Comm: "sudo", StartTime: time.Date(2018, 2, 18, 21, 1, 0, 0, time.UTC), UIDs: &psscanner.IDs{Real: 1000}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":25,"cmd":"sudo id","argv":["sudo","id"],"exe":"/usr/bin/sudo","comm":"sudo","start_time":"2018-02-18T21:01:00Z","uids":{"real":1000,"effective":0,"saved":0,"fs":0}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 26, PPID: -1, CMD: "id", Argv: []string{"id"}, Env: map[string]string{"SUDO_USER": "bob", "LANG": "C.\xff"}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":26,"cmd":"id","argv":["id"],"env":{"LANG":"C.�","SUDO_USER":"bob"},"raw":{"env.LANG":"Qy7/"}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 27, PPID: -1, CMD: "nginx", Argv: []string{"nginx"}, Cgroup: &psscanner.Cgroup{Path: "/docker/abc", Container: "abc"}, NS: &psscanner.Namespaces{PID: 1, Mount: 2, User: 3}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":27,"cmd":"nginx","argv":["nginx"],"cgroup":{"path":"/docker/abc","container":"abc"},"ns":{"pid":1,"mnt":2,"user":3}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 1000, PID: 28, PPID: -1, CMD: "ls", Argv: []string{"ls"}, Session: &psscanner.Session{TTY: "pts/0", SID: 20, PGRP: 28, LoginUID: 1000, SessionID: 3}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":1000,"pid":28,"cmd":"ls","argv":["ls"],"session":{"tty":"pts/0","sid":20,"pgrp":28,"loginuid":1000,"sessionid":3}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 29, PPID: 20, CMD: "cat", Argv: []string{"cat"}, Pipes: &psscanner.Pipes{Stdin: 100}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":29,"ppid":20,"cmd":"cat","argv":["cat"],"pipes":{"stdin":100}}`)
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindPipeline, UID: 0, PID: 28, PPID: 20, CMD: "echo x | cat", Pipeline: []psscanner.PipelineMember{{PID: 28, CMD: "echo x", Argv: []string{"echo", "x"}}, {PID: 29, CMD: "cat", Argv: []string{"cat"}}}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"PIPELINE","uid":0,"pid":28,"ppid":20,"cmd":"echo x | cat","pipeline":[{"pid":28,"uid":0,"cmd":"echo x","argv":["echo","x"]},{"pid":29,"uid":0,"cmd":"cat","argv":["cat"]}]}`)
+
+	p.printFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/file"})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"FS","op":"CREATE","path":"/tmp/file"}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 26, PPID: -1, CMD: "echo \x1b[2J \xff", Argv: []string{"echo", "\x1b[2J", "\xff"}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":26,"cmd":"echo \u001b[2J �","argv":["echo","\u001b[2J","�"],"raw":{"argv":"ZWNobwAbWzJKAP8="}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 28, PPID: 23, CMD: "passwd", Argv: []string{"passwd"}, Ancestors: []psscanner.Ancestor{{PID: 23, UID: 0, CMD: "sh -c x", Argv: []string{"sh", "-c", "x"}}, {PID: 22, UID: 0, CMD: "cron", Exited: true}}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":28,"ppid":23,"cmd":"passwd","argv":["passwd"],"ancestors":[{"pid":23,"uid":0,"cmd":"sh -c x","argv":["sh","-c","x"]},{"pid":22,"uid":0,"cmd":"cron","exited":true}]}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 27, PPID: -1, CMD: "id", Argv: []string{"id"}, Time: time.Date(2018, 2, 18, 21, 0, 0, 0, time.UTC)})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:00:00Z","kind":"CMD","uid":0,"pid":27,"cmd":"id","argv":["id"]}`)
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindMissed, UID: -1, PPID: -1, Missed: &psscanner.Missed{From: 30, To: 32, Count: 3, Caught: 7, Allocated: 10}})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"MISSED","missed":{"from":30,"to":32,"count":3,"caught":7,"allocated":10}}`)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 2, PPID: 0, CMD: "[kthreadd]", KernelThread: true})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CMD","uid":0,"pid":2,"ppid":0,"cmd":"[kthreadd]","kernel_thread":true}`)
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindChanged, UID: 0, PID: 29, PPID: -1, CMD: "id", Argv: []string{"id"}, Previous: "sh -c id"})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"CHANGED","uid":0,"pid":29,"cmd":"id","argv":["id"],"previous":"sh -c id"}`)
+
+	p.printFinding(findings.Finding{PID: 23, UID: 0, CMD: "bash /opt/job.sh", Path: "/opt/job.sh", Reason: "is writable"})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"FINDING","uid":0,"pid":23,"cmd":"bash /opt/job.sh","path":"/opt/job.sh","reason":"is writable"}`)
+
+	p.printFinding(findings.Finding{Kind: findings.KindRisk, PID: 24, UID: 0, CMD: "sshpass -p x ssh host", Reason: "password of sshpass passed as argument", Time: time.Date(2018, 2, 18, 21, 0, 0, 0, time.UTC)})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:00:00Z","kind":"RISK","uid":0,"pid":24,"cmd":"sshpass -p x ssh host","reason":"password of sshpass passed as argument"}`)
+
+	p.printFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/\xfe\r"})
+	expectMessage(t, l.Raw, `{"timestamp":"2018-02-18T21:01:01.0000005Z","kind":"FS","op":"CREATE","path":"/tmp/�\r","raw":{"path":"L3RtcC/+DQ=="}}`)
+}
+
+func TestTextPrinter(t *testing.T) {
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatText, Colored: false}, l)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 23, PPID: -1, CMD: "sh -c echo a b", Argv: []string{"sh", "-c", "echo a b"}})
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=23     | sh -c 'echo a b'")
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindExit, UID: 0, PID: 23, PPID: -1, CMD: "sleep 1", Lifetime: 1500 * time.Millisecond})
+	expectMessage(t, l.Event, "0 EXIT: UID=0     PID=23     | sleep 1 (lifetime ~1.5s)")
+
+	p.printFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/file"})
+	expectMessage(t, l.Event, "0 FS:               CREATE | /tmp/file")
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 24, PPID: -1, CMD: "echo \x1b[2J \xff", Argv: []string{"echo", "\x1b[2J", "\xff"}})
+	expectMessage(t, l.Event, `0 CMD: UID=0     PID=24     | echo $'\x1b[2J' $'\xff'`)
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindPipeline, UID: 0, PID: 28, PPID: -1, CMD: "echo x | cat", Pipeline: []psscanner.PipelineMember{{PID: 28}, {PID: 29}}})
+	expectMessage(t, l.Event, "0 PIPELINE: UID=0     PID=28     | echo x | cat (pids 28, 29)")
+
+	p.printPS(psscanner.PSEvent{Kind: psscanner.KindMissed, UID: -1, PPID: -1, Missed: &psscanner.Missed{From: 30, To: 32, Count: 3, Caught: 7, Allocated: 10}})
+	expectMessage(t, l.Event, "0 MISSED: 3 processes missed between PID 30 and 32 (caught 70.0% of 10 so far)")
+
+	p.printFinding(findings.Finding{PID: 23, UID: 0, CMD: "bash /opt/job.sh", Path: "/opt/job.sh", Reason: "is writable"})
+	expectMessage(t, l.Event, "0 FINDING: UID=0     PID=23     | /opt/job.sh is writable (running bash /opt/job.sh)")
+
+	p.printFinding(findings.Finding{Kind: findings.KindRisk, PID: 24, UID: 0, CMD: "sh -c 'tar cf /b.tar *'", Reason: "unquoted wildcard * in arguments of tar allows option injection"})
+	expectMessage(t, l.Event, "0 RISK: UID=0     PID=24     | unquoted wildcard * in arguments of tar allows option injection (running sh -c 'tar cf /b.tar *')")
+
+	p.printFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/evil\rCREATE | /tmp/harmless"})
+	expectMessage(t, l.Event, `0 FS:               CREATE | /tmp/evil\rCREATE | /tmp/harmless`)
+
+	// recorded events keep their time
+	p.printFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/file", Time: time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)})
+	expectMessage(t, l.Event, "2018-02-18T21:01:01Z 0 FS:               CREATE | /tmp/file")
+	p.printFinding(findings.Finding{PID: 23, UID: 0, CMD: "bash /opt/job.sh", Path: "/opt/job.sh", Reason: "is writable", Time: time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)})
+	expectMessage(t, l.Event, "2018-02-18T21:01:01Z 0 FINDING: UID=0     PID=23     | /opt/job.sh is writable (running bash /opt/job.sh)")
+}
+
+func TestTextPrinterColorBy(t *testing.T) {
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatText, Colored: true, ColorBy: "unit"}, l)
+
+	cron := &psscanner.Cgroup{Path: "/system.slice/cron.service", Unit: "cron.service", Slice: "system.slice"}
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 23, PPID: -1, CMD: "cron", Cgroup: cron})
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=0     PID=23     UNIT=cron.service | cron", logging.GetColorByKey("cron.service")))
+	p.printPS(psscanner.PSEvent{UID: 1000, PID: 24, PPID: -1, CMD: "sh", Cgroup: cron})
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=1000  PID=24     UNIT=cron.service | sh", logging.GetColorByKey("cron.service")))
+
+	// events without the key are colored by UID
+	p.printPS(psscanner.PSEvent{UID: 1000, PID: 25, PPID: -1, CMD: "id"})
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=1000  PID=25     | id", logging.GetColorByUID(1000)))
+}
+
+func TestSessionPrinter(t *testing.T) {
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatText, Sessions: true}, l)
+
+	ssh := psscanner.Session{TTY: "pts/0", SID: 4200, PGRP: 4250, LoginUID: 1000, SessionID: 3}
+	p.printPS(psscanner.PSEvent{UID: 1000, PID: 4250, PPID: -1, CMD: "vim /etc/hosts", Session: &ssh})
+	expectMessage(t, l.Event, "0 SESSION: sessionid 3 LOGINUID=1000 TTY=pts/0")
+	expectMessage(t, l.Event, "0 CMD: UID=1000  PID=4250   TTY=pts/0 SID=4200 PGRP=4250 | vim /etc/hosts")
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 4260, PPID: -1, CMD: "sudo id", Session: &psscanner.Session{TTY: "pts/0", SID: 4200, PGRP: 4260, LoginUID: 1000, SessionID: 3}})
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=4260   TTY=pts/0 SID=4200 PGRP=4260 | sudo id")
+
+	// another session interrupts, after which the first one gets a header again
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 5000, PPID: -1, CMD: "/bin/sh -c backup", Session: &psscanner.Session{SID: 5000, PGRP: 5000, LoginUID: 0, SessionID: 9}})
+	expectMessage(t, l.Event, "0 SESSION: sessionid 9 LOGINUID=0")
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=5000   SID=5000 PGRP=5000 | /bin/sh -c backup")
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 700, PPID: -1, CMD: "sshd", Session: &psscanner.Session{SID: 700, PGRP: 700, LoginUID: -1, SessionID: -1}})
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=700    SID=700 PGRP=700 | sshd")
+	p.printPS(psscanner.PSEvent{UID: 1000, PID: 4270, PPID: -1, CMD: "ls", Session: &ssh})
+	expectMessage(t, l.Event, "0 SESSION: sessionid 3 LOGINUID=1000 TTY=pts/0")
+	expectMessage(t, l.Event, "0 CMD: UID=1000  PID=4270   TTY=pts/0 SID=4200 PGRP=4250 | ls")
+
+	if ssh.SessionID != 3 {
+		t.Errorf("Session of event modified: %+v", ssh)
+	}
+}
+
+// TestTextPrinterRoundTrip runs printed commands in a shell, which must pass the same
+// arguments, and checks that printing left them unchanged
+func TestTextPrinterRoundTrip(t *testing.T) {
+	shell := ansiCShell(t)
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatText}, l)
+
+	for _, argv := range [][]string{
+		{"printf", `\x1b[2J`},
+		{"printf", "\x1b[2J"},
+		{"echo", "it's", "a b", `C:\share`, "a\nb\tc\rd"},
+		{"cat", "grüße\xff\xfe", "txt.\u202eexe", "c1\u009bcsi", "$HOME"},
+	} {
+		p.printPS(psscanner.PSEvent{UID: 0, PID: 24, PPID: -1, CMD: strings.Join(argv, " "), Argv: argv})
+		line := <-l.Event
+		cmd := strings.TrimPrefix(line, "0 CMD: UID=0     PID=24     | ")
+		if cmd != psscanner.ShellQuote(argv) {
+			t.Errorf("Command of %q changed when printed: %s", argv, line)
+		}
+		if escaped := logging.Escape(cmd); escaped != cmd {
+			t.Errorf("Command of %q not safe to print: %s", argv, cmd)
+		}
+		out, err := exec.Command(shell, "-c", "set -- "+cmd+`; for arg; do printf '%s\0' "$arg"; done`).Output()
+		if err != nil {
+			t.Fatalf("Running %s: %v", cmd, err)
+		}
+		if got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00"); !reflect.DeepEqual(got, argv) {
+			t.Errorf("Wrong arguments from %s: got %q but want %q", cmd, got, argv)
+		}
+	}
+}
+
+// ansiCShell finds a shell that understands ANSI-C quotes, $'...', which POSIX only added
+// recently, e.g., dash does not
+func ansiCShell(t *testing.T) string {
+	for _, shell := range []string{"sh", "bash", "zsh", "ksh"} {
+		if out, err := exec.Command(shell, "-c", `printf %s $'\x41'`).Output(); err == nil && string(out) == "A" {
+			return shell
+		}
+	}
+	t.Skip("no shell that understands $'...'")
+	return ""
+}
+
+func TestTreePrinter(t *testing.T) {
+	l := newMockLogger()
+	p := newPrinter(&config.Config{Format: config.FormatText, Tree: true}, l)
+
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 20, PPID: 1, CMD: "cron", Ancestors: []psscanner.Ancestor{{PID: 1, CMD: "init"}}})
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=20     PPID=1      | \\_ cron")
+	p.printPS(psscanner.PSEvent{UID: 0, PID: 21, PPID: 20, CMD: "sh", Ancestors: []psscanner.Ancestor{{PID: 20, CMD: "cron"}, {PID: 1, CMD: "init"}}})
+	expectMessage(t, l.Event, "0 CMD: UID=0     PID=21     PPID=20     |    \\_ sh")
+}
+
+func mockNow(t time.Time) func() {
+	oldNow := now
+	now = func() time.Time { return t }
+	return func() {
+		now = oldNow
+	}
+}
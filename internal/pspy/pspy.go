@@ -2,10 +2,15 @@ package pspy
 
 import (
 	"os"
+	"reflect"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/dominicbreuker/pspy/internal/config"
-	"github.com/dominicbreuker/pspy/internal/logging"
+	"github.com/dominicbreuker/pspy/internal/filter"
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
 	"github.com/dominicbreuker/pspy/internal/psscanner"
 )
 
@@ -13,32 +18,52 @@ type Bindings struct {
 	Logger Logger
 	FSW    FSWatcher
 	PSS    PSScanner
+	// Reload loads the configuration again on SIGHUP. If nil, SIGHUP exits.
+	Reload func() (*config.Config, error)
+	// Recorder saves all events before they are filtered, if not nil
+	Recorder Recorder
+	// Checker looks for findings in process events if enabled and not nil
+	Checker Checker
 }
 
 type Logger interface {
 	Infof(format string, v ...interface{})
 	Errorf(debug bool, format string, v ...interface{})
 	Eventf(color int, format string, v ...interface{})
+	EventAtf(t time.Time, color int, format string, v ...interface{})
+	Rawf(format string, v ...interface{})
 }
 
 type FSWatcher interface {
 	Init(rdirs, dirs []string) (chan error, chan struct{})
-	Run() (chan struct{}, chan string, chan error)
+	Run() (chan struct{}, chan fswatcher.FSEvent, chan error)
+	Update(rdirs, dirs []string) (chan error, chan struct{})
 	Enable()
 }
 
 type PSScanner interface {
 	Run(triggerCh chan struct{}) (chan psscanner.PSEvent, chan error)
+	SetCountMissed(on bool)
+}
+
+type Checker interface {
+	Check(pe psscanner.PSEvent) []findings.Finding
+}
+
+type Recorder interface {
+	RecordPS(pe psscanner.PSEvent) error
+	RecordFS(fe fswatcher.FSEvent) error
 }
 
 type chans struct {
 	sigCh     chan os.Signal
-	fsEventCh chan string
+	fsEventCh chan fswatcher.FSEvent
 	psEventCh chan psscanner.PSEvent
 }
 
 func Start(cfg *config.Config, b *Bindings, sigCh chan os.Signal) chan struct{} {
-	b.Logger.Infof("Config: %+v", cfg)
+	// align continuation lines with the first one
+	b.Logger.Infof("Config: %s", strings.ReplaceAll(cfg.String(), "\n", "\n        "))
 	abort := make(chan struct{}, 1)
 	abort <- struct{}{}
 
@@ -50,40 +75,70 @@ func Start(cfg *config.Config, b *Bindings, sigCh chan os.Signal) chan struct{}
 		return abort
 	}
 
-	psEventCh := startPSS(b.PSS, b.Logger, triggerCh)
-
-	triggerEvery(100*time.Millisecond, triggerCh)
+	s := newScheduler(cfg)
+	scanCh := make(chan struct{})
+	go s.run(triggerCh, scanCh)
+	// missed processes are only estimated while printed
+	b.PSS.SetCountMissed(cfg.LogMissed)
+	psEventCh := startPSS(b.PSS, b.Logger, scanCh)
 
 	chans := &chans{
 		sigCh:     sigCh,
 		fsEventCh: fsEventCh,
 		psEventCh: psEventCh,
 	}
-	exit := printOutput(cfg, b, chans)
+	exit := printOutput(cfg, b, chans, s)
 	return exit
 }
 
-func printOutput(cfg *config.Config, b *Bindings, chans *chans) chan struct{} {
+func printOutput(cfg *config.Config, b *Bindings, chans *chans, s *scheduler) chan struct{} {
 	exit := make(chan struct{})
-	// fsEventColor, psEventColor := getColors(cfg.Colored)
+	p := newPrinter(cfg, b.Logger)
+	f := newFilter(cfg, b.Logger)
+	rec := b.Recorder
+	record := func(err error) {
+		if err != nil {
+			b.Logger.Infof("Stopped recording events: %v", err)
+			rec = nil
+		}
+	}
 
 	go func() {
 		for {
 			select {
 			case se := <-chans.sigCh:
+				if se == syscall.SIGHUP && b.Reload != nil {
+					cfg = reload(cfg, b, s)
+					p = newPrinter(cfg, b.Logger)
+					f = newFilter(cfg, b.Logger)
+					continue
+				}
 				b.Logger.Infof("Exiting program... (%s)", se)
 				exit <- struct{}{}
 			case fe := <-chans.fsEventCh:
-				if cfg.LogFS {
-					b.Logger.Eventf(logging.ColorNone, "FS: %+v", fe)
+				if rec != nil {
+					record(rec.RecordFS(fe))
+				}
+				if cfg.LogFS && f.MatchFS(fe) {
+					p.printFS(fe)
 				}
 			case pe := <-chans.psEventCh:
-				if cfg.LogPS {
-					color := logging.ColorNone
-					if cfg.Colored {
-						color = logging.GetColorByUID(pe.UID)
+				if cfg.Redact {
+					// before anything is written, including the recording
+					pe = findings.RedactEvent(pe)
+				}
+				if rec != nil {
+					record(rec.RecordPS(pe))
+				}
+				if cfg.LogPS && wanted(cfg, pe.Kind) && f.MatchPS(pe) {
+					p.printPS(pe)
+				}
+				if cfg.Findings && b.Checker != nil {
+					for _, fd := range b.Checker.Check(pe) {
+						if f.MatchFinding(fd) {
+							p.printFinding(fd)
+						}
 					}
-					b.Logger.Eventf(color, "CMD: %+v", pe)
 				}
 			}
 		}
@@ -91,6 +146,63 @@ func printOutput(cfg *config.Config, b *Bindings, chans *chans) chan struct{} {
 	return exit
 }
 
+// wanted returns whether events of a kind are printed at all
+func wanted(cfg *config.Config, kind psscanner.EventKind) bool {
+	switch kind {
+	case psscanner.KindExit:
+		return cfg.LogExits
+	case psscanner.KindMissed:
+		return cfg.LogMissed
+	default:
+		return true
+	}
+}
+
+// newFilter compiles the filters of a configuration, which should have been validated before
+func newFilter(cfg *config.Config, logger Logger) *filter.Filter {
+	f, err := filter.New(cfg.Filter, cfg.Exclude)
+	if err != nil {
+		logger.Errorf(false, "Not filtering events: %v", err)
+		return nil
+	}
+	return f
+}
+
+// reload applies a new configuration to the running program. The process scanner
+// keeps running, so processes already reported are not reported again.
+func reload(cfg *config.Config, b *Bindings, s *scheduler) *config.Config {
+	newCfg, err := b.Reload()
+	if err != nil {
+		b.Logger.Infof("Can't reload configuration, keeping the current one: %v", err)
+		return cfg
+	}
+
+	changes := config.Changes(cfg, newCfg)
+	if len(changes) == 0 {
+		b.Logger.Infof("Reloaded configuration: no changes")
+		return newCfg
+	}
+	if !reflect.DeepEqual(cfg.RDirs, newCfg.RDirs) || !reflect.DeepEqual(cfg.Dirs, newCfg.Dirs) {
+		errCh, doneCh := b.FSW.Update(newCfg.RDirs, newCfg.Dirs)
+		go logUpdateErrors(errCh, doneCh, b.Logger)
+	}
+	s.update(newCfg)
+	b.PSS.SetCountMissed(newCfg.LogMissed)
+	b.Logger.Infof("Reloaded configuration: %s", strings.Join(changes, " | "))
+	return newCfg
+}
+
+func logUpdateErrors(errCh chan error, doneCh chan struct{}, logger Logger) {
+	for {
+		select {
+		case <-doneCh:
+			return
+		case err := <-errCh:
+			logger.Errorf(true, "updating fs watcher: %v", err)
+		}
+	}
+}
+
 func initFSW(fsw FSWatcher, rdirs, dirs []string, logger Logger, sigCh <-chan os.Signal) bool {
 	errCh, doneCh := fsw.Init(rdirs, dirs)
 	for {
@@ -105,7 +217,7 @@ func initFSW(fsw FSWatcher, rdirs, dirs []string, logger Logger, sigCh <-chan os
 	}
 }
 
-func startFSW(fsw FSWatcher, logger Logger, drainFor time.Duration, sigCh <-chan os.Signal) (triggerCh chan struct{}, fsEventCh chan string, ok bool) {
+func startFSW(fsw FSWatcher, logger Logger, drainFor time.Duration, sigCh <-chan os.Signal) (triggerCh chan struct{}, fsEventCh chan fswatcher.FSEvent, ok bool) {
 	triggerCh, fsEventCh, errCh := fsw.Run()
 	go logErrors(errCh, logger)
 
@@ -122,15 +234,6 @@ func startPSS(pss PSScanner, logger Logger, triggerCh chan struct{}) (psEventCh
 	return psEventCh
 }
 
-func triggerEvery(d time.Duration, triggerCh chan struct{}) {
-	go func() {
-		for {
-			<-time.After(d)
-			triggerCh <- struct{}{}
-		}
-	}()
-}
-
 func logErrors(errCh chan error, logger Logger) {
 	for {
 		err := <-errCh
@@ -138,7 +241,7 @@ func logErrors(errCh chan error, logger Logger) {
 	}
 }
 
-func drainEventsFor(triggerCh chan struct{}, eventCh chan string, d time.Duration, sigCh <-chan os.Signal, fsw FSWatcher) bool {
+func drainEventsFor(triggerCh chan struct{}, eventCh chan fswatcher.FSEvent, d time.Duration, sigCh <-chan os.Signal, fsw FSWatcher) bool {
 	for {
 		select {
 		case <-sigCh:
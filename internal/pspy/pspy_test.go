@@ -4,10 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"reflect"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/dominicbreuker/pspy/internal/config"
+	"github.com/dominicbreuker/pspy/internal/findings"
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
 	"github.com/dominicbreuker/pspy/internal/logging"
 	"github.com/dominicbreuker/pspy/internal/psscanner"
 )
@@ -71,7 +75,7 @@ func TestStartFSW(t *testing.T) {
 		fsw.runErrCh <- errors.New("error sent while draining")
 		<-time.After(drainFor) // ensure draining is over
 		fsw.runTriggerCh <- struct{}{}
-		fsw.runEventCh <- "event sent after draining"
+		fsw.runEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "event sent after draining"}
 		fsw.runErrCh <- errors.New("error sent after draining")
 	}()
 
@@ -84,7 +88,7 @@ func TestStartFSW(t *testing.T) {
 	expectMessage(t, l.Error, "ERROR: error sent while draining")
 	expectMessage(t, l.Info, "done")
 	expectTrigger(t, triggerCh)
-	expectMessage(t, fsEventCh, "event sent after draining")
+	expectFSEvent(t, fsEventCh, fswatcher.FSEvent{Op: "CREATE", Path: "event sent after draining"})
 }
 
 func TestStartFSWInterrupt(t *testing.T) {
@@ -152,29 +156,220 @@ func TestStart(t *testing.T) {
 	go func() {
 		close(fsw.initDoneCh)
 		<-time.After(2 * drainFor)
+		fsw.runTriggerCh <- struct{}{} // consumed by the mock scanner
 		fsw.runTriggerCh <- struct{}{}
 		pss.runEventCh <- psscanner.PSEvent{UID: 1000, PID: 12345, PPID: 54321, CMD: "pss event"}
 		pss.runErrCh <- errors.New("pss error")
-		fsw.runEventCh <- "fsw event"
+		fsw.runEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "fsw event"}
 		fsw.runErrCh <- errors.New("fsw error")
 		sigCh <- os.Interrupt
 	}()
 
 	exitCh := Start(cfg, b, sigCh)
-	expectMessage(t, l.Info, "Config: Printing events (colored=true): processes=true | file-system-events=true ||| Scanning for processes every 16m39s and on inotify events ||| Watching directories: [rdir1 rdir2] (recursive) | [dir1 dir2] (non-recursive)")
+	expectMessage(t, l.Info, `Config: Printing events (colored=true, format=, tree=false, sessions=false, redact=false): processes=true | exits=false | missed=false | findings=false | file-system-events=true
+        Scanning for processes every 16m39s and on inotify events
+        Watching directories: [rdir1 rdir2] (recursive) | [dir1 dir2] (non-recursive)`)
 	expectMessage(t, l.Info, "Draining file system events due to startup...")
 	<-time.After(2 * drainFor)
 	expectMessage(t, l.Info, "done")
 	expectTrigger(t, pss.runTriggerCh) // pss receives triggers from fsw
 	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=1000  PID=12345  PPID=54321  | pss event", logging.ColorPurple))
 	expectMessage(t, l.Error, "ERROR: pss error")
-	expectMessage(t, l.Event, fmt.Sprintf("%d FS: fsw event", logging.ColorNone))
+	expectMessage(t, l.Event, fmt.Sprintf("%d FS:               CREATE | fsw event", logging.ColorNone))
 	expectMessage(t, l.Error, "ERROR: fsw error")
 	expectMessage(t, l.Info, "Exiting program... (interrupt)")
 
 	expectExit(t, exitCh)
 }
 
+func TestStartReload(t *testing.T) {
+	drainFor := 10 * time.Millisecond
+	l := newMockLogger()
+	fsw := newMockFSWatcher()
+	pss := newMockPSScanner()
+
+	cfg := &config.Config{
+		RDirs:        []string{"rdir1"},
+		Dirs:         []string{},
+		LogFS:        true,
+		LogPS:        true,
+		DrainFor:     drainFor,
+		TriggerEvery: 999 * time.Second,
+	}
+	reloads := []error{errors.New("broken file"), nil, nil}
+	b := &Bindings{
+		Logger: l,
+		FSW:    fsw,
+		PSS:    pss,
+		Reload: func() (*config.Config, error) {
+			err := reloads[0]
+			reloads = reloads[1:]
+			newCfg := *cfg
+			newCfg.RDirs = []string{"rdir1", "rdir2"}
+			newCfg.LogFS = false
+			newCfg.LogMissed = true
+			return &newCfg, err
+		},
+	}
+	sigCh := make(chan os.Signal)
+
+	go func() {
+		close(fsw.initDoneCh)
+	}()
+
+	exitCh := Start(cfg, b, sigCh)
+	expectMessage(t, l.Info, `Config: Printing events (colored=false, format=, tree=false, sessions=false, redact=false): processes=true | exits=false | missed=false | findings=false | file-system-events=true
+        Scanning for processes every 16m39s and on inotify events
+        Watching directories: [rdir1] (recursive) | [] (non-recursive)`)
+	expectMessage(t, l.Info, "Draining file system events due to startup...")
+	expectMessage(t, l.Info, "done")
+	if pss.countMissed {
+		t.Errorf("Missed processes counted though not printed")
+	}
+
+	sigCh <- syscall.SIGHUP
+	expectMessage(t, l.Info, "Can't reload configuration, keeping the current one: broken file")
+	sigCh <- syscall.SIGHUP
+	expectMessage(t, l.Info, "Reloaded configuration: recursive dirs [rdir1] -> [rdir1 rdir2] | file-system-events true -> false | missed false -> true")
+	if !reflect.DeepEqual(fsw.rdirs, []string{"rdir1", "rdir2"}) {
+		t.Errorf("Watched dirs not updated: %v", fsw.rdirs)
+	}
+	if !pss.countMissed {
+		t.Errorf("Missed processes not counted after reload")
+	}
+	sigCh <- syscall.SIGHUP
+	expectMessage(t, l.Info, "Reloaded configuration: no changes")
+
+	fsw.runEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "fsw event"}
+	pss.runEventCh <- psscanner.PSEvent{UID: 1000, PID: 12345, PPID: -1, CMD: "pss event"}
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=1000  PID=12345  | pss event", logging.ColorNone))
+
+	sigCh <- syscall.SIGTERM
+	expectMessage(t, l.Info, "Exiting program... (terminated)")
+	expectExit(t, exitCh)
+}
+
+func TestPrintOutputFilter(t *testing.T) {
+	l := newMockLogger()
+	cfg := &config.Config{LogFS: true, LogPS: true, Filter: "uid==0 || path==/etc/*", Exclude: `cmd=~"^cron"`}
+	chans := &chans{
+		sigCh:     make(chan os.Signal),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		psEventCh: make(chan psscanner.PSEvent),
+	}
+	printOutput(cfg, &Bindings{Logger: l}, chans, newScheduler(cfg))
+
+	chans.psEventCh <- psscanner.PSEvent{UID: 1000, PID: 1, PPID: -1, CMD: "user"}
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 2, PPID: -1, CMD: "cron -f"}
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 3, PPID: -1, CMD: "root"}
+	chans.fsEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/x"}
+	chans.fsEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "/etc/x"}
+
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=0     PID=3      | root", logging.ColorNone))
+	expectMessage(t, l.Event, fmt.Sprintf("%d FS:               CREATE | /etc/x", logging.ColorNone))
+	select {
+	case m := <-l.Event:
+		t.Errorf("Unexpected event: %s", m)
+	default:
+	}
+}
+
+func TestPrintOutputKinds(t *testing.T) {
+	l := newMockLogger()
+	cfg := &config.Config{LogPS: true, LogMissed: true}
+	chans := &chans{
+		sigCh:     make(chan os.Signal),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		psEventCh: make(chan psscanner.PSEvent),
+	}
+	printOutput(cfg, &Bindings{Logger: l}, chans, newScheduler(cfg))
+
+	chans.psEventCh <- psscanner.PSEvent{Kind: psscanner.KindExit, UID: 0, PID: 1, PPID: -1, CMD: "exited"}
+	chans.psEventCh <- psscanner.PSEvent{Kind: psscanner.KindMissed, UID: -1, PPID: -1, Missed: &psscanner.Missed{From: 2, To: 2, Count: 1, Allocated: 1}}
+
+	expectMessage(t, l.Event, fmt.Sprintf("%d MISSED: 1 process missed with PID 2 (caught 0.0%% of 1 so far)", logging.ColorNone))
+	select {
+	case m := <-l.Event:
+		t.Errorf("Unexpected event: %s", m)
+	default:
+	}
+}
+
+type mockChecker struct{}
+
+func (c mockChecker) Check(pe psscanner.PSEvent) []findings.Finding {
+	if pe.UID != 0 {
+		return nil
+	}
+	return []findings.Finding{
+		{PID: pe.PID, UID: pe.UID, CMD: pe.CMD, Path: "/opt/job.sh", Reason: "is writable"},
+		{Kind: findings.KindRisk, PID: pe.PID, UID: pe.UID, CMD: pe.CMD, Reason: "unquoted wildcard * in arguments of tar allows option injection"},
+	}
+}
+
+func TestPrintOutputFindings(t *testing.T) {
+	l := newMockLogger()
+	cfg := &config.Config{LogPS: true, Findings: true, Filter: "uid==1000 || kind==RISK"}
+	chans := &chans{
+		sigCh:     make(chan os.Signal),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		psEventCh: make(chan psscanner.PSEvent),
+	}
+	printOutput(cfg, &Bindings{Logger: l, Checker: mockChecker{}}, chans, newScheduler(cfg))
+
+	// findings are filtered by their own kind, independent of their process
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 1, PPID: -1, CMD: "bash /opt/job.sh"}
+	chans.psEventCh <- psscanner.PSEvent{UID: 1000, PID: 2, PPID: -1, CMD: "id"}
+
+	expectMessage(t, l.Event, fmt.Sprintf("%d RISK: UID=0     PID=1      | unquoted wildcard * in arguments of tar allows option injection (running bash /opt/job.sh)", logging.ColorNone))
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=1000  PID=2      | id", logging.ColorNone))
+}
+
+func TestPrintOutputRedact(t *testing.T) {
+	l := newMockLogger()
+	cfg := &config.Config{LogPS: true, Findings: true, Redact: true}
+	chans := &chans{
+		sigCh:     make(chan os.Signal),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		psEventCh: make(chan psscanner.PSEvent),
+	}
+	rec := &mockRecorder{failAfter: 10}
+	printOutput(cfg, &Bindings{Logger: l, Checker: mockChecker{}, Recorder: rec}, chans, newScheduler(cfg))
+
+	// secrets are masked in events, findings and recordings
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 1, PPID: -1, CMD: "mysql -phunter2", Argv: []string{"mysql", "-phunter2"}}
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=0     PID=1      | mysql '-p***'", logging.ColorNone))
+	expectMessage(t, l.Event, fmt.Sprintf("%d FINDING: UID=0     PID=1      | /opt/job.sh is writable (running mysql -p***)", logging.ColorNone))
+	if expected := []string{"mysql -p***"}; !reflect.DeepEqual(rec.cmds, expected) {
+		t.Errorf("Wrong commands recorded: got %v but wanted %v", rec.cmds, expected)
+	}
+}
+
+func TestPrintOutputRecord(t *testing.T) {
+	l := newMockLogger()
+	cfg := &config.Config{LogPS: true, Filter: "uid==0"}
+	chans := &chans{
+		sigCh:     make(chan os.Signal),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		psEventCh: make(chan psscanner.PSEvent),
+	}
+	rec := &mockRecorder{failAfter: 3}
+	printOutput(cfg, &Bindings{Logger: l, Recorder: rec}, chans, newScheduler(cfg))
+
+	// everything is recorded, even if not printed
+	chans.psEventCh <- psscanner.PSEvent{UID: 1000, PID: 1, PPID: -1, CMD: "user"}
+	chans.fsEventCh <- fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/x"}
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 2, PPID: -1, CMD: "root"}
+	expectMessage(t, l.Info, "Stopped recording events: disk full")
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=0     PID=2      | root", logging.ColorNone))
+	chans.psEventCh <- psscanner.PSEvent{UID: 0, PID: 3, PPID: -1, CMD: "root"}
+	expectMessage(t, l.Event, fmt.Sprintf("%d CMD: UID=0     PID=3      | root", logging.ColorNone))
+
+	if expected := []string{"CMD 1", "FS /tmp/x", "CMD 2"}; !reflect.DeepEqual(rec.events, expected) {
+		t.Errorf("Wrong events recorded: got %v but wanted %v", rec.events, expected)
+	}
+}
+
 // #### Helpers ####
 
 var timeout = 100 * time.Millisecond
@@ -191,6 +386,17 @@ func expectMessage(t *testing.T, ch chan string, expected string) {
 	}
 }
 
+func expectFSEvent(t *testing.T, ch chan fswatcher.FSEvent, expected fswatcher.FSEvent) {
+	select {
+	case actual := <-ch:
+		if actual != expected {
+			t.Fatalf("Wrong event: got %+v but wanted %+v", actual, expected)
+		}
+	case <-time.After(timeout):
+		t.Fatalf("Did not get event in time: %+v", expected)
+	}
+}
+
 func expectTrigger(t *testing.T, ch chan struct{}) {
 	if err := expectChanMsg(ch); err != nil {
 		t.Fatalf("triggering: %v", err)
@@ -227,10 +433,34 @@ func expectClosed(t *testing.T, ch chan struct{}) {
 
 // Logger
 
+type mockRecorder struct {
+	events    []string
+	cmds      []string
+	failAfter int
+}
+
+func (r *mockRecorder) RecordPS(pe psscanner.PSEvent) error {
+	r.cmds = append(r.cmds, pe.CMD)
+	return r.record(fmt.Sprintf("%s %d", pe.Kind, pe.PID))
+}
+
+func (r *mockRecorder) RecordFS(fe fswatcher.FSEvent) error {
+	return r.record(fmt.Sprintf("FS %s", fe.Path))
+}
+
+func (r *mockRecorder) record(e string) error {
+	r.events = append(r.events, e)
+	if len(r.events) >= r.failAfter {
+		return errors.New("disk full")
+	}
+	return nil
+}
+
 type mockLogger struct {
 	Info  chan string
 	Error chan string
 	Event chan string
+	Raw   chan string
 	Debug bool
 }
 
@@ -239,6 +469,7 @@ func newMockLogger() *mockLogger {
 		Info:  make(chan string, 10),
 		Error: make(chan string, 10),
 		Event: make(chan string, 10),
+		Raw:   make(chan string, 10),
 		Debug: true,
 	}
 }
@@ -258,6 +489,15 @@ func (l *mockLogger) Eventf(color int, format string, v ...interface{}) {
 	l.Event <- fmt.Sprintf("%d %s", color, m)
 }
 
+func (l *mockLogger) EventAtf(t time.Time, color int, format string, v ...interface{}) {
+	m := fmt.Sprintf(format, v...)
+	l.Event <- fmt.Sprintf("%s %d %s", t.UTC().Format(time.RFC3339), color, m)
+}
+
+func (l *mockLogger) Rawf(format string, v ...interface{}) {
+	l.Raw <- fmt.Sprintf(format, v...)
+}
+
 // FSWatcher
 
 type mockFSWatcher struct {
@@ -266,7 +506,7 @@ type mockFSWatcher struct {
 	initErrCh    chan error
 	initDoneCh   chan struct{}
 	runTriggerCh chan struct{}
-	runEventCh   chan string
+	runEventCh   chan fswatcher.FSEvent
 	runErrCh     chan error
 }
 
@@ -277,7 +517,7 @@ func newMockFSWatcher() *mockFSWatcher {
 		initErrCh:    make(chan error),
 		initDoneCh:   make(chan struct{}),
 		runTriggerCh: make(chan struct{}),
-		runEventCh:   make(chan string),
+		runEventCh:   make(chan fswatcher.FSEvent),
 		runErrCh:     make(chan error),
 	}
 }
@@ -288,10 +528,18 @@ func (fsw *mockFSWatcher) Init(rdirs, dirs []string) (chan error, chan struct{})
 	return fsw.initErrCh, fsw.initDoneCh
 }
 
-func (fsw *mockFSWatcher) Run() (chan struct{}, chan string, chan error) {
+func (fsw *mockFSWatcher) Run() (chan struct{}, chan fswatcher.FSEvent, chan error) {
 	return fsw.runTriggerCh, fsw.runEventCh, fsw.runErrCh
 }
 
+func (fsw *mockFSWatcher) Update(rdirs, dirs []string) (chan error, chan struct{}) {
+	fsw.rdirs = rdirs
+	fsw.dirs = dirs
+	errCh, doneCh := make(chan error), make(chan struct{})
+	close(doneCh)
+	return errCh, doneCh
+}
+
 func (fsw *mockFSWatcher) Enable() {
 	return
 }
@@ -303,6 +551,7 @@ type mockPSScanner struct {
 	runEventCh   chan psscanner.PSEvent
 	runErrCh     chan error
 	numRefreshes int
+	countMissed  bool
 }
 
 func newMockPSScanner() *mockPSScanner {
@@ -321,3 +570,7 @@ func (pss *mockPSScanner) Run(triggerCh chan struct{}) (chan psscanner.PSEvent,
 
 	return pss.runEventCh, pss.runErrCh
 }
+
+func (pss *mockPSScanner) SetCountMissed(on bool) {
+	pss.countMissed = on
+}
@@ -0,0 +1,124 @@
+package pspy
+
+import (
+	"syscall"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/config"
+)
+
+// hook for testing
+var cpuTime = func() time.Duration {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0
+	}
+	return time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+}
+
+// scheduler triggers process scans on a timer and whenever the file system watcher
+// sees activity. The timer interval adapts between floor and ceiling: it tightens
+// while inotify is busy and backs off while the system is idle or pspy exceeds its CPU budget.
+type scheduler struct {
+	interval time.Duration
+	floor    time.Duration
+	ceiling  time.Duration
+	budget   float64 // maximum share of one CPU, 0 for no limit
+
+	updateCh chan *config.Config
+
+	active     bool // file system activity since the last tick
+	overBudget bool
+	lastTick   time.Time
+	lastCPU    time.Duration
+}
+
+func newScheduler(cfg *config.Config) *scheduler {
+	s := &scheduler{updateCh: make(chan *config.Config, 1)}
+	s.configure(cfg)
+	return s
+}
+
+func (s *scheduler) configure(cfg *config.Config) {
+	s.interval = cfg.TriggerEvery
+	s.floor = cfg.TriggerMin
+	s.ceiling = cfg.TriggerMax
+	s.budget = cfg.CPUBudget / 100
+	if s.floor <= 0 || s.floor > s.interval {
+		s.floor = s.interval
+	}
+	if s.ceiling < s.interval {
+		s.ceiling = s.interval
+	}
+	s.overBudget = false
+}
+
+// update makes a running scheduler use a new configuration. It never blocks
+// as long as there is a single caller, replacing an update not yet applied.
+func (s *scheduler) update(cfg *config.Config) {
+	select {
+	case <-s.updateCh:
+	default:
+	}
+	s.updateCh <- cfg
+}
+
+// run forwards file system triggers to scanCh and adds its own on every tick.
+// While over budget, file system triggers are dropped and only the timer scans.
+func (s *scheduler) run(fsTriggerCh <-chan struct{}, scanCh chan<- struct{}) {
+	s.lastTick, s.lastCPU = now(), cpuTime()
+	timer := time.NewTimer(s.interval)
+	for {
+		select {
+		case <-fsTriggerCh:
+			s.active = true
+			if !s.overBudget {
+				scanCh <- struct{}{}
+			}
+		case <-timer.C:
+			scanCh <- struct{}{}
+			s.tick(now(), cpuTime())
+			timer.Reset(s.interval)
+		case cfg := <-s.updateCh:
+			s.configure(cfg)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.interval)
+		}
+	}
+}
+
+// tick measures CPU usage since the last tick and picks the next interval
+func (s *scheduler) tick(t time.Time, cpu time.Duration) {
+	if wall := t.Sub(s.lastTick); s.budget > 0 && wall > 0 {
+		s.overBudget = float64(cpu-s.lastCPU)/float64(wall) > s.budget
+	}
+	s.lastTick, s.lastCPU = t, cpu
+
+	s.interval = s.next()
+	s.active = false
+}
+
+func (s *scheduler) next() time.Duration {
+	var d time.Duration
+	switch {
+	case s.overBudget:
+		d = 2 * s.interval
+	case s.active:
+		d = s.interval / 2
+	default:
+		d = s.interval + s.interval/4
+	}
+
+	if d < s.floor {
+		return s.floor
+	}
+	if d > s.ceiling {
+		return s.ceiling
+	}
+	return d
+}
@@ -0,0 +1,87 @@
+package pspy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/config"
+)
+
+func TestNewScheduler(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     config.Config
+		floor   time.Duration
+		ceiling time.Duration
+	}{
+		{name: "fixed", cfg: config.Config{TriggerEvery: 100 * time.Millisecond}, floor: 100 * time.Millisecond, ceiling: 100 * time.Millisecond},
+		{name: "adaptive", cfg: config.Config{TriggerEvery: 100 * time.Millisecond, TriggerMin: 10 * time.Millisecond, TriggerMax: time.Second}, floor: 10 * time.Millisecond, ceiling: time.Second},
+		{name: "bounds-around-interval", cfg: config.Config{TriggerEvery: 100 * time.Millisecond, TriggerMin: time.Second, TriggerMax: 10 * time.Millisecond}, floor: 100 * time.Millisecond, ceiling: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newScheduler(&tt.cfg)
+			if s.interval != tt.cfg.TriggerEvery || s.floor != tt.floor || s.ceiling != tt.ceiling {
+				t.Errorf("Wrong schedule: got %v in [%v, %v] but wanted %v in [%v, %v]", s.interval, s.floor, s.ceiling, tt.cfg.TriggerEvery, tt.floor, tt.ceiling)
+			}
+		})
+	}
+}
+
+func TestSchedulerTick(t *testing.T) {
+	start := time.Date(2018, 2, 18, 21, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name       string
+		interval   time.Duration
+		active     bool
+		budget     float64
+		cpu        time.Duration
+		expected   time.Duration
+		overBudget bool
+	}{
+		{name: "busy", interval: 100 * time.Millisecond, active: true, expected: 50 * time.Millisecond},
+		{name: "busy-at-floor", interval: 30 * time.Millisecond, active: true, expected: 20 * time.Millisecond},
+		{name: "idle", interval: 100 * time.Millisecond, expected: 125 * time.Millisecond},
+		{name: "idle-at-ceiling", interval: 900 * time.Millisecond, expected: time.Second},
+		{name: "within-budget", interval: 100 * time.Millisecond, active: true, budget: 0.05, cpu: 10 * time.Millisecond, expected: 50 * time.Millisecond},
+		{name: "over-budget", interval: 100 * time.Millisecond, active: true, budget: 0.05, cpu: 100 * time.Millisecond, expected: 200 * time.Millisecond, overBudget: true},
+		{name: "no-budget", interval: 100 * time.Millisecond, active: true, cpu: time.Second, expected: 50 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &scheduler{
+				interval: tt.interval,
+				floor:    20 * time.Millisecond,
+				ceiling:  time.Second,
+				budget:   tt.budget,
+				active:   tt.active,
+				lastTick: start,
+				lastCPU:  time.Second,
+			}
+			s.tick(start.Add(time.Second), time.Second+tt.cpu)
+
+			if s.interval != tt.expected {
+				t.Errorf("Wrong interval: got %v but wanted %v", s.interval, tt.expected)
+			}
+			if s.overBudget != tt.overBudget {
+				t.Errorf("Wrong budget state: got %t but wanted %t", s.overBudget, tt.overBudget)
+			}
+			if s.active {
+				t.Errorf("Activity not reset after tick")
+			}
+		})
+	}
+}
+
+func TestSchedulerRun(t *testing.T) {
+	fsTriggerCh, scanCh := make(chan struct{}), make(chan struct{})
+	s := newScheduler(&config.Config{TriggerEvery: 10 * time.Millisecond, TriggerMax: 20 * time.Millisecond})
+	go s.run(fsTriggerCh, scanCh)
+
+	expectTrigger(t, scanCh) // timer
+
+	fsTriggerCh <- struct{}{}
+	expectTrigger(t, scanCh) // forwarded from the file system watcher
+}
@@ -0,0 +1,127 @@
+package psscanner
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// container scopes and directories are named after the 64 hex digit ID, e.g.,
+	// docker-<id>.scope, cri-containerd-<id>.scope, crio-<id>.scope, libpod-<id>.scope or <id>
+	containerRegex = regexp.MustCompile(`^(?:[a-z-]+-)?([0-9a-f]{64})(?:\.scope)?$`)
+	// kubelet names pod cgroups after the pod UID, with underscores for the systemd driver
+	podRegex = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+)
+
+// Cgroup is the control group of a process and what it tells about its origin
+type Cgroup struct {
+	Path      string `json:"path"`
+	Container string `json:"container,omitempty"` // ID of a Docker, containerd, CRI-O or Podman container
+	Pod       string `json:"pod,omitempty"`       // UID of a Kubernetes pod
+	Unit      string `json:"unit,omitempty"`      // systemd service or scope, e.g., cron.service
+	Slice     string `json:"slice,omitempty"`     // systemd slice, e.g., user-1000.slice
+}
+
+func (c Cgroup) String() string {
+	switch {
+	case c.Container != "" && c.Pod != "":
+		return fmt.Sprintf("POD=%s CONTAINER=%s", c.Pod, shortID(c.Container))
+	case c.Container != "":
+		return "CONTAINER=" + shortID(c.Container)
+	case c.Unit != "":
+		return "UNIT=" + c.Unit
+	case c.Slice != "":
+		return "SLICE=" + c.Slice
+	default:
+		return "CGROUP=" + c.Path
+	}
+}
+
+// shortID abbreviates container IDs like docker ps does
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// Namespaces are the inode numbers of the PID, mount and user namespaces of a process.
+// Processes in a container share namespaces that differ from those of the host.
+type Namespaces struct {
+	PID   uint64 `json:"pid"`
+	Mount uint64 `json:"mnt"`
+	User  uint64 `json:"user"`
+}
+
+func (ns Namespaces) String() string {
+	return fmt.Sprintf("%d/%d/%d", ns.PID, ns.Mount, ns.User)
+}
+
+// getCgroup reads /proc/<pid>/cgroup. With cgroup v2, there is a single line "0::<path>".
+// With v1, the hierarchy of systemd is used, or else the first one with a path.
+func (p *procfs) getCgroup(pid int) (*Cgroup, error) {
+	content, err := p.readFile(fmt.Sprintf("%d/cgroup", pid), 4096)
+	if err != nil {
+		return nil, err
+	}
+	return parseCgroup(string(content))
+}
+
+func parseCgroup(content string) (*Cgroup, error) {
+	path := ""
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if (fields[0] == "0" && fields[1] == "") || fields[1] == "name=systemd" {
+			path = fields[2]
+			break
+		}
+		if path == "" && fields[2] != "/" {
+			path = fields[2]
+		}
+	}
+	if path == "" {
+		return nil, errors.New("no cgroup found")
+	}
+
+	c := &Cgroup{Path: path}
+	for _, part := range strings.Split(path, "/") {
+		if m := containerRegex.FindStringSubmatch(part); m != nil {
+			c.Container = m[1]
+		}
+		if m := podRegex.FindStringSubmatch(part); m != nil {
+			c.Pod = strings.ReplaceAll(m[1], "_", "-")
+		}
+		switch {
+		case strings.HasSuffix(part, ".service") || strings.HasSuffix(part, ".scope"):
+			c.Unit = part
+		case strings.HasSuffix(part, ".slice"):
+			c.Slice = part
+		}
+	}
+	return c, nil
+}
+
+// getNamespaces reads the namespace links /proc/<pid>/ns/{pid,mnt,user}, e.g., "pid:[4026531836]"
+func (p *procfs) getNamespaces(pid int) (*Namespaces, error) {
+	ns := &Namespaces{}
+	for _, n := range []struct {
+		name  string
+		inode *uint64
+	}{{"pid", &ns.PID}, {"mnt", &ns.Mount}, {"user", &ns.User}} {
+		link, err := p.fs.Readlink(fmt.Sprintf("%d/ns/%s", pid, n.name))
+		if err != nil {
+			return nil, err
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, n.name+":["), "]")
+		if *n.inode, err = strconv.ParseUint(inode, 10, 64); err != nil {
+			return nil, fmt.Errorf("corrupt namespace link '%s'", link)
+		}
+	}
+	return ns, nil
+}
@@ -0,0 +1,94 @@
+package psscanner
+
+import (
+	"reflect"
+	"testing"
+)
+
+const containerID = "3f4e1a9c2b7d8e6f5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b5c4d3e2f"
+
+func TestParseCgroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected Cgroup
+		str      string
+	}{
+		{
+			name:     "docker-systemd",
+			content:  "0::/system.slice/docker-" + containerID + ".scope\n",
+			expected: Cgroup{Path: "/system.slice/docker-" + containerID + ".scope", Container: containerID, Unit: "docker-" + containerID + ".scope", Slice: "system.slice"},
+			str:      "CONTAINER=3f4e1a9c2b7d",
+		},
+		{
+			name:     "docker-cgroupfs-v1",
+			content:  "12:pids:/docker/" + containerID + "\n11:cpu,cpuacct:/docker/" + containerID + "\n",
+			expected: Cgroup{Path: "/docker/" + containerID, Container: containerID},
+			str:      "CONTAINER=3f4e1a9c2b7d",
+		},
+		{
+			name:     "kubernetes",
+			content:  "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0c8e3f4a_1b2c_4d5e_8f9a_0b1c2d3e4f5a.slice/cri-containerd-" + containerID + ".scope\n",
+			expected: Cgroup{Path: "/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0c8e3f4a_1b2c_4d5e_8f9a_0b1c2d3e4f5a.slice/cri-containerd-" + containerID + ".scope", Container: containerID, Pod: "0c8e3f4a-1b2c-4d5e-8f9a-0b1c2d3e4f5a", Unit: "cri-containerd-" + containerID + ".scope", Slice: "kubepods-burstable-pod0c8e3f4a_1b2c_4d5e_8f9a_0b1c2d3e4f5a.slice"},
+			str:      "POD=0c8e3f4a-1b2c-4d5e-8f9a-0b1c2d3e4f5a CONTAINER=3f4e1a9c2b7d",
+		},
+		{
+			name:     "systemd-service-v1",
+			content:  "5:memory:/\n1:name=systemd:/system.slice/cron.service\n",
+			expected: Cgroup{Path: "/system.slice/cron.service", Unit: "cron.service", Slice: "system.slice"},
+			str:      "UNIT=cron.service",
+		},
+		{
+			name:     "ssh-session",
+			content:  "0::/user.slice/user-1000.slice/session-3.scope\n",
+			expected: Cgroup{Path: "/user.slice/user-1000.slice/session-3.scope", Unit: "session-3.scope", Slice: "user-1000.slice"},
+			str:      "UNIT=session-3.scope",
+		},
+		{
+			name:     "root",
+			content:  "0::/\n",
+			expected: Cgroup{Path: "/"},
+			str:      "CGROUP=/",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCgroup(tt.content)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(*c, tt.expected) {
+				t.Errorf("Wrong cgroup: got %+v but want %+v", *c, tt.expected)
+			}
+			if c.String() != tt.str {
+				t.Errorf("Wrong string: got '%s' but want '%s'", c, tt.str)
+			}
+		})
+	}
+
+	if _, err := parseCgroup(""); err == nil || err.Error() != "no cgroup found" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestGetNamespaces(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockLink("42/ns/pid", "pid:[4026532400]")
+	fs.mockLink("42/ns/mnt", "mnt:[4026532398]")
+	fs.mockLink("42/ns/user", "user:[4026531837]")
+	ns, err := newProcfs(fs).getNamespaces(42)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (Namespaces{PID: 4026532400, Mount: 4026532398, User: 4026531837}); *ns != expected {
+		t.Errorf("Wrong namespaces: got %+v but want %+v", *ns, expected)
+	}
+	if ns.String() != "4026532400/4026532398/4026531837" {
+		t.Errorf("Wrong string: %s", ns)
+	}
+
+	fs.mockLink("43/ns/pid", "pid:[x]")
+	if _, err := newProcfs(fs).getNamespaces(43); err == nil || err.Error() != "corrupt namespace link 'pid:[x]'" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
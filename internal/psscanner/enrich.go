@@ -0,0 +1,248 @@
+package psscanner
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxEnvironLength limits how much of the environment of a process is read
+const maxEnvironLength = 64 * 1024
+
+// Enrichment selects optional process details read from /proc for each new process
+type Enrichment struct {
+	Exe       bool
+	Cwd       bool
+	Comm      bool
+	StartTime bool
+	IDs       bool
+	Cgroup    bool
+	NS        bool
+	Session   bool
+	Pipes     bool
+	Env       bool
+	// glob patterns of the names of environment variables to keep, all if empty,
+	// and of those to drop even if allowed
+	EnvAllow []string
+	EnvDeny  []string
+}
+
+// EnrichmentOptions lists the names accepted by ParseEnrichment
+var EnrichmentOptions = []string{"exe", "cwd", "comm", "start", "ids", "cgroup", "ns", "session", "pipes", "env"}
+
+// ParseEnrichment builds an Enrichment from option names such as "exe" or "ids"
+func ParseEnrichment(names []string) (Enrichment, error) {
+	e := Enrichment{}
+	for _, name := range names {
+		switch strings.TrimSpace(name) {
+		case "exe":
+			e.Exe = true
+		case "cwd":
+			e.Cwd = true
+		case "comm":
+			e.Comm = true
+		case "start":
+			e.StartTime = true
+		case "ids":
+			e.IDs = true
+		case "cgroup":
+			e.Cgroup = true
+		case "ns":
+			e.NS = true
+		case "session":
+			e.Session = true
+		case "pipes":
+			e.Pipes = true
+		case "env":
+			e.Env = true
+		default:
+			return e, fmt.Errorf("unknown process detail '%s': must be one of %s", name, strings.Join(EnrichmentOptions, ", "))
+		}
+	}
+	return e, nil
+}
+
+// IDs are the real, effective, saved set and file system user or group IDs of a process
+type IDs struct {
+	Real      int `json:"real"`
+	Effective int `json:"effective"`
+	Saved     int `json:"saved"`
+	FS        int `json:"fs"`
+}
+
+func (ids IDs) String() string {
+	return fmt.Sprintf("%d/%d/%d/%d", ids.Real, ids.Effective, ids.Saved, ids.FS)
+}
+
+// ValidateEnvPatterns returns an error if a pattern for the names of environment variables is malformed
+func ValidateEnvPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern '%s' for environment variables: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// keepEnv returns whether an environment variable passes the allow and deny lists
+func (e Enrichment) keepEnv(name string) bool {
+	return (len(e.EnvAllow) == 0 || matchAny(e.EnvAllow, name)) && !matchAny(e.EnvDeny, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// enrich adds the selected details to an event. Every detail is optional,
+// a failure to read it is reported but does not prevent the event.
+func (p *PSScanner) enrich(pe *PSEvent) {
+	e := p.enrichment
+	pid := pe.PID
+
+	if e.Exe {
+		exe, err := p.getExe(pid)
+		pe.Exe = exe
+		p.reportReadable(pid, "exe", err)
+	}
+	if e.Cwd {
+		cwd, err := p.fs.Readlink(fmt.Sprintf("%d/cwd", pid))
+		pe.Cwd = cwd
+		p.reportReadable(pid, "cwd", err)
+	}
+	if e.Comm {
+		comm, err := p.readFile(fmt.Sprintf("%d/comm", pid), 64)
+		pe.Comm = strings.TrimSuffix(string(comm), "\n")
+		p.reportError(pid, "comm", err)
+	}
+	if e.StartTime {
+		pe.StartTime, _ = p.readStartTime(pid)
+	}
+	if e.IDs {
+		uids, gids, err := p.getIDs(pid)
+		pe.UIDs, pe.GIDs = uids, gids
+		p.reportError(pid, "ids", err)
+	}
+	if e.Cgroup {
+		cgroup, err := p.getCgroup(pid)
+		pe.Cgroup = cgroup
+		p.reportError(pid, "cgroup", err)
+	}
+	if e.NS {
+		ns, err := p.getNamespaces(pid)
+		pe.NS = ns
+		p.reportReadable(pid, "namespaces", err)
+	}
+	if e.Session {
+		session, err := p.getSession(pid)
+		pe.Session = session
+		p.reportError(pid, "session", err)
+	}
+	if e.Pipes {
+		pipes, err := p.getPipes(pid)
+		pe.Pipes = pipes
+		p.reportReadable(pid, "pipes", err)
+	}
+	if e.Env {
+		env, err := p.getEnv(pid, e.keepEnv)
+		pe.Env = env
+		p.reportReadable(pid, "environ", err)
+	}
+}
+
+func (p *PSScanner) readStartTime(pid int) (time.Time, error) {
+	ticks, err := p.getStartTime(pid)
+	if err != nil {
+		p.reportError(pid, "start time", err)
+		return time.Time{}, err
+	}
+	t, err := p.startTimeToTime(ticks)
+	p.reportError(pid, "start time", err)
+	return t, err
+}
+
+// reportReadable reports errors other than permission errors, as the executable, cwd,
+// namespaces, pipes and environment are only readable for processes of the same user,
+// unless running as root.
+func (p *PSScanner) reportReadable(pid int, detail string, err error) {
+	if !os.IsPermission(err) {
+		p.reportError(pid, detail, err)
+	}
+}
+
+func (p *PSScanner) reportError(pid int, detail string, err error) {
+	if err != nil && p.errCh != nil {
+		p.errCh <- fmt.Errorf("reading %s of pid %d: %v", detail, pid, err)
+	}
+}
+
+// getEnv reads the environment variables of a process that keep accepts, nil if there are none.
+// The environment is the one the process started with, later changes are not visible.
+func (p *procfs) getEnv(pid int, keep func(name string) bool) (map[string]string, error) {
+	environ, err := p.readFile(fmt.Sprintf("%d/environ", pid), maxEnvironLength)
+	if err != nil {
+		return nil, err
+	}
+	var env map[string]string
+	for _, entry := range bytes.Split(environ, []byte{0}) {
+		name, value, ok := strings.Cut(string(entry), "=")
+		if !ok || name == "" || !keep(name) {
+			continue
+		}
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[name] = value
+	}
+	return env, nil
+}
+
+// getIDs reads user and group IDs from the Uid and Gid lines of /proc/<pid>/status
+func (p *procfs) getIDs(pid int) (*IDs, *IDs, error) {
+	status, err := p.readFile(fmt.Sprintf("%d/status", pid), 4096)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var uids, gids *IDs
+	for _, line := range strings.Split(string(status), "\n") {
+		if strings.HasPrefix(line, "Uid:") {
+			if uids, err = parseIDs(line); err != nil {
+				return nil, nil, err
+			}
+		}
+		if strings.HasPrefix(line, "Gid:") {
+			if gids, err = parseIDs(line); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if uids == nil || gids == nil {
+		return uids, gids, fmt.Errorf("ids missing in status file")
+	}
+	return uids, gids, nil
+}
+
+func parseIDs(line string) (*IDs, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("corrupt status line '%s'", line)
+	}
+	ids := make([]int, 4)
+	for i, f := range fields[1:] {
+		id, err := strconv.Atoi(f)
+		if err != nil {
+			return nil, fmt.Errorf("corrupt status line '%s': %v", line, err)
+		}
+		ids[i] = id
+	}
+	return &IDs{Real: ids[0], Effective: ids[1], Saved: ids[2], FS: ids[3]}, nil
+}
@@ -0,0 +1,183 @@
+package psscanner
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseEnrichment(t *testing.T) {
+	e, err := ParseEnrichment([]string{"exe", " cwd", "comm", "start", "ids", "env"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(e, Enrichment{Exe: true, Cwd: true, Comm: true, StartTime: true, IDs: true, Env: true}) {
+		t.Errorf("Wrong enrichment: %+v", e)
+	}
+
+	_, err = ParseEnrichment([]string{"exe", "color"})
+	if err == nil || err.Error() != "unknown process detail 'color': must be one of exe, cwd, comm, start, ids, cgroup, ns, session, pipes, env" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+var status = []byte("Name:\tsudo\nUmask:\t0022\nState:\tS (sleeping)\nTgid:\t42\nPid:\t42\nPPid:\t1\nUid:\t1000\t0\t0\t0\nGid:\t1000\t1000\t1000\t1000\nFDSize:\t64\n")
+
+func TestEnrich(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockLink("42/exe", "/usr/bin/sudo")
+	fs.mockFile("42/comm", []byte("sudo\n"), nil, nil)
+	fs.mockFile("42/status", status, nil, nil)
+	fs.mockPidStat(42, statWithStartTime(42, 1500), nil, nil)
+	fs.mockFile("stat", []byte("cpu  1 2 3\nbtime 1518987600\nprocesses 42\n"), nil, nil)
+	fs.mockFile("42/environ", []byte("SUDO_USER=bob\x00LS_COLORS=rs=0\x00SSH_CONNECTION=10.0.0.1 5022 10.0.0.2 22\x00EMPTY=\x00broken\x00"), nil, nil)
+	start := time.Unix(1518987615, 0)
+
+	errCh := make(chan error, 10)
+	p := &PSScanner{
+		procfs:     newProcfs(fs),
+		errCh:      errCh,
+		enrichment: Enrichment{Exe: true, Cwd: true, Comm: true, StartTime: true, IDs: true, Env: true, EnvDeny: []string{"LS_*"}},
+	}
+	pe := PSEvent{UID: 0, PID: 42, PPID: -1, CMD: "sudo id"}
+	p.enrich(&pe)
+
+	expected := PSEvent{
+		UID:       0,
+		PID:       42,
+		PPID:      -1,
+		CMD:       "sudo id",
+		Exe:       "/usr/bin/sudo",
+		Comm:      "sudo",
+		StartTime: start,
+		UIDs:      &IDs{Real: 1000, Effective: 0, Saved: 0, FS: 0},
+		GIDs:      &IDs{Real: 1000, Effective: 1000, Saved: 1000, FS: 1000},
+		Env:       map[string]string{"SUDO_USER": "bob", "SSH_CONNECTION": "10.0.0.1 5022 10.0.0.2 22", "EMPTY": ""},
+	}
+	if !reflect.DeepEqual(pe, expected) {
+		t.Errorf("Wrong event: got %#v but want %#v", pe, expected)
+	}
+
+	select {
+	case err := <-errCh:
+		if err.Error() != "reading cwd of pid 42: readlink 42/cwd: file does not exist" {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Errorf("Did not receive error for cwd")
+	}
+
+	s := fmt.Sprintf("UID=0     PID=42     UIDS=1000/0/0/0 GIDS=1000/1000/1000/1000 START=%s COMM=sudo EXE=/usr/bin/sudo ENV={EMPTY='' SSH_CONNECTION='10.0.0.1 5022 10.0.0.2 22' SUDO_USER=bob} | sudo id", start.Format("2006-01-02T15:04:05.00"))
+	if pe.String() != s {
+		t.Errorf("Wrong string: got '%s' but want '%s'", pe, s)
+	}
+}
+
+func TestEnrichUnreadable(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockLink("42/exe", "/tmp/payload (deleted)")
+	fs.mockLinkErr("42/cwd", &os.PathError{Op: "readlink", Path: "42/cwd", Err: os.ErrPermission})
+	fs.mockLinkErr("42/ns/pid", &os.PathError{Op: "readlink", Path: "42/ns/pid", Err: os.ErrPermission})
+
+	errCh := make(chan error, 10)
+	p := &PSScanner{
+		procfs:     newProcfs(fs),
+		errCh:      errCh,
+		enrichment: Enrichment{Exe: true, Cwd: true, NS: true},
+	}
+	pe := PSEvent{UID: 0, PID: 42, PPID: -1, CMD: "/tmp/payload"}
+	p.enrich(&pe)
+
+	expected := PSEvent{UID: 0, PID: 42, PPID: -1, CMD: "/tmp/payload", Exe: "/tmp/payload (deleted)"}
+	if !reflect.DeepEqual(pe, expected) {
+		t.Errorf("Wrong event: got %#v but want %#v", pe, expected)
+	}
+	select {
+	case err := <-errCh:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestEnrichEnv(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockFile("1/environ", nil, nil, os.ErrPermission)
+	fs.mockFile("2/environ", []byte("HOME=/root\x00SUDO_USER=bob\x00SUDO_UID=1000\x00SUDO_COMMAND=/bin/sh\x00"), nil, nil)
+
+	errCh := make(chan error, 10)
+	p := &PSScanner{
+		procfs:     newProcfs(fs),
+		errCh:      errCh,
+		enrichment: Enrichment{Env: true, EnvAllow: []string{"SUDO_*", "SSH_*"}, EnvDeny: []string{"SUDO_COMMAND"}},
+	}
+
+	// environments of other users can't be read, which is not worth an error
+	pe := PSEvent{PID: 1}
+	p.enrich(&pe)
+	if pe.Env != nil {
+		t.Errorf("Unexpected environment: %v", pe.Env)
+	}
+	pe = PSEvent{PID: 2}
+	p.enrich(&pe)
+	if expected := map[string]string{"SUDO_USER": "bob", "SUDO_UID": "1000"}; !reflect.DeepEqual(pe.Env, expected) {
+		t.Errorf("Wrong environment: got %v but want %v", pe.Env, expected)
+	}
+	select {
+	case err := <-errCh:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestEnrichCgroup(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockFile("42/cgroup", []byte("0::/system.slice/cron.service\n"), nil, nil)
+	fs.mockLink("42/ns/pid", "pid:[4026531836]")
+	fs.mockLink("42/ns/mnt", "mnt:[4026531841]")
+	fs.mockLink("42/ns/user", "user:[4026531837]")
+
+	errCh := make(chan error, 10)
+	p := &PSScanner{
+		procfs:     newProcfs(fs),
+		errCh:      errCh,
+		enrichment: Enrichment{Cgroup: true, NS: true},
+	}
+	pe := PSEvent{UID: 0, PID: 42, PPID: -1, CMD: "/usr/sbin/cron -f"}
+	p.enrich(&pe)
+
+	if expected := (&Cgroup{Path: "/system.slice/cron.service", Unit: "cron.service", Slice: "system.slice"}); !reflect.DeepEqual(pe.Cgroup, expected) {
+		t.Errorf("Wrong cgroup: got %+v but want %+v", pe.Cgroup, expected)
+	}
+	if expected := (&Namespaces{PID: 4026531836, Mount: 4026531841, User: 4026531837}); !reflect.DeepEqual(pe.NS, expected) {
+		t.Errorf("Wrong namespaces: got %+v but want %+v", pe.NS, expected)
+	}
+	s := "UID=0     PID=42     UNIT=cron.service NS=4026531836/4026531841/4026531837 | /usr/sbin/cron -f"
+	if pe.String() != s {
+		t.Errorf("Wrong string: got '%s' but want '%s'", pe, s)
+	}
+	select {
+	case err := <-errCh:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestValidateEnvPatterns(t *testing.T) {
+	if err := ValidateEnvPatterns([]string{"SUDO_*", "[A-Z]*"}); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err := ValidateEnvPatterns([]string{"[A-"}); err == nil || err.Error() != "invalid pattern '[A-' for environment variables: syntax error in pattern" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestGetIDsCorrupt(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockFile("42/status", []byte("Name:\tsudo\nUid:\t1000\t0\n"), nil, nil)
+	_, _, err := newProcfs(fs).getIDs(42)
+	if err == nil || err.Error() != "corrupt status line 'Uid:\t1000\t0'" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
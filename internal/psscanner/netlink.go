@@ -0,0 +1,272 @@
+package psscanner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// constants from linux/connector.h and linux/cn_proc.h
+const (
+	cnIdxProc         = 0x1
+	cnValProc         = 0x1
+	procCnMcastListen = 1
+
+	procEventFork = 0x00000001
+	procEventExec = 0x00000002
+	procEventExit = 0x80000000
+
+	// sizeof(struct cn_msg)
+	sizeofCnMsg = 20
+	// what, cpu and timestamp_ns of struct proc_event
+	sizeofProcEventHeader = 16
+)
+
+// the proc connector speaks host byte order
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// NetlinkScanner reports processes as the kernel execs them, using the proc connector
+// instead of polling /proc. Subscribing requires CAP_NET_ADMIN.
+type NetlinkScanner struct {
+	pss *PSScanner
+	fd  int
+}
+
+type procConnEvent struct {
+	what uint32
+	pid  int
+	tgid int
+	// set if the kernel dropped events because our receive buffer was full
+	lost bool
+}
+
+// NewNetlinkScanner subscribes to process events, reading process details with pss.
+// Returns an error if the socket cannot be opened, e.g., due to missing privileges.
+func NewNetlinkScanner(pss *PSScanner) (*NetlinkScanner, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_CONNECTOR)
+	if err != nil {
+		return nil, fmt.Errorf("opening netlink socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: cnIdxProc}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("binding netlink socket: %v", err)
+	}
+	if err := unix.Sendto(fd, subscribeMsg(), 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("subscribing to proc events: %v", err)
+	}
+	return &NetlinkScanner{pss: pss, fd: fd}, nil
+}
+
+// Run reports all processes running at startup, followed by processes as they exec and exit.
+// Triggers are used to report children forked without exec, to resynchronize with /proc
+// after the kernel dropped events, or to poll /proc for good if the socket fails.
+func (n *NetlinkScanner) Run(triggerCh chan struct{}) (chan PSEvent, chan error) {
+	eventCh := make(chan PSEvent, 100)
+	n.pss.eventCh = eventCh
+	errCh := make(chan error)
+	n.pss.errCh = errCh
+	procEventCh := make(chan procConnEvent, 100)
+
+	go n.receive(procEventCh, errCh)
+
+	go func() {
+		// missed processes are not counted: the proc connector reports every exec,
+		// so gaps only come from threads and forks without exec
+		pl := newProcList(n.pss.procfs, n.pss.ancestry, 0, n.pss.rescan)
+		if n.pss.recheck {
+			pl.recheck = recheckRefreshes
+		}
+		n.pss.procs = pl
+		if err := pl.refresh(n.pss); err != nil {
+			errCh <- err
+		}
+
+		resync := false
+		for {
+			select {
+			case ev, ok := <-procEventCh:
+				if !ok {
+					procEventCh = nil
+					resync = true
+					continue
+				}
+				if ev.lost {
+					resync = true
+					continue
+				}
+				pl.handleProcEvent(ev, n.pss)
+			case <-triggerCh:
+				if resync {
+					pl.addForks(n.pss)
+					if err := pl.refresh(n.pss); err != nil {
+						errCh <- err
+					}
+					// keep polling if the socket is gone
+					resync = procEventCh == nil
+				} else {
+					pl.poll(n.pss)
+				}
+			}
+		}
+	}()
+
+	return eventCh, errCh
+}
+
+// SetCountMissed does nothing, as no process is missed while the proc connector reports them
+func (n *NetlinkScanner) SetCountMissed(on bool) {}
+
+func (n *NetlinkScanner) receive(procEventCh chan<- procConnEvent, errCh chan<- error) {
+	defer close(procEventCh)
+	defer unix.Close(n.fd)
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		nr, _, err := unix.Recvfrom(n.fd, buf, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.ENOBUFS {
+			procEventCh <- procConnEvent{lost: true}
+			continue
+		}
+		if err != nil {
+			errCh <- fmt.Errorf("reading netlink socket, falling back to scanning /proc: %v", err)
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:nr])
+		if err != nil {
+			errCh <- fmt.Errorf("parsing netlink message: %v", err)
+			continue
+		}
+		for _, m := range msgs {
+			if m.Header.Type != unix.NLMSG_DONE {
+				continue
+			}
+			ev, err := parseProcEvent(m.Data)
+			if err != nil {
+				errCh <- fmt.Errorf("parsing proc event: %v", err)
+				continue
+			}
+			procEventCh <- ev
+		}
+	}
+}
+
+func (pl *procList) handleProcEvent(ev procConnEvent, p pidProcessor) {
+	if ev.pid != ev.tgid {
+		return // threads
+	}
+	switch ev.what {
+	case procEventFork:
+		// most children exec right away, so they are reported with the program they run
+		pl.forks[ev.pid] = struct{}{}
+	case procEventExec:
+		delete(pl.forks, ev.pid)
+		known, ok := pl.procs[ev.pid]
+		switch {
+		case !ok:
+			pl.add(ev.pid, p)
+			known = pl.procs[ev.pid]
+		case known.execSeen:
+			pl.reread(known, pl.exe(known.event), true, p)
+		default:
+			// it may have been read from /proc after this exec already, so it is
+			// only reported if it changed since
+			pl.recheckOne(known, p)
+		}
+		known.execSeen = true
+	case procEventExit:
+		delete(pl.forks, ev.pid)
+		if _, ok := pl.procs[ev.pid]; ok {
+			pl.exit(ev.pid, p)
+		}
+	}
+}
+
+// poll does what refresh does besides listing /proc, as the proc connector reports new
+// processes: forks without exec are reported, new processes rechecked, known processes
+// rescanned if due, as exec is reported but not changes of argv, and pipes of processes
+// that exited forgotten
+func (pl *procList) poll(p pidProcessor) {
+	pending := pl.pending
+	pl.pending = nil
+	pl.addForks(p)
+	pl.recheckPending(pending, p)
+	pl.rescanIfDue(p)
+	pl.prunePipes()
+}
+
+// addForks reports children forked since the previous trigger that did not exec, such as
+// subshells and worker processes. Those that exited already are not reported.
+func (pl *procList) addForks(p pidProcessor) {
+	pids := make([]int, 0, len(pl.forks))
+	for pid := range pl.forks {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		delete(pl.forks, pid)
+		if _, known := pl.procs[pid]; !known {
+			pl.add(pid, p)
+		}
+	}
+}
+
+// parseProcEvent parses a struct cn_msg carrying a struct proc_event
+func parseProcEvent(data []byte) (procConnEvent, error) {
+	if len(data) < sizeofCnMsg+sizeofProcEventHeader {
+		return procConnEvent{}, fmt.Errorf("message too short: %d bytes", len(data))
+	}
+	if nativeEndian.Uint32(data[0:4]) != cnIdxProc || nativeEndian.Uint32(data[4:8]) != cnValProc {
+		return procConnEvent{}, errors.New("not a proc connector message")
+	}
+
+	ev := procConnEvent{what: nativeEndian.Uint32(data[sizeofCnMsg:])}
+	body := data[sizeofCnMsg+sizeofProcEventHeader:]
+	switch ev.what {
+	case procEventFork:
+		// parent_pid, parent_tgid, child_pid, child_tgid
+		if len(body) < 16 {
+			return procConnEvent{}, errors.New("fork event too short")
+		}
+		ev.pid = int(nativeEndian.Uint32(body[8:12]))
+		ev.tgid = int(nativeEndian.Uint32(body[12:16]))
+	case procEventExec, procEventExit:
+		// process_pid, process_tgid, ...
+		if len(body) < 8 {
+			return procConnEvent{}, errors.New("event too short")
+		}
+		ev.pid = int(nativeEndian.Uint32(body[0:4]))
+		ev.tgid = int(nativeEndian.Uint32(body[4:8]))
+	}
+	return ev, nil
+}
+
+// subscribeMsg builds a netlink message asking the proc connector for events
+func subscribeMsg() []byte {
+	b := make([]byte, unix.SizeofNlMsghdr+sizeofCnMsg+4)
+	nativeEndian.PutUint32(b[0:4], uint32(len(b)))  // nlmsg_len
+	nativeEndian.PutUint16(b[4:6], unix.NLMSG_DONE) // nlmsg_type
+
+	cn := b[unix.SizeofNlMsghdr:]
+	nativeEndian.PutUint32(cn[0:4], cnIdxProc)
+	nativeEndian.PutUint32(cn[4:8], cnValProc)
+	nativeEndian.PutUint16(cn[16:18], 4) // len of payload
+	nativeEndian.PutUint32(cn[sizeofCnMsg:], procCnMcastListen)
+	return b
+}
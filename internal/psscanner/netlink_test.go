@@ -0,0 +1,181 @@
+package psscanner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseProcEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected procConnEvent
+		err      string
+	}{
+		{
+			name:     "exec",
+			data:     procEventMsg(cnIdxProc, procEventExec, 42, 42),
+			expected: procConnEvent{what: procEventExec, pid: 42, tgid: 42},
+		},
+		{
+			name:     "exit",
+			data:     procEventMsg(cnIdxProc, procEventExit, 43, 42, 0, 0),
+			expected: procConnEvent{what: procEventExit, pid: 43, tgid: 42},
+		},
+		{
+			name:     "fork",
+			data:     procEventMsg(cnIdxProc, procEventFork, 1, 1, 44, 44),
+			expected: procConnEvent{what: procEventFork, pid: 44, tgid: 44},
+		},
+		{
+			name: "short",
+			data: procEventMsg(cnIdxProc, procEventExec, 42)[:20],
+			err:  "message too short: 20 bytes",
+		},
+		{
+			name: "short-body",
+			data: procEventMsg(cnIdxProc, procEventExec, 42),
+			err:  "event too short",
+		},
+		{
+			name: "other-connector",
+			data: procEventMsg(0x7, procEventExec, 42, 42),
+			err:  "not a proc connector message",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev, err := parseProcEvent(tt.data)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("Wrong error: got %v but want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(ev, tt.expected) {
+				t.Errorf("Wrong event: got %+v but want %+v", ev, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleProcEvent(t *testing.T) {
+	pl := newProcList(newProcfs(newMockFS(t)), 1, 0, 0)
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	pl.handleProcEvent(procConnEvent{what: procEventFork, pid: 5, tgid: 5}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 5, tgid: 5}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 6, tgid: 5}, m) // thread
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 5, tgid: 5}, m) // exec again
+	pl.handleProcEvent(procConnEvent{what: procEventExit, pid: 5, tgid: 5}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventExit, pid: 7, tgid: 7}, m) // never seen
+
+	if !reflect.DeepEqual(m.pids, []int{5}) || !reflect.DeepEqual(m.execed, []int{5}) {
+		t.Errorf("Unexpected pids got processed %v or exec'ed %v", m.pids, m.execed)
+	}
+	if !reflect.DeepEqual(m.exited, []int{5}) {
+		t.Errorf("Unexpected pids exited: got %v", m.exited)
+	}
+	if len(pl.procs) != 0 {
+		t.Errorf("Exited processes still known: %v", pl.procs)
+	}
+	if _, ok := pl.exited[5]; !ok {
+		t.Errorf("Exec'ed process not remembered for ancestry after it exited")
+	}
+
+	// forks without exec are reported on the next trigger, unless they exited
+	pl.handleProcEvent(procConnEvent{what: procEventFork, pid: 9, tgid: 9}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventFork, pid: 8, tgid: 8}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventFork, pid: 10, tgid: 10}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventExit, pid: 10, tgid: 10}, m)
+	pl.addForks(m)
+	pl.addForks(m)
+	if !reflect.DeepEqual(m.pids, []int{5, 8, 9}) {
+		t.Errorf("Wrong forks processed: got %v", m.pids)
+	}
+}
+
+func TestHandleProcEventReadAfterExec(t *testing.T) {
+	pl := newProcList(newProcfs(newMockFS(t)), 0, 0, 0)
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	// the trigger came between fork and exec event, so the fork is reported with the
+	// program it exec'ed already, and the exec event must not report it again. The same
+	// goes for processes listed at startup while their exec events were queued.
+	pl.handleProcEvent(procConnEvent{what: procEventFork, pid: 5, tgid: 5}, m)
+	pl.addForks(m)
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 5, tgid: 5}, m)
+	pl.procs[6] = &proc{event: PSEvent{PID: 6}}
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 6, tgid: 6}, m)
+	if !reflect.DeepEqual(m.rechecked, []int{5, 6}) || len(m.execed) != 0 {
+		t.Errorf("Not rechecked on exec: rechecked %v, exec'ed %v", m.rechecked, m.execed)
+	}
+
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 5, tgid: 5}, m)
+	if !reflect.DeepEqual(m.execed, []int{5}) {
+		t.Errorf("Exec after the fork was rechecked not reported: got %v", m.execed)
+	}
+}
+
+func TestPollPrunesPipes(t *testing.T) {
+	pl := newProcList(newProcfs(newMockFS(t)), 0, 0, 0)
+	m := &mockPidProcessor{t: t}
+	for _, known := range []*proc{
+		{event: PSEvent{PID: 10, PPID: 9, CMD: "echo x", Pipes: &Pipes{Stdout: 100}}},
+		{event: PSEvent{PID: 11, PPID: 9, CMD: "cat", Pipes: &Pipes{Stdin: 100}}},
+	} {
+		pl.procs[known.event.PID] = known
+		pl.trackPipes(known, m)
+	}
+
+	pl.handleProcEvent(procConnEvent{what: procEventExit, pid: 10, tgid: 10}, m)
+	pl.handleProcEvent(procConnEvent{what: procEventExit, pid: 11, tgid: 11}, m)
+	pl.poll(m)
+	if _, ok := pl.pipes[100]; !ok {
+		t.Errorf("Pipe forgotten right after its processes exited")
+	}
+	pl.poll(m)
+	if len(pl.pipes) != 0 {
+		t.Errorf("Pipes of exited processes not forgotten: %v", pl.pipes)
+	}
+}
+
+func TestPollRechecks(t *testing.T) {
+	pl := newProcList(newProcfs(newMockFS(t)), 0, 0, 0)
+	pl.recheck = recheckRefreshes
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	pl.handleProcEvent(procConnEvent{what: procEventExec, pid: 5, tgid: 5}, m)
+	pl.poll(m)
+	pl.poll(m)
+	pl.poll(m)
+	if !reflect.DeepEqual(m.rechecked, []int{5, 5}) {
+		t.Errorf("Wrong pids rechecked: got %v but want %v", m.rechecked, []int{5, 5})
+	}
+}
+
+func TestSubscribeMsg(t *testing.T) {
+	b := subscribeMsg()
+	if len(b) != 40 || nativeEndian.Uint32(b[0:4]) != 40 {
+		t.Fatalf("Wrong message length: %d", len(b))
+	}
+	if nativeEndian.Uint32(b[36:40]) != procCnMcastListen {
+		t.Errorf("Wrong op: %v", b[36:40])
+	}
+}
+
+// procEventMsg builds a struct cn_msg with a struct proc_event carrying the given fields
+func procEventMsg(idx uint32, what uint32, fields ...uint32) []byte {
+	b := make([]byte, sizeofCnMsg+sizeofProcEventHeader+4*len(fields))
+	nativeEndian.PutUint32(b[0:4], idx)
+	nativeEndian.PutUint32(b[4:8], cnValProc)
+	nativeEndian.PutUint32(b[sizeofCnMsg:], what)
+	for i, f := range fields {
+		nativeEndian.PutUint32(b[sizeofCnMsg+sizeofProcEventHeader+4*i:], f)
+	}
+	return b
+}
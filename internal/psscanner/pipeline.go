@@ -0,0 +1,223 @@
+package psscanner
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Pipes are the inodes of the pipes on standard input and output of a process, 0 for other files.
+// A shell connects the members of a pipeline such as "echo x | passwd" by giving the standard
+// output of one and the standard input of the next the two ends of the same pipe.
+type Pipes struct {
+	Stdin  uint64 `json:"stdin,omitempty"`
+	Stdout uint64 `json:"stdout,omitempty"`
+}
+
+func (p Pipes) String() string {
+	var parts []string
+	if p.Stdin != 0 {
+		parts = append(parts, fmt.Sprintf("STDIN=pipe:[%d]", p.Stdin))
+	}
+	if p.Stdout != 0 {
+		parts = append(parts, fmt.Sprintf("STDOUT=pipe:[%d]", p.Stdout))
+	}
+	return strings.Join(parts, " ")
+}
+
+// PipelineMember is a process of a pipeline, reading what the member before it writes
+type PipelineMember struct {
+	PID  int      `json:"pid"`
+	UID  int      `json:"uid"`
+	CMD  string   `json:"cmd"`
+	Argv []string `json:"argv,omitempty"`
+}
+
+// Command renders the command line of a member like PSEvent.Command
+func (m PipelineMember) Command() string {
+	if m.Argv != nil {
+		return ShellQuote(m.Argv)
+	}
+	return m.CMD
+}
+
+// PipelineCommand renders the command lines of the members of a pipeline joined by " | "
+func PipelineCommand(members []PipelineMember) string {
+	cmds := make([]string, len(members))
+	for i, m := range members {
+		cmds[i] = m.Command()
+	}
+	return strings.Join(cmds, " | ")
+}
+
+// getPipes reads the links /proc/<pid>/fd/0 and 1, e.g., "pipe:[4026531836]", nil if neither is a pipe.
+// The links are only readable for processes of the same user, unless running as root.
+func (p *procfs) getPipes(pid int) (*Pipes, error) {
+	pipes := &Pipes{}
+	for fd, inode := range []*uint64{&pipes.Stdin, &pipes.Stdout} {
+		link, err := p.fs.Readlink(fmt.Sprintf("%d/fd/%d", pid, fd))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // closed
+			}
+			return nil, err
+		}
+		if !strings.HasPrefix(link, "pipe:[") || !strings.HasSuffix(link, "]") {
+			continue
+		}
+		if *inode, err = strconv.ParseUint(link[len("pipe:["):len(link)-1], 10, 64); err != nil {
+			return nil, fmt.Errorf("corrupt fd link '%s'", link)
+		}
+	}
+	if *pipes == (Pipes{}) {
+		return nil, nil
+	}
+	return pipes, nil
+}
+
+// pipeEnds are the processes known to write to and read from a pipe
+type pipeEnds struct {
+	writers, readers []*proc
+	// all processes were gone at the end of the previous refresh
+	stale bool
+}
+
+// trackPipes registers the pipes of a new or rechecked process and reports the pipeline
+// it belongs to if there is one that was not reported in this form before
+func (pl *procList) trackPipes(known *proc, p pidProcessor) {
+	pipes := known.event.Pipes
+	if pipes == nil {
+		return
+	}
+	if pipes.Stdin != 0 {
+		ends := pl.pipeEnds(pipes.Stdin)
+		ends.readers = replaceProc(ends.readers, known)
+	}
+	if pipes.Stdout != 0 {
+		ends := pl.pipeEnds(pipes.Stdout)
+		ends.writers = replaceProc(ends.writers, known)
+	}
+
+	members := pl.pipeline(known)
+	if len(members) < 2 {
+		return
+	}
+	key := pipelineKey(members)
+	reported := true
+	for _, m := range members {
+		reported = reported && m.pipeline == key
+	}
+	if reported {
+		return
+	}
+	events := make([]PSEvent, len(members))
+	for i, m := range members {
+		m.pipeline = key
+		events[i] = m.event
+	}
+	p.processPipeline(events)
+}
+
+func (pl *procList) pipeEnds(inode uint64) *pipeEnds {
+	ends, ok := pl.pipes[inode]
+	if !ok {
+		ends = &pipeEnds{}
+		pl.pipes[inode] = ends
+	}
+	ends.stale = false
+	return ends
+}
+
+// replaceProc adds a process to a list of processes, replacing an older one of the same PID
+func replaceProc(procs []*proc, known *proc) []*proc {
+	for i, other := range procs {
+		if other.event.PID == known.event.PID {
+			procs[i] = known
+			return procs
+		}
+	}
+	return append(procs, known)
+}
+
+// pipeline returns the members of the pipeline of a process in order, following the pipes on
+// its standard input and output to the siblings at their other ends
+func (pl *procList) pipeline(known *proc) []*proc {
+	seen := map[int]bool{known.event.PID: true}
+	members := []*proc{known}
+	for m := known; ; {
+		if m = pl.sibling(m, m.event.Pipes.Stdin, false); m == nil || seen[m.event.PID] {
+			break
+		}
+		seen[m.event.PID] = true
+		members = append([]*proc{m}, members...)
+	}
+	for m := known; ; {
+		if m = pl.sibling(m, m.event.Pipes.Stdout, true); m == nil || seen[m.event.PID] {
+			break
+		}
+		seen[m.event.PID] = true
+		members = append(members, m)
+	}
+	return members
+}
+
+// sibling returns the process with the same parent at the other end of a pipe,
+// the one reading from it if reader is true and the one writing to it otherwise
+func (pl *procList) sibling(known *proc, inode uint64, reader bool) *proc {
+	ends, ok := pl.pipes[inode]
+	if inode == 0 || !ok {
+		return nil
+	}
+	others := ends.writers
+	if reader {
+		others = ends.readers
+	}
+	for _, other := range others {
+		if other.event.PID != known.event.PID && other.event.PPID > 0 && other.event.PPID == known.event.PPID && other.event.Pipes != nil {
+			return other
+		}
+	}
+	return nil
+}
+
+// pipelineKey tells pipelines apart by the PIDs and commands of their members,
+// so that one is reported again when a member exec'ed
+func pipelineKey(members []*proc) string {
+	var b strings.Builder
+	for _, m := range members {
+		fmt.Fprintf(&b, "%d %s\x00", m.event.PID, m.event.CMD)
+	}
+	return b.String()
+}
+
+// prunePipes forgets pipes whose processes are all gone. Processes that exited stay linked
+// until the end of the next refresh or poll, as a short-lived member such as echo often exits before
+// the next member is seen.
+func (pl *procList) prunePipes() {
+	for inode, ends := range pl.pipes {
+		ends.writers = pl.present(ends.writers)
+		ends.readers = pl.present(ends.readers)
+		gone := true
+		for _, procs := range [][]*proc{ends.writers, ends.readers} {
+			for _, known := range procs {
+				gone = gone && pl.procs[known.event.PID] != known
+			}
+		}
+		if gone && ends.stale {
+			delete(pl.pipes, inode)
+		}
+		ends.stale = gone
+	}
+}
+
+// present drops processes that were replaced by another one of the same PID
+func (pl *procList) present(procs []*proc) []*proc {
+	kept := procs[:0]
+	for _, known := range procs {
+		if current, ok := pl.procs[known.event.PID]; !ok || current == known {
+			kept = append(kept, known)
+		}
+	}
+	return kept
+}
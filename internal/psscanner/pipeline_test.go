@@ -0,0 +1,130 @@
+package psscanner
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetPipes(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockLink("42/fd/0", "pipe:[66528]")
+	fs.mockLink("42/fd/1", "/dev/null")
+	fs.mockLink("43/fd/0", "/dev/pts/0")
+	fs.mockLink("43/fd/1", "socket:[1234]")
+	fs.mockLink("44/fd/1", "pipe:[x]")
+	p := newProcfs(fs)
+
+	pipes, err := p.getPipes(42)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (&Pipes{Stdin: 66528}); !reflect.DeepEqual(pipes, expected) {
+		t.Errorf("Wrong pipes: got %+v but want %+v", pipes, expected)
+	}
+	if pipes, err := p.getPipes(43); pipes != nil || err != nil {
+		t.Errorf("Unexpected pipes %+v or error %v", pipes, err)
+	}
+	if _, err := p.getPipes(44); err == nil || err.Error() != "corrupt fd link 'pipe:[x]'" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestEnrichPipes(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockLink("42/fd/0", "pipe:[66528]")
+	fs.mockLink("42/fd/1", "pipe:[66535]")
+
+	errCh := make(chan error, 10)
+	p := &PSScanner{procfs: newProcfs(fs), errCh: errCh, enrichment: Enrichment{Pipes: true}}
+	pe := PSEvent{UID: 0, PID: 42, PPID: 41, CMD: "cat"}
+	p.enrich(&pe)
+	if s := "UID=0     PID=42     PPID=41     STDIN=pipe:[66528] STDOUT=pipe:[66535] | cat"; pe.String() != s {
+		t.Errorf("Wrong string: got '%s' but want '%s'", pe, s)
+	}
+
+	// closed file descriptors
+	pe = PSEvent{PID: 43}
+	p.enrich(&pe)
+	if pe.Pipes != nil {
+		t.Errorf("Unexpected pipes: %+v", pe.Pipes)
+	}
+	select {
+	case err := <-errCh:
+		t.Errorf("Unexpected error: %v", err)
+	default:
+	}
+}
+
+func TestTrackPipes(t *testing.T) {
+	m := &mockPidProcessor{t: t}
+	pl := newProcList(nil, 0, 0, 0)
+	add := func(pid, ppid int, cmd string, pipes *Pipes) *proc {
+		known := &proc{event: PSEvent{PID: pid, PPID: ppid, CMD: cmd, Pipes: pipes}}
+		pl.procs[pid] = known
+		pl.trackPipes(known, m)
+		return known
+	}
+
+	add(10, 9, "echo x", &Pipes{Stdout: 100})
+	add(20, 1, "cat", &Pipes{Stdin: 100}) // not a sibling, e.g., a daemon passed the pipe
+	add(11, 9, "passwd bob", &Pipes{Stdin: 100})
+	expected := [][]int{{10, 11}}
+	if !reflect.DeepEqual(m.pipelines, expected) {
+		t.Fatalf("Wrong pipelines: got %v but want %v", m.pipelines, expected)
+	}
+
+	// a member seen before its neighbor exec'ed extends the pipeline
+	sh := add(12, 9, "sh", &Pipes{Stdin: 200})
+	pl.procs[11].event.Pipes = &Pipes{Stdin: 100, Stdout: 200}
+	pl.trackPipes(pl.procs[11], m)
+	sh.event.CMD = "tee log"
+	pl.trackPipes(sh, m)
+	pl.trackPipes(sh, m)
+	expected = append(expected, []int{10, 11, 12}, []int{10, 11, 12})
+	if !reflect.DeepEqual(m.pipelines, expected) {
+		t.Errorf("Wrong pipelines: got %v but want %v", m.pipelines, expected)
+	}
+
+	// pipes are forgotten a refresh after all their processes exited
+	delete(pl.procs, 10)
+	pl.prunePipes()
+	if _, ok := pl.pipes[100]; !ok {
+		t.Errorf("Pipe forgotten while processes are alive")
+	}
+	delete(pl.procs, 11)
+	delete(pl.procs, 20)
+	pl.prunePipes()
+	if _, ok := pl.pipes[100]; !ok {
+		t.Errorf("Pipe forgotten right after its processes exited")
+	}
+	pl.prunePipes()
+	if _, ok := pl.pipes[100]; ok {
+		t.Errorf("Pipe of exited processes not forgotten")
+	}
+	if _, ok := pl.pipes[200]; !ok {
+		t.Errorf("Pipe of a process alive forgotten")
+	}
+}
+
+func TestProcessPipeline(t *testing.T) {
+	clock := time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)
+	defer mockNow(clock)()
+	eventCh := make(chan PSEvent, 1)
+	p := &PSScanner{eventCh: eventCh}
+	p.processPipeline([]PSEvent{
+		{UID: 0, PID: 23, PPID: 22, CMD: "/bin/echo -e a\\nb", Argv: []string{"/bin/echo", "-e", "a\\nb"}},
+		{UID: 0, PID: 24, PPID: 22, CMD: "passwd myuser", Argv: []string{"passwd", "myuser"}},
+	})
+	pe := <-eventCh
+	expected := PSEvent{Kind: KindPipeline, UID: 0, PID: 23, PPID: 22, CMD: "/bin/echo -e $'a\\\\nb' | passwd myuser", Pipeline: []PipelineMember{
+		{PID: 23, UID: 0, CMD: "/bin/echo -e a\\nb", Argv: []string{"/bin/echo", "-e", "a\\nb"}},
+		{PID: 24, UID: 0, CMD: "passwd myuser", Argv: []string{"passwd", "myuser"}},
+	}, Time: clock}
+	if !reflect.DeepEqual(pe, expected) {
+		t.Errorf("Wrong event: got %+v but want %+v", pe, expected)
+	}
+	if s := "UID=0     PID=23     PPID=22     | /bin/echo -e $'a\\\\nb' | passwd myuser (pids 23, 24)"; pe.String() != s {
+		t.Errorf("Wrong string: got '%s' but want '%s'", pe, s)
+	}
+}
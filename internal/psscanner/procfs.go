@@ -0,0 +1,291 @@
+package psscanner
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FS gives access to a procfs tree. Names are relative to its root, e.g., "42/cmdline".
+type FS interface {
+	Open(name string) (io.ReadCloser, error)
+	OpenDir(name string) (DirReader, error)
+	Lstat(name string, stat *syscall.Stat_t) error
+	Readlink(name string) (string, error)
+}
+
+type DirReader interface {
+	Readdirnames(n int) (names []string, err error)
+	io.Closer
+}
+
+// NewProcFS returns an FS for the procfs mounted at root, usually /proc
+func NewProcFS(root string) FS {
+	return &osFS{root: root}
+}
+
+type osFS struct {
+	root string
+}
+
+func (fs *osFS) path(name string) string {
+	return filepath.Join(fs.root, name)
+}
+
+func (fs *osFS) Open(name string) (io.ReadCloser, error) {
+	return os.Open(fs.path(name))
+}
+
+func (fs *osFS) OpenDir(name string) (DirReader, error) {
+	return os.Open(fs.path(name))
+}
+
+// Lstat directly uses the syscall as os.Lstat hides data in the Sys member
+func (fs *osFS) Lstat(name string, stat *syscall.Stat_t) error {
+	return syscall.Lstat(fs.path(name), stat)
+}
+
+func (fs *osFS) Readlink(name string) (string, error) {
+	return os.Readlink(fs.path(name))
+}
+
+// clock ticks per second used in /proc/<pid>/stat (USER_HZ), 100 on all common architectures
+const userHZ = 100
+
+// procfs reads process information from an FS
+type procfs struct {
+	fs FS
+	// the FS is not the /proc of our own PID namespace, see getLastPid
+	foreign bool
+
+	bootTimeOnce sync.Once
+	bootTime     time.Time
+	bootTimeErr  error
+}
+
+func newProcfs(fs FS) *procfs {
+	osFS, ok := fs.(*osFS)
+	return &procfs{fs: fs, foreign: ok && osFS.root != "/proc"}
+}
+
+func (p *procfs) getPIDs() ([]int, error) {
+	f, err := p.fs.OpenDir(".")
+	if err != nil {
+		return nil, fmt.Errorf("opening proc dir: %v", err)
+	}
+	defer f.Close()
+
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("reading proc dir: %v", err)
+	}
+
+	pids := make([]int, 0)
+	for _, f := range names {
+		pid, err := strconv.Atoi(f)
+		if err != nil || pid <= 0 {
+			continue
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+// getLastPid returns the PID most recently allocated by the kernel,
+// taken from the last field of /proc/loadavg. The kernel reports it for the PID namespace
+// of the reader, whichever procfs is read, so it is unknown for a procfs mounted elsewhere,
+// which may be of another namespace, e.g., the host's at /host/proc in a container.
+func (p *procfs) getLastPid() (int, error) {
+	if p.foreign {
+		return -1, errors.New("last PID of another PID namespace unknown")
+	}
+	loadavg, err := p.readFile("loadavg", 128)
+	if err != nil {
+		return -1, err
+	}
+	fields := strings.Fields(string(loadavg))
+	if len(fields) < 5 {
+		return -1, errors.New("corrupt loadavg file")
+	}
+	return strconv.Atoi(fields[4])
+}
+
+// getStartTime returns the start time of a process in clock ticks after boot
+func (p *procfs) getStartTime(pid int) (uint64, error) {
+	stat, err := p.readFile(fmt.Sprintf("%d/stat", pid), 512)
+	if err != nil {
+		return 0, err
+	}
+	fields, err := statFields(stat)
+	if err != nil {
+		return 0, err
+	}
+	if len(fields) < 20 {
+		return 0, errors.New("corrupt stat file")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// getPpid returns the parent PID of a process, 0 for processes started by the kernel
+func (p *procfs) getPpid(pid int) (int, error) {
+	stat, err := p.readFile(fmt.Sprintf("%d/stat", pid), 512)
+	if err != nil {
+		return -1, err
+	}
+	fields, err := statFields(stat)
+	if err != nil {
+		return -1, err
+	}
+	if len(fields) < 2 {
+		return -1, errors.New("corrupt stat file")
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return -1, err
+	}
+	return ppid, nil
+}
+
+// getTgid returns the thread group ID of a task, which is its own PID for processes
+// and the PID of the process it belongs to for threads
+func (p *procfs) getTgid(pid int) (int, error) {
+	status, err := p.readFile(fmt.Sprintf("%d/status", pid), 4096)
+	if err != nil {
+		return -1, err
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if v := strings.TrimPrefix(line, "Tgid:"); v != line {
+			return strconv.Atoi(strings.TrimSpace(v))
+		}
+	}
+	return -1, errors.New("corrupt status file")
+}
+
+// getExe returns the executable of a process. Executables deleted or replaced since
+// the process started have the suffix " (deleted)", which is kept as it is a strong hint of
+// malware covering its tracks.
+func (p *procfs) getExe(pid int) (string, error) {
+	return p.fs.Readlink(fmt.Sprintf("%d/exe", pid))
+}
+
+// ExePath returns the path of an executable as read from /proc/<pid>/exe without the
+// suffix " (deleted)", e.g., to compare it with another path
+func ExePath(exe string) string {
+	return strings.TrimSuffix(exe, " (deleted)")
+}
+
+// getState returns the state of a process, e.g., "R" or "Z" for zombies, and its flags
+func (p *procfs) getState(pid int) (string, uint64, error) {
+	stat, err := p.readFile(fmt.Sprintf("%d/stat", pid), 512)
+	if err != nil {
+		return "", 0, err
+	}
+	fields, err := statFields(stat)
+	if err != nil {
+		return "", 0, err
+	}
+	if len(fields) < 7 {
+		return "", 0, errors.New("corrupt stat file")
+	}
+	flags, err := strconv.ParseUint(fields[6], 10, 64)
+	return fields[0], flags, err
+}
+
+// getComm returns the name of the executable of a process, at most 15 bytes long.
+// Reads /proc/<pid>/comm or, if that fails, the name in the stat file.
+func (p *procfs) getComm(pid int) (string, error) {
+	if comm, err := p.readFile(fmt.Sprintf("%d/comm", pid), 64); err == nil {
+		return strings.TrimSuffix(string(comm), "\n"), nil
+	}
+	stat, err := p.readFile(fmt.Sprintf("%d/stat", pid), 512)
+	if err != nil {
+		return "", err
+	}
+	start, end := bytes.IndexByte(stat, '('), bytes.LastIndexByte(stat, ')')
+	if start < 0 || end < start {
+		return "", errors.New("corrupt stat file")
+	}
+	return string(stat[start+1 : end]), nil
+}
+
+// statFields splits a stat file into the fields following the command name,
+// which may contain spaces and parentheses. Index 0 is the process state (field 3 in proc(5)).
+func statFields(stat []byte) ([]string, error) {
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return nil, errors.New("corrupt stat file")
+	}
+	return strings.Fields(string(stat[i+1:])), nil
+}
+
+// startTimeToTime converts a start time in clock ticks after boot to wall clock time
+func (p *procfs) startTimeToTime(ticks uint64) (time.Time, error) {
+	if ticks == 0 {
+		return time.Time{}, errors.New("unknown start time")
+	}
+	p.bootTimeOnce.Do(func() {
+		p.bootTime, p.bootTimeErr = p.getBootTime()
+	})
+	if p.bootTimeErr != nil {
+		return time.Time{}, p.bootTimeErr
+	}
+	return p.bootTime.Add(time.Duration(ticks) * time.Second / userHZ), nil
+}
+
+// getBootTime reads the system boot time from the btime line in /proc/stat
+func (p *procfs) getBootTime() (time.Time, error) {
+	f, err := p.fs.Open("stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "btime" {
+			btime, err := strconv.ParseInt(fields[1], 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("parsing btime: %v", err)
+			}
+			return time.Unix(btime, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, errors.New("btime not found in /proc/stat")
+}
+
+// readFile reads up to maxlen bytes. Files in /proc may return less than available
+// in a single read, e.g., cmdline returns at most a page, so keep reading until EOF.
+func (p *procfs) readFile(filename string, maxlen int) ([]byte, error) {
+	file, err := p.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, maxlen)
+	n := 0
+	for n < maxlen {
+		m, err := file.Read(buffer[n:])
+		n += m
+		if err == io.EOF || (err == nil && m == 0) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buffer[:n], nil
+}
@@ -0,0 +1,342 @@
+package psscanner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// GetPIDs
+
+func TestGetPIDs(t *testing.T) {
+	tests := []struct {
+		name        string
+		proc        []string
+		procErrOpen error
+		procErrRead error
+		pids        []int
+		err         string
+	}{
+		{
+			name:        "numbers-only",
+			proc:        []string{"42", "somedir"},
+			procErrOpen: nil,
+			procErrRead: nil,
+			pids:        []int{42},
+			err:         "",
+		},
+		{
+			name:        "multiple-entries",
+			proc:        []string{"42", "13"},
+			procErrOpen: nil,
+			procErrRead: nil,
+			pids:        []int{42, 13},
+			err:         "",
+		},
+		{
+			name:        "ignores-lte-0",
+			proc:        []string{"0", "-1"},
+			procErrOpen: nil,
+			procErrRead: nil,
+			pids:        []int{},
+			err:         "",
+		},
+		{
+			name:        "empty-procfs",
+			proc:        []string{},
+			procErrOpen: nil,
+			procErrRead: nil,
+			pids:        []int{},
+			err:         "",
+		},
+		{
+			name:        "handle-open-error",
+			proc:        []string{},
+			procErrOpen: errors.New("file-system-error"),
+			procErrRead: nil,
+			pids:        nil,
+			err:         "opening proc dir: file-system-error",
+		},
+		{
+			name:        "handle-read-error",
+			proc:        []string{},
+			procErrOpen: nil,
+			procErrRead: errors.New("file-system-error"),
+			pids:        nil,
+			err:         "reading proc dir: file-system-error",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newMockFS(t)
+			fs.mockDir(".", tt.proc, tt.procErrRead, tt.procErrOpen)
+			pids, err := newProcfs(fs).getPIDs()
+			if !reflect.DeepEqual(pids, tt.pids) {
+				t.Errorf("Wrong pids returned: got %v but want %v", pids, tt.pids)
+			}
+			if (err != nil || tt.err != "") && fmt.Sprintf("%v", err) != tt.err {
+				t.Errorf("Wrong error returned: got %v but want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		chunk    int
+		maxlen   int
+		expected string
+	}{
+		{name: "single-read", content: "abc\x00def\x00", maxlen: 100, expected: "abc\x00def\x00"},
+		{name: "multiple-reads", content: "abc\x00def\x00", chunk: 3, maxlen: 100, expected: "abc\x00def\x00"},
+		{name: "truncated", content: "abc\x00def\x00", chunk: 3, maxlen: 5, expected: "abc\x00d"},
+		{name: "empty", content: "", chunk: 3, maxlen: 5, expected: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newMockFS(t)
+			fs.files["f"] = &mockFileEntry{content: []byte(tt.content), chunk: tt.chunk}
+			b, err := newProcfs(fs).readFile("f", tt.maxlen)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(b) != tt.expected {
+				t.Errorf("Wrong content: got %q but wanted %q", b, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBootTime(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockFile("stat", []byte("cpu  1 2 3\nbtime 1518987600\nprocesses 42\n"), nil, nil)
+	p := newProcfs(fs)
+
+	st, err := p.startTimeToTime(250)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !st.Equal(time.Unix(1518987602, 500000000)) {
+		t.Errorf("Wrong start time: %v", st)
+	}
+	if _, err := p.startTimeToTime(0); err == nil {
+		t.Errorf("Expected error for unknown start time")
+	}
+}
+
+func TestProcFSForeign(t *testing.T) {
+	if newProcfs(NewProcFS("/proc")).foreign {
+		t.Errorf("/proc is of our own PID namespace")
+	}
+	if !newProcfs(NewProcFS("/host/proc")).foreign {
+		t.Errorf("/host/proc may be of another PID namespace")
+	}
+	if pid, err := newProcfs(NewProcFS("/host/proc")).getLastPid(); err == nil {
+		t.Errorf("Expected error for last pid of another namespace, got %d", pid)
+	}
+}
+
+func TestProcFS(t *testing.T) {
+	fs := NewProcFS("/proc")
+	p := newProcfs(fs)
+	self := os.Getpid()
+
+	pids, err := p.getPIDs()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	found := false
+	for _, pid := range pids {
+		found = found || pid == self
+	}
+	if !found {
+		t.Errorf("Own pid %d not found in %v", self, pids)
+	}
+
+	var stat syscall.Stat_t
+	if err := fs.Lstat(fmt.Sprintf("%d", self), &stat); err != nil || int(stat.Uid) != os.Getuid() {
+		t.Errorf("Wrong owner of own pid: uid=%d err=%v", stat.Uid, err)
+	}
+	if _, err := fs.Readlink(fmt.Sprintf("%d/exe", self)); err != nil {
+		t.Errorf("Can't read own exe: %v", err)
+	}
+}
+
+// mockFS is an in-memory procfs tree
+type mockFS struct {
+	t     *testing.T
+	files map[string]*mockFileEntry
+	dirs  map[string]*mockDirEntry
+	stats map[string]*mockStatEntry
+	links map[string]string
+	errs  map[string]error
+}
+
+type mockFileEntry struct {
+	content []byte
+	errRead error
+	errOpen error
+	chunk   int
+}
+
+type mockDirEntry struct {
+	names   []string
+	errRead error
+	errOpen error
+}
+
+type mockStatEntry struct {
+	uid uint32
+	err error
+}
+
+func newMockFS(t *testing.T) *mockFS {
+	return &mockFS{
+		t:     t,
+		files: make(map[string]*mockFileEntry),
+		dirs:  make(map[string]*mockDirEntry),
+		stats: make(map[string]*mockStatEntry),
+		links: make(map[string]string),
+		errs:  make(map[string]error),
+	}
+}
+
+func notExist(op, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *mockFS) Open(name string) (io.ReadCloser, error) {
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	if testing.Verbose() {
+		fs.t.Logf("opening mocked file: %s", name)
+	}
+	return &MockFile{content: f.content, err: f.errRead, chunk: f.chunk}, f.errOpen
+}
+
+func (fs *mockFS) OpenDir(name string) (DirReader, error) {
+	d, ok := fs.dirs[name]
+	if !ok {
+		return nil, notExist("open", name)
+	}
+	if testing.Verbose() {
+		fs.t.Logf("opening mocked dir: %s", name)
+	}
+	return &MockDir{names: d.names, err: d.errRead}, d.errOpen
+}
+
+func (fs *mockFS) Lstat(name string, stat *syscall.Stat_t) error {
+	st, ok := fs.stats[name]
+	if !ok {
+		return notExist("lstat", name)
+	}
+	if testing.Verbose() {
+		fs.t.Logf("mocking lstat for %s", name)
+	}
+	stat.Uid = st.uid
+	return st.err
+}
+
+func (fs *mockFS) Readlink(name string) (string, error) {
+	if err, ok := fs.errs[name]; ok {
+		return "", err
+	}
+	target, ok := fs.links[name]
+	if !ok {
+		return "", notExist("readlink", name)
+	}
+	return target, nil
+}
+
+func (fs *mockFS) mockFile(name string, content []byte, errRead error, errOpen error) {
+	fs.files[name] = &mockFileEntry{content: content, errRead: errRead, errOpen: errOpen}
+}
+
+func (fs *mockFS) mockPidStat(pid int, stat []byte, errRead error, errOpen error) {
+	fs.mockFile(fmt.Sprintf("%d/stat", pid), stat, errRead, errOpen)
+}
+
+func (fs *mockFS) mockPidCmdLine(pid int, cmdline []byte, errRead error, errOpen error) {
+	fs.mockFile(fmt.Sprintf("%d/cmdline", pid), cmdline, errRead, errOpen)
+}
+
+func (fs *mockFS) mockPidUid(pid int, uid uint32, err error) {
+	fs.stats[fmt.Sprintf("%d", pid)] = &mockStatEntry{uid: uid, err: err}
+}
+
+func (fs *mockFS) mockDir(name string, names []string, errRead error, errOpen error) {
+	fs.dirs[name] = &mockDirEntry{names: names, errRead: errRead, errOpen: errOpen}
+}
+
+func (fs *mockFS) mockPidList(pids []int) {
+	dirs := make([]string, 0)
+	for _, pid := range pids {
+		dirs = append(dirs, fmt.Sprintf("%d", pid))
+	}
+	fs.mockDir(".", dirs, nil, nil)
+}
+
+func (fs *mockFS) mockLink(name string, target string) {
+	fs.links[name] = target
+}
+
+func (fs *mockFS) mockLinkErr(name string, err error) {
+	fs.errs[name] = err
+}
+
+type MockFile struct {
+	content []byte
+	err     error
+	offset  int
+	chunk   int // maximum bytes per read, 0 for no limit
+}
+
+func (f *MockFile) Close() error {
+	return nil
+}
+
+func (f *MockFile) Read(p []byte) (int, error) {
+	if f.err == nil && f.offset >= len(f.content) {
+		return 0, io.EOF
+	}
+	if f.chunk > 0 && len(p) > f.chunk {
+		p = p[:f.chunk]
+	}
+	n := copy(p, f.content[f.offset:])
+	f.offset += n
+	return n, f.err
+}
+
+type MockDir struct {
+	names []string
+	err   error
+}
+
+func (f *MockDir) Close() error {
+	return nil
+}
+
+func min(a, b int) int {
+	if a > b {
+		return b
+	}
+	return a
+}
+
+func (f *MockDir) Readdirnames(n int) (names []string, err error) {
+	if n < 0 {
+		return f.names, f.err
+	}
+	return f.names[:min(n, len(f.names))], f.err
+}
@@ -1,64 +1,385 @@
 package psscanner
 
 import (
-	"fmt"
-	"io"
 	"os"
+	"sort"
 	"strconv"
+	"syscall"
+	"time"
 )
 
-type procList map[int]struct{}
+// maxExited is the number of exited processes remembered for the ancestry of their descendants
+const maxExited = 1024
+
+// recheckRefreshes is the number of refreshes in which new processes get their command line read again
+const recheckRefreshes = 2
+
+// procList remembers all processes seen alive during the last refresh
+type procList struct {
+	fs    *procfs
+	procs map[int]*proc
+	// effective UID of pspy, whose processes are the only ones with a readable executable unless root
+	uid int
+	// last PID allocated by the kernel during the previous refresh, -1 if unknown
+	lastPid int
+	// levels of ancestors to report for each new process, 0 to disable
+	ancestry int
+	// PIDs to look up after the last allocated one before scanning all of /proc, 0 to disable
+	probe int
+	// refreshes in which new processes get their command line read again, 0 to disable
+	recheck int
+	// processes added since the previous refresh or with rechecks left
+	pending []*proc
+	// how often all known processes get their command line and executable read again, 0 to disable
+	rescan     time.Duration
+	lastRescan time.Time
+	// estimate processes missed from gaps in the PIDs allocated by the kernel
+	countMissed bool
+	// new PIDs seen and allocated in total, counted while countMissed
+	caught, allocated int
+	// recently exited processes by PID, oldest first in exitedOrder
+	exited      map[int]*proc
+	exitedOrder []*proc
+	// processes at the ends of pipes by inode, to find pipelines
+	pipes map[uint64]*pipeEnds
+	// PIDs forked but neither exec'ed nor exited yet, with the proc connector
+	forks map[int]struct{}
+}
+
+type proc struct {
+	event     PSEvent
+	startTime uint64 // clock ticks after boot, 0 if unknown
+	firstSeen time.Time
+	rechecks  int    // refreshes left in which to read the command line again
+	exe       string // executable when last read, empty if unknown
+	pipeline  string // key of the pipeline last reported with this process
+	execSeen  bool   // exec event received, as processes listed or forked may exec before it arrives
+}
 
 type pidProcessor interface {
-	processNewPid(pid int)
+	processNewPid(pid int) PSEvent
+	processExitedPid(pe PSEvent, lifetime time.Duration)
+	processMissed(m Missed)
+	processRecheckedPid(pe PSEvent, execed bool) PSEvent
+	processPipeline(members []PSEvent)
 }
 
-func (pl procList) refresh(p pidProcessor) error {
-	pids, err := getPIDs()
+func newProcList(fs *procfs, ancestry int, probe int, rescan time.Duration) *procList {
+	return &procList{
+		fs:       fs,
+		procs:    make(map[int]*proc),
+		uid:      os.Geteuid(),
+		lastPid:  -1,
+		ancestry: ancestry,
+		probe:    probe,
+		rescan:   rescan,
+		exited:   make(map[int]*proc),
+		pipes:    make(map[uint64]*pipeEnds),
+		forks:    make(map[int]struct{}),
+	}
+}
+
+func (pl *procList) refresh(p pidProcessor) error {
+	// PIDs probed or listed in this refresh, including those that exited meanwhile
+	seen := make(map[int]struct{})
+	// processes found from now on are rechecked from the next refresh on
+	pending := pl.pending
+	pl.pending = nil
+	if pl.probe > 0 {
+		pl.probeNext(seen, p)
+	}
+
+	pids, err := pl.fs.getPIDs()
 	if err != nil {
+		pl.pending = append(pending, pl.pending...)
 		return err
 	}
 
+	lastPid, err := pl.fs.getLastPid()
+	if err != nil {
+		lastPid = -1
+	}
+
+	alive := make(map[int]struct{}, len(pids))
 	for i := len(pids) - 1; i >= 0; i-- {
 		pid := pids[i]
-		_, ok := pl[pid]
+		alive[pid] = struct{}{}
+		seen[pid] = struct{}{}
+		known, ok := pl.procs[pid]
+		if ok && pl.mayBeReused(pid, lastPid) {
+			// the kernel handed out this PID since the last refresh, so the old process is gone
+			if startTime, _ := pl.fs.getStartTime(pid); startTime != known.startTime {
+				pl.exit(pid, p)
+				ok = false
+			}
+		}
 		if !ok {
-			p.processNewPid(pid)
-			pl[pid] = struct{}{}
+			pl.add(pid, p)
+		}
+	}
+
+	exited := make([]int, 0)
+	for pid := range pl.procs {
+		if _, ok := alive[pid]; !ok {
+			exited = append(exited, pid)
 		}
 	}
+	sort.Ints(exited)
+	for _, pid := range exited {
+		pl.exit(pid, p)
+	}
+	pl.recheckPending(pending, p)
+	pl.rescanIfDue(p)
 
+	if pl.countMissed {
+		pl.findMissed(lastPid, seen, p)
+	}
+	pl.lastPid = lastPid
+	pl.prunePipes()
 	return nil
 }
 
-func getPIDs() ([]int, error) {
-	f, err := dirOpen("/proc")
-	if err != nil {
-		return nil, fmt.Errorf("opening proc dir: %v", err)
+// probeNext looks up the PIDs following the last one allocated during the previous refresh.
+// The kernel allocates PIDs in order, so new processes are likely found there long before
+// listing /proc completes. Probing stops after pl.probe PIDs in a row without a new process.
+// PIDs of processes found are added to seen.
+func (pl *procList) probeNext(seen map[int]struct{}, p pidProcessor) {
+	if pl.lastPid < 0 {
+		return
 	}
-	defer f.Close()
 
-	names, err := f.Readdirnames(-1)
-	if err != nil {
-		return nil, fmt.Errorf("reading proc dir: %v", err)
+	var stat syscall.Stat_t
+	for pid, misses := pl.lastPid+1, 0; misses < pl.probe; pid++ {
+		if _, known := pl.procs[pid]; known {
+			misses = 0
+			continue
+		}
+		if pl.fs.fs.Lstat(strconv.Itoa(pid), &stat) != nil {
+			misses++
+			continue
+		}
+		// threads can be looked up like processes but are not listed in /proc
+		if tgid, err := pl.fs.getTgid(pid); err != nil || tgid != pid {
+			misses++
+			continue
+		}
+		misses = 0
+		seen[pid] = struct{}{}
+		pl.add(pid, p)
+	}
+}
+
+// findMissed looks for PIDs the kernel allocated since the previous refresh that were not seen,
+// neither probed nor listed. Processes probed may have exited before the listing.
+// PIDs of threads still running are ignored, but short-lived threads can't be told apart from processes.
+// Refreshes in which allocation wrapped around pid_max are not counted.
+func (pl *procList) findMissed(lastPid int, seen map[int]struct{}, p pidProcessor) {
+	if pl.lastPid < 0 || lastPid <= pl.lastPid {
+		return
 	}
 
-	pids := make([]int, 0)
-	for _, f := range names {
-		pid, err := strconv.Atoi(f)
-		if err != nil || pid <= 0 {
+	gaps := make([]Missed, 0)
+	inGap := false
+	for pid := pl.lastPid + 1; pid <= lastPid; pid++ {
+		if _, ok := seen[pid]; ok {
+			pl.caught++
+			pl.allocated++
+			inGap = false
 			continue
 		}
-		pids = append(pids, pid)
+		var stat syscall.Stat_t
+		if pl.fs.fs.Lstat(strconv.Itoa(pid), &stat) == nil {
+			continue // a thread, which is not listed in /proc but can be looked up
+		}
+		pl.allocated++
+		if !inGap {
+			gaps = append(gaps, Missed{From: pid})
+			inGap = true
+		}
+		gap := &gaps[len(gaps)-1]
+		gap.To = pid
+		gap.Count++
+	}
+
+	for _, gap := range gaps {
+		gap.Caught, gap.Allocated = pl.caught, pl.allocated
+		p.processMissed(gap)
+	}
+}
+
+// recheckPending reads the command lines of processes added before again. They may have
+// changed by exec after fork or become readable once the process was set up.
+func (pl *procList) recheckPending(pending []*proc, p pidProcessor) {
+	for _, known := range pending {
+		if pl.procs[known.event.PID] != known {
+			continue // exited, maybe with its PID reused already
+		}
+		pl.recheckOne(known, p)
+		if known.rechecks--; known.rechecks > 0 {
+			pl.pending = append(pl.pending, known)
+		}
+	}
+}
+
+// rescanIfDue reads the command lines and executables of all known processes again once
+// the rescan interval passed, to find processes that changed their argv or exec'ed.
+func (pl *procList) rescanIfDue(p pidProcessor) {
+	if pl.rescan <= 0 {
+		return
+	}
+	if pl.lastRescan.IsZero() {
+		// everything was just read for the first time
+		pl.lastRescan = now()
+		return
+	}
+	if now().Sub(pl.lastRescan) < pl.rescan {
+		return
+	}
+	pl.lastRescan = now()
+
+	pids := make([]int, 0, len(pl.procs))
+	for pid, known := range pl.procs {
+		if !known.event.KernelThread {
+			pids = append(pids, pid)
+		}
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		pl.recheckOne(pl.procs[pid], p)
+	}
+}
+
+// recheckOne reads the command line and executable of a known process again.
+// A different executable means the process exec'ed.
+func (pl *procList) recheckOne(known *proc, p pidProcessor) {
+	exe := pl.exe(known.event)
+	pl.reread(known, exe, exe != "" && known.exe != "" && exe != known.exe, p)
+}
+
+// reread reads the command line of a known process again, reporting it as exec'ed if execed
+func (pl *procList) reread(known *proc, exe string, execed bool, p pidProcessor) {
+	known.event = p.processRecheckedPid(known.event, execed)
+	if exe != "" {
+		known.exe = exe
+	}
+	pl.trackPipes(known, p)
+}
+
+// exe reads the executable of a process, empty if unknown. Reading it requires permission
+// to ptrace the process, so it is not even tried for other users' processes unless root.
+func (pl *procList) exe(pe PSEvent) string {
+	if pl.uid != 0 && pe.UID != pl.uid {
+		return ""
+	}
+	exe, _ := pl.fs.getExe(pe.PID)
+	return ExePath(exe)
+}
+
+// mayBeReused returns true if the kernel may have allocated pid again since the last refresh.
+// PIDs are allocated cyclically, so only PIDs between the previous and current last PID
+// can have been reused. Without this information, every PID is suspect.
+func (pl *procList) mayBeReused(pid, lastPid int) bool {
+	if pl.lastPid < 0 || lastPid < 0 {
+		return true
+	}
+	if pl.lastPid <= lastPid {
+		return pid > pl.lastPid && pid <= lastPid
+	}
+	// allocation wrapped around pid_max
+	return pid > pl.lastPid || pid <= lastPid
+}
+
+func (pl *procList) add(pid int, p pidProcessor) {
+	if pl.ancestry > 0 {
+		pl.addParents(pid, p)
+	}
+	pl.addOne(pid, p)
+}
+
+// addParents reports unknown ancestors of pid before pid itself, oldest first, so its
+// ancestry is complete. Scans go from the highest PID down, which mostly finds children first.
+func (pl *procList) addParents(pid int, p pidProcessor) {
+	unknown := make([]int, 0)
+	for len(unknown) < pl.ancestry {
+		ppid, err := pl.fs.getPpid(pid)
+		if _, known := pl.procs[ppid]; err != nil || ppid <= 0 || known {
+			break
+		}
+		unknown = append(unknown, ppid)
+		pid = ppid
+	}
+	for i := len(unknown) - 1; i >= 0; i-- {
+		pl.addOne(unknown[i], p)
 	}
-	return pids, nil
 }
 
-type readDirNamesCloser interface {
-	Readdirnames(n int) (names []string, err error)
-	io.Closer
+func (pl *procList) addOne(pid int, p pidProcessor) {
+	pe := p.processNewPid(pid)
+	startTime, _ := pl.fs.getStartTime(pid)
+	known := &proc{event: pe, startTime: startTime, firstSeen: now()}
+	if pl.recheck > 0 || pl.rescan > 0 {
+		known.exe = pl.exe(pe)
+	}
+	pl.procs[pid] = known
+	if pl.recheck > 0 && !pe.KernelThread {
+		known.rechecks = pl.recheck
+		pl.pending = append(pl.pending, known)
+	}
+	// the PID was reused, so an exited process of the same PID is no one's ancestor anymore
+	delete(pl.exited, pid)
+	pl.trackPipes(known, p)
 }
 
-var dirOpen func(string) (readDirNamesCloser, error) = func(s string) (readDirNamesCloser, error) {
-	return os.Open(s)
+// ancestors returns up to levels ancestors of a process with the given parent, parent first.
+// Ancestors that exited are included as long as they are remembered.
+func (pl *procList) ancestors(ppid int, levels int) []Ancestor {
+	chain := make([]Ancestor, 0)
+	for len(chain) < levels && ppid > 0 {
+		known, ok := pl.procs[ppid]
+		exited := false
+		if !ok {
+			if known, ok = pl.exited[ppid]; !ok {
+				break
+			}
+			exited = true
+		}
+		pe := known.event
+		chain = append(chain, Ancestor{PID: pe.PID, UID: pe.UID, CMD: pe.CMD, Argv: pe.Argv, Exited: exited})
+		if pe.PPID == ppid {
+			break
+		}
+		ppid = pe.PPID
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return chain
+}
+
+func (pl *procList) exit(pid int, p pidProcessor) {
+	known := pl.procs[pid]
+	delete(pl.procs, pid)
+	if pl.ancestry > 0 {
+		pl.remember(pid, known)
+	}
+
+	started := known.firstSeen
+	if t, err := pl.fs.startTimeToTime(known.startTime); err == nil {
+		started = t
+	}
+	p.processExitedPid(known.event, now().Sub(started))
+}
+
+// remember keeps an exited process for the ancestry of its descendants, forgetting the oldest one if needed
+func (pl *procList) remember(pid int, known *proc) {
+	if len(pl.exitedOrder) >= maxExited {
+		oldest := pl.exitedOrder[0]
+		pl.exitedOrder = pl.exitedOrder[1:]
+		// unless its PID was reused and exited again since
+		if pl.exited[oldest.event.PID] == oldest {
+			delete(pl.exited, oldest.event.PID)
+		}
+	}
+	pl.exited[pid] = known
+	pl.exitedOrder = append(pl.exitedOrder, known)
 }
@@ -4,187 +4,516 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
-// GetPIDs
+type mockPidProcessor struct {
+	t         *testing.T
+	pids      []int
+	exited    []int
+	missed    []Missed
+	rechecked []int
+	execed    []int
+	pipelines [][]int
+}
+
+func (m *mockPidProcessor) processNewPid(pid int) PSEvent {
+	if testing.Verbose() {
+		m.t.Logf("proc %d processed", pid)
+	}
+	m.pids = append(m.pids, pid)
+	return PSEvent{PID: pid}
+}
+
+func (m *mockPidProcessor) processExitedPid(pe PSEvent, lifetime time.Duration) {
+	if testing.Verbose() {
+		m.t.Logf("proc %d exited after %v", pe.PID, lifetime)
+	}
+	m.exited = append(m.exited, pe.PID)
+}
+
+func (m *mockPidProcessor) processMissed(missed Missed) {
+	m.missed = append(m.missed, missed)
+}
+
+func (m *mockPidProcessor) processRecheckedPid(pe PSEvent, execed bool) PSEvent {
+	m.rechecked = append(m.rechecked, pe.PID)
+	if execed {
+		m.execed = append(m.execed, pe.PID)
+	}
+	return pe
+}
+
+func (m *mockPidProcessor) processPipeline(members []PSEvent) {
+	pids := make([]int, len(members))
+	for i, pe := range members {
+		pids[i] = pe.PID
+	}
+	m.pipelines = append(m.pipelines, pids)
+}
 
-func TestGetPIDs(t *testing.T) {
+func TestRefresh(t *testing.T) {
 	tests := []struct {
-		name        string
-		proc        []string
-		procErrOpen error
-		procErrRead error
-		pids        []int
-		err         string
+		name          string
+		known         map[int]uint64 // pid -> start time
+		lastPid       int
+		newPids       []int
+		startTimes    map[int]uint64
+		loadavg       string
+		foreign       bool // procfs of another PID namespace than loadavg
+		pidsProcessed []int
+		pidsExited    []int
+		lastPidAfter  int
 	}{
 		{
-			name:        "numbers-only",
-			proc:        []string{"42", "somedir"},
-			procErrOpen: nil,
-			procErrRead: nil,
-			pids:        []int{42},
-			err:         "",
+			name:          "nominal",
+			known:         map[int]uint64{},
+			lastPid:       -1,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 20, 3: 30},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n",
+			pidsProcessed: []int{3, 2, 1},
+			pidsExited:    []int{},
+			lastPidAfter:  3,
 		},
 		{
-			name:        "multiple-entries",
-			proc:        []string{"42", "13"},
-			procErrOpen: nil,
-			procErrRead: nil,
-			pids:        []int{42, 13},
-			err:         "",
+			name:          "merge",
+			known:         map[int]uint64{1: 10},
+			lastPid:       1,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 20, 3: 30},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n",
+			pidsProcessed: []int{3, 2},
+			pidsExited:    []int{},
+			lastPidAfter:  3,
 		},
 		{
-			name:        "ignores-lte-0",
-			proc:        []string{"0", "-1"},
-			procErrOpen: nil,
-			procErrRead: nil,
-			pids:        []int{},
-			err:         "",
+			name:          "nothing-new",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 20, 3: 30},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n",
+			pidsProcessed: []int{},
+			pidsExited:    []int{},
+			lastPidAfter:  3,
 		},
 		{
-			name:        "empty-procfs",
-			proc:        []string{},
-			procErrOpen: nil,
-			procErrRead: nil,
-			pids:        []int{},
-			err:         "",
+			name:          "exited",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{2},
+			startTimes:    map[int]uint64{2: 20},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n",
+			pidsProcessed: []int{},
+			pidsExited:    []int{1, 3},
+			lastPidAfter:  3,
 		},
 		{
-			name:        "handle-open-error",
-			proc:        []string{},
-			procErrOpen: errors.New("file-system-error"),
-			procErrRead: nil,
-			pids:        nil,
-			err:         "opening proc dir: file-system-error",
+			name:          "reused",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 99, 3: 30},
+			loadavg:       "0.00 0.01 0.05 1/123 2\n", // wrapped around
+			pidsProcessed: []int{2},
+			pidsExited:    []int{2},
+			lastPidAfter:  2,
 		},
 		{
-			name:        "handle-read-error",
-			proc:        []string{},
-			procErrOpen: nil,
-			procErrRead: errors.New("file-system-error"),
-			pids:        nil,
-			err:         "reading proc dir: file-system-error",
+			name:          "not-reallocated",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 11, 2: 21, 3: 31},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n",
+			pidsProcessed: []int{},
+			pidsExited:    []int{},
+			lastPidAfter:  3,
+		},
+		{
+			name:          "reused-no-loadavg",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 20, 3: 31},
+			loadavg:       "corrupt",
+			pidsProcessed: []int{3},
+			pidsExited:    []int{3},
+			lastPidAfter:  -1,
+		},
+		{
+			name:          "reused-other-namespace",
+			known:         map[int]uint64{1: 10, 2: 20, 3: 30},
+			lastPid:       3,
+			newPids:       []int{1, 2, 3},
+			startTimes:    map[int]uint64{1: 10, 2: 20, 3: 31},
+			loadavg:       "0.00 0.01 0.05 1/123 3\n", // of our own namespace
+			foreign:       true,
+			pidsProcessed: []int{3},
+			pidsExited:    []int{3},
+			lastPidAfter:  -1,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer mockDir("/proc", tt.proc, tt.procErrRead, tt.procErrOpen, t)()
-			pids, err := getPIDs()
-			if !reflect.DeepEqual(pids, tt.pids) {
-				t.Errorf("Wrong pids returned: got %v but want %v", pids, tt.pids)
+			fs := newMockFS(t)
+			fs.mockPidList(tt.newPids)
+			fs.mockFile("loadavg", []byte(tt.loadavg), nil, nil)
+			for pid, startTime := range tt.startTimes {
+				fs.mockPidStat(pid, statWithStartTime(pid, startTime), nil, nil)
 			}
-			if (err != nil || tt.err != "") && fmt.Sprintf("%v", err) != tt.err {
-				t.Errorf("Wrong error returned: got %v but want %s", err, tt.err)
+
+			procfs := newProcfs(fs)
+			procfs.foreign = tt.foreign
+			pl := newProcList(procfs, 0, 0, 0)
+			pl.lastPid = tt.lastPid
+			for pid, startTime := range tt.known {
+				pl.procs[pid] = &proc{event: PSEvent{PID: pid}, startTime: startTime}
+			}
+
+			m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+			pl.refresh(m)
+
+			if !reflect.DeepEqual(m.pids, tt.pidsProcessed) {
+				t.Errorf("Unexpected pids got processed: got %v but want %v", m.pids, tt.pidsProcessed)
+			}
+			if !reflect.DeepEqual(m.exited, tt.pidsExited) {
+				t.Errorf("Unexpected pids exited: got %v but want %v", m.exited, tt.pidsExited)
+			}
+			known := make([]int, 0)
+			for pid, p := range pl.procs {
+				known = append(known, pid)
+				startTime, ok := tt.known[pid]
+				if !ok || contains(tt.pidsProcessed, pid) {
+					startTime = tt.startTimes[pid]
+				}
+				if p.startTime != startTime {
+					t.Errorf("Wrong start time stored for pid %d: got %d but want %d", pid, p.startTime, startTime)
+				}
+			}
+			sort.Ints(known)
+			if !reflect.DeepEqual(known, sortedCopy(tt.newPids)) {
+				t.Errorf("Unexpected pids stored in procList: got %v but want %v", known, tt.newPids)
+			}
+			if pl.lastPid != tt.lastPidAfter {
+				t.Errorf("Wrong last pid: got %d but want %d", pl.lastPid, tt.lastPidAfter)
 			}
 		})
 	}
 }
 
-type MockDir struct {
-	names []string
-	err   error
+func TestFindMissed(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockPidList([]int{1, 12, 16})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 17\n"), nil, nil)
+	for _, pid := range []int{1, 12, 16} {
+		fs.mockPidStat(pid, statWithStartTime(pid, 10), nil, nil)
+	}
+	fs.mockPidUid(14, 0, nil) // a thread
+
+	pl := newProcList(newProcfs(fs), 0, 0, 0)
+	pl.countMissed = true
+	pl.lastPid = 9
+	pl.procs[1] = &proc{event: PSEvent{PID: 1}, startTime: 10}
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+	pl.refresh(m)
+
+	expected := []Missed{
+		{From: 10, To: 11, Count: 2, Caught: 2, Allocated: 7},
+		{From: 13, To: 15, Count: 2, Caught: 2, Allocated: 7}, // thread 14 does not end the gap
+		{From: 17, To: 17, Count: 1, Caught: 2, Allocated: 7},
+	}
+	if !reflect.DeepEqual(m.missed, expected) {
+		t.Errorf("Wrong missed pids: got %+v but want %+v", m.missed, expected)
+	}
+
+	// no accounting when allocation wrapped around
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 5\n"), nil, nil)
+	m.missed = nil
+	pl.refresh(m)
+	if m.missed != nil || pl.allocated != 7 {
+		t.Errorf("Counted missed pids after wrap around: %+v, %d allocated", m.missed, pl.allocated)
+	}
+
+	pl.countMissed = false
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 9\n"), nil, nil)
+	pl.refresh(m)
+	if m.missed != nil {
+		t.Errorf("Counted missed pids while disabled: %+v", m.missed)
+	}
 }
 
-func (f *MockDir) Close() error {
-	return nil
+// exitingPidProcessor lets processes exit right after they were processed
+type exitingPidProcessor struct {
+	*mockPidProcessor
+	fs   *mockFS
+	exit map[int]bool
 }
 
-func min(a, b int) int {
-	if a > b {
-		return b
+func (m *exitingPidProcessor) processNewPid(pid int) PSEvent {
+	if m.exit[pid] {
+		delete(m.fs.stats, fmt.Sprintf("%d", pid))
 	}
-	return a
+	return m.mockPidProcessor.processNewPid(pid)
 }
 
-func (f *MockDir) Readdirnames(n int) (names []string, err error) {
-	if n < 0 {
-		return f.names, f.err
+func TestFindMissedProbed(t *testing.T) {
+	fs := newMockFS(t)
+	// 11 is probed and exits before /proc is listed
+	fs.mockPidList([]int{1, 12})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 12\n"), nil, nil)
+	for _, pid := range []int{1, 11, 12} {
+		fs.mockPidUid(pid, 0, nil)
+		fs.mockPidStat(pid, statWithStartTime(pid, 10), nil, nil)
+		fs.mockFile(fmt.Sprintf("%d/status", pid), []byte(fmt.Sprintf("Name:\tx\nTgid:\t%d\n", pid)), nil, nil)
+	}
+
+	pl := newProcList(newProcfs(fs), 0, 3, 0)
+	pl.countMissed = true
+	pl.lastPid = 10
+	pl.procs[1] = &proc{event: PSEvent{PID: 1}, startTime: 10}
+	m := &exitingPidProcessor{mockPidProcessor: &mockPidProcessor{t: t}, fs: fs, exit: map[int]bool{11: true}}
+	if err := pl.refresh(m); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(m.pids, []int{11, 12}) || !reflect.DeepEqual(m.exited, []int{11}) {
+		t.Errorf("Wrong pids processed %v or exited %v", m.pids, m.exited)
+	}
+	if m.missed != nil || pl.caught != 2 || pl.allocated != 2 {
+		t.Errorf("Probed pid counted as missed: %+v, %d of %d caught", m.missed, pl.caught, pl.allocated)
 	}
-	return f.names[:min(n, len(f.names))], f.err
 }
 
-// Hook/chain a mocked file into the "open" variable
-func mockDir(name string, names []string, errRead error, errOpen error, t *testing.T) func() {
-	oldopen := dirOpen
-	dirOpen = func(n string) (readDirNamesCloser, error) {
-		if name == n {
-			if testing.Verbose() {
-				t.Logf("opening mocked dir: %s", n)
-			}
-			return &MockDir{
-				names: names,
-				err:   errRead,
-			}, errOpen
-		}
-		return oldopen(n)
+func TestProbeNext(t *testing.T) {
+	fs := newMockFS(t)
+	// 11 is known, 12 exited already, 13 is a thread of 11, 18 comes after too many misses
+	fs.mockPidList([]int{1, 11, 14, 18})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 18\n"), nil, nil)
+	for pid, tgid := range map[int]int{1: 1, 11: 11, 13: 11, 14: 14, 18: 18} {
+		fs.mockPidUid(pid, 0, nil)
+		fs.mockPidStat(pid, statWithStartTime(pid, 10), nil, nil)
+		fs.mockFile(fmt.Sprintf("%d/status", pid), []byte(fmt.Sprintf("Name:\tx\nUmask:\t0022\nState:\tS (sleeping)\nTgid:\t%d\n", tgid)), nil, nil)
 	}
-	return func() {
-		dirOpen = oldopen
+
+	pl := newProcList(newProcfs(fs), 0, 3, 0)
+	pl.lastPid = 9
+	pl.procs[1] = &proc{event: PSEvent{PID: 1}, startTime: 10}
+	pl.procs[11] = &proc{event: PSEvent{PID: 11}, startTime: 10}
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	pl.probeNext(map[int]struct{}{}, m)
+	if !reflect.DeepEqual(m.pids, []int{14}) {
+		t.Errorf("Wrong pids probed: got %v but want %v", m.pids, []int{14})
+	}
+
+	// the full scan finds the rest
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.pids, []int{14, 18}) {
+		t.Errorf("Wrong pids processed: got %v but want %v", m.pids, []int{14, 18})
+	}
+
+	// nothing to probe from before the last pid is known
+	pl = newProcList(newProcfs(fs), 0, 2, 0)
+	m = &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+	pl.probeNext(map[int]struct{}{}, m)
+	if len(m.pids) != 0 {
+		t.Errorf("Probed without last pid: %v", m.pids)
 	}
 }
 
-type mockPidProcessor struct {
-	t    *testing.T
-	pids []int
+func TestRecheckPending(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockPidList([]int{1, 2})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 2\n"), nil, nil)
+	pl := newProcList(newProcfs(fs), 0, 0, 0)
+	pl.recheck = recheckRefreshes
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	pl.refresh(m)
+	if len(m.rechecked) != 0 {
+		t.Errorf("Rechecked new pids right away: %v", m.rechecked)
+	}
+	fs.mockPidList([]int{1, 2, 3})
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.rechecked, []int{2, 1}) {
+		t.Errorf("Wrong pids rechecked: got %v but want %v", m.rechecked, []int{2, 1})
+	}
+	// 2 exited
+	fs.mockPidList([]int{1, 3})
+	m.rechecked = nil
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.rechecked, []int{3, 1}) {
+		t.Errorf("Wrong pids rechecked: got %v but want %v", m.rechecked, []int{3, 1})
+	}
+	m.rechecked = nil
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.rechecked, []int{3}) {
+		t.Errorf("Wrong pids rechecked: got %v but want %v", m.rechecked, []int{3})
+	}
+	pl.refresh(m)
+	if len(pl.pending) != 0 {
+		t.Errorf("Pending pids left: %d", len(pl.pending))
+	}
+
+	// nor when found by probing
+	fs.mockPidList([]int{1, 3, 4})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 4\n"), nil, nil)
+	fs.mockPidUid(4, 0, nil)
+	fs.mockFile("4/status", []byte("Name:\tx\nUmask:\t0022\nState:\tS (sleeping)\nTgid:\t4\n"), nil, nil)
+	pl.probe = 2
+	m.pids, m.rechecked = nil, nil
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.pids, []int{4}) || len(m.rechecked) != 0 {
+		t.Errorf("Rechecked pids probed right away: processed %v, rechecked %v", m.pids, m.rechecked)
+	}
 }
 
-func (m *mockPidProcessor) processNewPid(pid int) {
-	if testing.Verbose() {
-		m.t.Logf("proc %d processed", pid)
+func TestRescan(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockPidList([]int{1, 2, 3})
+	fs.mockFile("loadavg", []byte("0.00 0.01 0.05 1/123 3\n"), nil, nil)
+	fs.mockLink("1/exe", "/sbin/init")
+	fs.mockLink("2/exe", "/bin/bash")
+	fs.mockLink("3/exe", "/usr/sbin/cron")
+	pl := newProcList(newProcfs(fs), 0, 0, time.Second)
+	pl.uid = 0
+	m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+
+	clock := time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)
+	oldNow := now
+	now = func() time.Time { return clock }
+	defer func() { now = oldNow }()
+	pl.refresh(m)
+	clock = clock.Add(500 * time.Millisecond)
+	pl.refresh(m)
+	if len(m.rechecked) != 0 {
+		t.Errorf("Rescanned too early: %v", m.rechecked)
+	}
+
+	clock = clock.Add(500 * time.Millisecond)
+	fs.mockLink("2/exe", "/usr/bin/sleep")
+	fs.mockLink("3/exe", "/usr/sbin/cron (deleted)") // upgraded, not exec'ed
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.rechecked, []int{1, 2, 3}) || !reflect.DeepEqual(m.execed, []int{2}) {
+		t.Errorf("Wrong rescan: rechecked %v and exec'ed %v", m.rechecked, m.execed)
+	}
+
+	// executables of other users' processes are unreadable without root
+	pl.uid = 1000
+	clock = clock.Add(time.Second)
+	fs.mockLink("2/exe", "/bin/bash")
+	m.rechecked, m.execed = nil, nil
+	pl.refresh(m)
+	if !reflect.DeepEqual(m.rechecked, []int{1, 2, 3}) || len(m.execed) != 0 {
+		t.Errorf("Wrong rescan without root: rechecked %v and exec'ed %v", m.rechecked, m.execed)
 	}
-	m.pids = append(m.pids, pid)
 }
 
-var unit = struct{}{}
+func TestGetTgid(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockFile("5/status", []byte("Name:\tx\nTgid:\t3\nNgid:\t0\n"), nil, nil)
+	fs.mockFile("6/status", []byte("Name:\tx\n"), nil, nil)
+	p := newProcfs(fs)
 
-func TestRefresh(t *testing.T) {
-	tests := []struct {
-		name          string
-		pl            procList
-		newPids       []int
-		plAfter       procList
-		pidsProcessed []int
-	}{
-		{
-			name:          "nominal",
-			pl:            procList{},
-			newPids:       []int{1, 2, 3},
-			plAfter:       procList{1: unit, 2: unit, 3: unit},
-			pidsProcessed: []int{3, 2, 1},
-		},
-		{
-			name:          "merge",
-			pl:            procList{1: unit},
-			newPids:       []int{1, 2, 3},
-			plAfter:       procList{1: unit, 2: unit, 3: unit},
-			pidsProcessed: []int{3, 2},
-		},
-		{
-			name:          "nothing-new",
-			pl:            procList{1: unit, 2: unit, 3: unit},
-			newPids:       []int{1, 2, 3},
-			plAfter:       procList{1: unit, 2: unit, 3: unit},
-			pidsProcessed: []int{},
-		},
+	if tgid, err := p.getTgid(5); err != nil || tgid != 3 {
+		t.Errorf("Wrong tgid: got %d, %v but want 3", tgid, err)
+	}
+	if _, err := p.getTgid(6); err == nil || err.Error() != "corrupt status file" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	if _, err := p.getTgid(7); err == nil {
+		t.Errorf("Expected error for missing status file")
 	}
+}
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			defer mockPidList(tt.newPids, t)()
+func TestRefreshLifetime(t *testing.T) {
+	start := time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)
+	defer mockNow(start)()
+	fs := newMockFS(t)
+	fs.mockPidList([]int{})
 
-			m := &mockPidProcessor{t, []int{}}
-			tt.pl.refresh(m)
+	pl := newProcList(newProcfs(fs), 0, 0, 0)
+	pl.procs[7] = &proc{event: PSEvent{PID: 7, CMD: "sleep 3"}, startTime: 0, firstSeen: start.Add(-3 * time.Second)}
+	results := make(chan PSEvent, 1)
+	pl.refresh(&PSScanner{procfs: pl.fs, eventCh: results})
 
-			if !reflect.DeepEqual(m.pids, tt.pidsProcessed) {
-				t.Errorf("Unexpected pids got processed: got %v but want %v", m.pids, tt.pidsProcessed)
-			}
-			if !reflect.DeepEqual(tt.pl, tt.plAfter) {
-				t.Errorf("Unexpected pids stored in procList: got %v but want %v", tt.pl, tt.plAfter)
+	e := <-results
+	expected := PSEvent{Kind: KindExit, PID: 7, CMD: "sleep 3", Lifetime: 3 * time.Second, Time: start}
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Wrong exit event: got %#v but want %#v", e, expected)
+	}
+}
+
+func TestRefreshAncestry(t *testing.T) {
+	defer mockNow(time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC))()
+	fs := newMockFS(t)
+	mockProc := func(pid, ppid int, cmd string) {
+		fs.mockPidStat(pid, []byte(fmt.Sprintf("%d (x) S %d 0 0\n", pid, ppid)), nil, nil)
+		fs.mockPidCmdLine(pid, []byte(cmd), nil, nil)
+		fs.mockPidUid(pid, 0, nil)
+	}
+	mockProc(1, 0, "init")
+	mockProc(20, 1, "cron")
+	mockProc(22, 20, "python3\x00reset.py")
+	mockProc(23, 22, "sh\x00-c\x00echo x | passwd")
+	fs.mockPidList([]int{1, 20, 22, 23})
+
+	results := make(chan PSEvent, 10)
+	pss := NewPSScanner(false, 2, 0, 0, false, 2048, Enrichment{}, fs)
+	pss.eventCh = results
+	pl := newProcList(pss.procfs, 2, 0, 0)
+	pss.procs = pl
+	pl.refresh(pss)
+
+	// parents are reported before their children, as far as the ancestry goes
+	expectEvents(t, results, []string{
+		"UID=0     PID=20     PPID=1      | cron",
+		"UID=0     PID=22     PPID=20     | python3 reset.py <- [20] cron",
+		"UID=0     PID=23     PPID=22     | sh -c 'echo x | passwd' <- [22] python3 reset.py <- [20] cron",
+		"UID=0     PID=1      PPID=0      | init",
+	})
+
+	// exited ancestors are remembered
+	fs.mockPidList([]int{1, 20, 23})
+	pl.refresh(pss)
+	expectEvents(t, results, []string{"UID=0     PID=22     PPID=20     | python3 reset.py (lifetime ~0s)"})
+	mockProc(24, 23, "passwd")
+	fs.mockPidList([]int{1, 20, 23, 24})
+	pl.refresh(pss)
+	expectEvents(t, results, []string{"UID=0     PID=24     PPID=23     | passwd <- [23] sh -c 'echo x | passwd' <- [22 exited] python3 reset.py"})
+}
+
+func expectEvents(t *testing.T, results chan PSEvent, expected []string) {
+	for _, e := range expected {
+		select {
+		case pe := <-results:
+			if pe.String() != e {
+				t.Errorf("Wrong event: got %s but want %s", pe, e)
 			}
-		})
+		default:
+			t.Fatalf("Missing event: %s", e)
+		}
+	}
+}
+
+func TestRememberExited(t *testing.T) {
+	pl := newProcList(newProcfs(newMockFS(t)), 1, 0, 0)
+	for pid := 1; pid <= maxExited+1; pid++ {
+		pl.remember(pid, &proc{event: PSEvent{PID: pid}})
+	}
+	if len(pl.exited) != maxExited {
+		t.Errorf("Wrong number of exited processes remembered: %d", len(pl.exited))
+	}
+	if _, ok := pl.exited[1]; ok {
+		t.Errorf("Oldest exited process not forgotten")
+	}
+	if a := pl.ancestors(maxExited+1, 1); len(a) != 1 || !a[0].Exited {
+		t.Errorf("Wrong ancestors: %+v", a)
 	}
 }
 
@@ -208,9 +537,11 @@ func TestRefreshFail(t *testing.T) {
 		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
-			defer mockDir("/proc", []string{}, tt.errRead, tt.errOpen, t)()
-			m := &mockPidProcessor{t, []int{}}
-			pl := procList{1: unit}
+			fs := newMockFS(t)
+			fs.mockDir(".", []string{}, tt.errRead, tt.errOpen)
+			m := &mockPidProcessor{t: t, pids: []int{}, exited: []int{}}
+			pl := newProcList(newProcfs(fs), 0, 0, 0)
+			pl.procs[1] = &proc{}
 			err := pl.refresh(m)
 			if err == nil {
 				t.Errorf("Expected an error")
@@ -224,10 +555,29 @@ func TestRefreshFail(t *testing.T) {
 	}
 }
 
-func mockPidList(pids []int, t *testing.T) func() {
-	dirs := make([]string, 0)
-	for _, pid := range pids {
-		dirs = append(dirs, fmt.Sprintf("%d", pid))
+func statWithStartTime(pid int, startTime uint64) []byte {
+	return []byte(fmt.Sprintf("%d (cmd) S 1 %s %d 0\n", pid, strings.Repeat("0 ", 17), startTime))
+}
+
+func contains(pids []int, pid int) bool {
+	for _, p := range pids {
+		if p == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedCopy(pids []int) []int {
+	c := append([]int{}, pids...)
+	sort.Ints(c)
+	return c
+}
+
+func mockNow(t time.Time) func() {
+	oldNow := now
+	now = func() time.Time { return t }
+	return func() {
+		now = oldNow
 	}
-	return mockDir("/proc", dirs, nil, nil, t)
 }
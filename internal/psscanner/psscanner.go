@@ -1,58 +1,316 @@
 package psscanner
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
-	"io"
-	"os"
-	"regexp"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type PSScanner struct {
+	*procfs
+	procs        *procList
 	enablePpid   bool
+	ancestry     int
+	probe        int
+	rescan       time.Duration
+	recheck      bool
+	mu           sync.Mutex // guards countMissed, which may change while running
+	countMissed  bool
 	eventCh      chan<- PSEvent
+	errCh        chan<- error
 	maxCmdLength int
+	enrichment   Enrichment
+}
+
+// EventKind tells what happened to the process of a PSEvent
+type EventKind int
+
+const (
+	// KindNew is a process seen for the first time
+	KindNew EventKind = iota
+	// KindExit is a process that disappeared from procfs
+	KindExit
+	// KindMissed reports PIDs allocated by the kernel that were never seen
+	KindMissed
+	// KindChanged is a known process whose command line changed, e.g., by setproctitle
+	KindChanged
+	// KindExec is a known process that executed another program, e.g., after fork
+	KindExec
+	// KindPipeline links processes whose standard input and output are connected by pipes
+	KindPipeline
+)
+
+const (
+	// UnknownCMD is the command of processes whose command line and name could not be read
+	UnknownCMD = "???"
+	// attempts to read a command line while it is empty, as it is for processes being set up
+	cmdLineAttempts   = 3
+	cmdLineRetryDelay = 2 * time.Millisecond
+	// flag of kernel threads in /proc/<pid>/stat
+	pfKthread = 0x00200000
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case KindNew:
+		return "CMD"
+	case KindExit:
+		return "EXIT"
+	case KindMissed:
+		return "MISSED"
+	case KindChanged:
+		return "CHANGED"
+	case KindExec:
+		return "EXEC"
+	case KindPipeline:
+		return "PIPELINE"
+	default:
+		return "UNKNOWN"
+	}
 }
 
 type PSEvent struct {
+	Kind EventKind
 	UID  int
 	PID  int
 	PPID int
-	CMD  string
+	// arguments joined by spaces, ambiguous if they contain spaces themselves
+	CMD string
+	// arguments as passed to execve, nil if the command line could not be read.
+	// CMD is then the name of the executable in brackets, as in ps, if known.
+	Argv []string
+	// set for threads of the kernel, which have no command line
+	KernelThread bool
+	// approximate time the process was alive, only set for KindExit
+	Lifetime time.Duration
+	// when the event was captured
+	Time time.Time
+	// parent, grandparent and so on, as far as known and configured
+	Ancestors []Ancestor
+	// PIDs that were never seen, only set for KindMissed
+	Missed *Missed
+	// command reported before, only set for KindChanged and KindExec
+	Previous string
+	// processes connected by pipes, the first writing to the second and so on,
+	// only set for KindPipeline. CMD is then their commands joined by " | ".
+	Pipeline []PipelineMember
+
+	// optional details, see Enrichment
+	Exe       string
+	Cwd       string
+	Comm      string
+	StartTime time.Time
+	UIDs      *IDs
+	GIDs      *IDs
+	Cgroup    *Cgroup
+	NS        *Namespaces
+	Session   *Session
+	Pipes     *Pipes
+	Env       map[string]string // filtered by Enrichment.EnvAllow and EnvDeny
+}
+
+// Missed is a range of PIDs the kernel allocated between two scans that pspy never saw,
+// i.e., processes that lived too short to be caught. PIDs also go to threads, so short-lived
+// threads count as missed processes too. Caught and Allocated are running totals since start.
+type Missed struct {
+	From      int `json:"from"`
+	To        int `json:"to"`
+	Count     int `json:"count"`
+	Caught    int `json:"caught"`
+	Allocated int `json:"allocated"`
+}
+
+// CatchRate is the share of new processes seen since start
+func (m Missed) CatchRate() float64 {
+	if m.Allocated == 0 {
+		return 1
+	}
+	return float64(m.Caught) / float64(m.Allocated)
 }
 
+func (m Missed) String() string {
+	what := "processes"
+	if m.Count == 1 {
+		what = "process"
+	}
+	between := fmt.Sprintf("between PID %d and %d", m.From, m.To)
+	if m.From == m.To {
+		between = fmt.Sprintf("with PID %d", m.From)
+	}
+	return fmt.Sprintf("%d %s missed %s (caught %.1f%% of %d so far)", m.Count, what, between, 100*m.CatchRate(), m.Allocated)
+}
+
+// Ancestor is a process that started a process of a PSEvent, directly or indirectly
+type Ancestor struct {
+	PID  int      `json:"pid"`
+	UID  int      `json:"uid"`
+	CMD  string   `json:"cmd"`
+	Argv []string `json:"argv,omitempty"`
+	// the ancestor was seen exiting before the event
+	Exited bool `json:"exited,omitempty"`
+}
+
+// maxAncestorCmd is the length at which ancestor commands are cut off when printed
+const maxAncestorCmd = 80
+
+func (a Ancestor) String() string {
+	cmd := a.CMD
+	if a.Argv != nil {
+		cmd = ShellQuote(a.Argv)
+	}
+	if len(cmd) > maxAncestorCmd {
+		cmd = cmd[:maxAncestorCmd] + "..."
+	}
+	if a.Exited {
+		return fmt.Sprintf("[%d exited] %s", a.PID, cmd)
+	}
+	return fmt.Sprintf("[%d] %s", a.PID, cmd)
+}
+
+// String renders the event on a single line. New processes are followed by their ancestors.
 func (evt PSEvent) String() string {
+	return evt.format(false)
+}
+
+// TreeString renders the event for a tree of processes, with the command indented
+// beneath the ancestors instead of followed by them
+func (evt PSEvent) TreeString() string {
+	return evt.format(true)
+}
+
+func (evt PSEvent) format(tree bool) string {
+	if evt.Kind == KindMissed && evt.Missed != nil {
+		return evt.Missed.String()
+	}
+
 	uid := strconv.Itoa(evt.UID)
 	if evt.UID == -1 {
 		uid = "???"
 	}
 
+	cmd := evt.Command()
+	if evt.KernelThread {
+		cmd += " (kernel thread)"
+	}
+	switch {
+	case evt.Kind == KindExit:
+		cmd = fmt.Sprintf("%s (lifetime ~%v)", cmd, evt.Lifetime.Round(time.Millisecond))
+	case evt.Kind == KindChanged || evt.Kind == KindExec:
+		cmd = fmt.Sprintf("%s (was %s)", cmd, evt.Previous)
+	case evt.Kind == KindPipeline:
+		pids := make([]string, len(evt.Pipeline))
+		for i, m := range evt.Pipeline {
+			pids[i] = strconv.Itoa(m.PID)
+		}
+		cmd = fmt.Sprintf("%s (pids %s)", cmd, strings.Join(pids, ", "))
+	case tree && len(evt.Ancestors) > 0:
+		cmd = strings.Repeat("   ", len(evt.Ancestors)-1) + "\\_ " + cmd
+	case len(evt.Ancestors) > 0:
+		for _, a := range evt.Ancestors {
+			cmd += " <- " + a.String()
+		}
+	}
+
 	if evt.PPID == -1 {
-		return fmt.Sprintf("UID=%-5s PID=%-6d | %s", uid, evt.PID, evt.CMD)
+		return fmt.Sprintf("UID=%-5s PID=%-6d %s| %s", uid, evt.PID, evt.details(), cmd)
 	}
 
 	return fmt.Sprintf(
-		"UID=%-5s PID=%-6d PPID=%-6d | %s", uid, evt.PID, evt.PPID, evt.CMD)
+		"UID=%-5s PID=%-6d PPID=%-6d %s| %s", uid, evt.PID, evt.PPID, evt.details(), cmd)
 }
 
-var (
-	// identify ppid in stat file
-	ppidRegex, _ = regexp.Compile("\\d+ \\(.*\\) [[:alpha:]] (\\d+)")
-	// hook for testing, directly use Lstat syscall as os.Lstat hides data in Sys member
-	lstat = syscall.Lstat
-	// hook for testing
-	open = func(s string) (io.ReadCloser, error) {
-		return os.Open(s)
+// formatEnv renders environment variables sorted by name, quoting values like arguments
+func formatEnv(env map[string]string) string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vars := make([]string, len(names))
+	for i, name := range names {
+		vars[i] = name + "=" + quoteArg(env[name])
+	}
+	return strings.Join(vars, " ")
+}
+
+// Command renders the command line unambiguously if it is known and CMD otherwise
+func (evt PSEvent) Command() string {
+	if evt.Argv != nil {
+		return ShellQuote(evt.Argv)
+	}
+	return evt.CMD
+}
+
+// details renders the optional details that are set, each followed by a space
+func (evt PSEvent) details() string {
+	var b strings.Builder
+	if evt.UIDs != nil {
+		fmt.Fprintf(&b, "UIDS=%s ", evt.UIDs)
+	}
+	if evt.GIDs != nil {
+		fmt.Fprintf(&b, "GIDS=%s ", evt.GIDs)
+	}
+	if !evt.StartTime.IsZero() {
+		fmt.Fprintf(&b, "START=%s ", evt.StartTime.Format("2006-01-02T15:04:05.00"))
+	}
+	if evt.Comm != "" {
+		fmt.Fprintf(&b, "COMM=%s ", evt.Comm)
+	}
+	if evt.Exe != "" {
+		fmt.Fprintf(&b, "EXE=%s ", evt.Exe)
+	}
+	if evt.Cwd != "" {
+		fmt.Fprintf(&b, "CWD=%s ", evt.Cwd)
+	}
+	if evt.Cgroup != nil {
+		fmt.Fprintf(&b, "%s ", evt.Cgroup)
+	}
+	if evt.NS != nil {
+		fmt.Fprintf(&b, "NS=%s ", evt.NS)
+	}
+	if evt.Session != nil {
+		fmt.Fprintf(&b, "%s ", evt.Session)
+	}
+	if evt.Pipes != nil {
+		fmt.Fprintf(&b, "%s ", evt.Pipes)
+	}
+	if len(evt.Env) > 0 {
+		fmt.Fprintf(&b, "ENV={%s} ", formatEnv(evt.Env))
 	}
+	return b.String()
+}
+
+var (
+	// hooks for testing
+	now   = time.Now
+	sleep = time.Sleep
 )
 
-func NewPSScanner(ppid bool, cmdLength int) *PSScanner {
+// NewPSScanner creates a scanner for the procfs in fs. With ancestry > 0, new processes
+// come with up to that many ancestors and their ppids are read even if ppid is false.
+// With probe > 0, each scan first looks up the PIDs the kernel is likely to allocate next.
+// With rescan > 0, all processes get their command line and executable read again that often.
+// With recheck, new processes get their command line and executable read again in the next scans.
+func NewPSScanner(ppid bool, ancestry int, probe int, rescan time.Duration, recheck bool, cmdLength int, enrichment Enrichment, fs FS) *PSScanner {
 	return &PSScanner{
+		procfs:       newProcfs(fs),
 		enablePpid:   ppid,
+		ancestry:     ancestry,
+		probe:        probe,
+		rescan:       rescan,
+		recheck:      recheck,
 		eventCh:      nil,
+		errCh:        nil,
 		maxCmdLength: cmdLength,
+		enrichment:   enrichment,
 	}
 }
 
@@ -60,31 +318,52 @@ func (p *PSScanner) Run(triggerCh chan struct{}) (chan PSEvent, chan error) {
 	eventCh := make(chan PSEvent, 100)
 	p.eventCh = eventCh
 	errCh := make(chan error)
-	pl := make(procList)
+	p.errCh = errCh
+	pl := newProcList(p.procfs, p.ancestry, p.probe, p.rescan)
+	if p.recheck {
+		pl.recheck = recheckRefreshes
+	}
+	p.procs = pl
 
 	go func() {
-		for {
-			<-triggerCh
-			pl.refresh(p)
+		// closing triggerCh stops scanning, the closed eventCh tells when it stopped
+		defer close(eventCh)
+		for range triggerCh {
+			pl.countMissed = p.countsMissed()
+			if err := pl.refresh(p); err != nil {
+				errCh <- err
+			}
 		}
 	}()
 	return eventCh, errCh
 }
 
-func (p *PSScanner) processNewPid(pid int) {
+// SetCountMissed turns the estimation of missed processes on or off, also while running
+func (p *PSScanner) SetCountMissed(on bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.countMissed = on
+}
+
+func (p *PSScanner) countsMissed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.countMissed
+}
+
+func (p *PSScanner) processNewPid(pid int) PSEvent {
 	statInfo := syscall.Stat_t{}
-	errStat := lstat(fmt.Sprintf("/proc/%d", pid), &statInfo)
-	cmdLine, errCmdLine := readFile(fmt.Sprintf("/proc/%d/cmdline", pid), p.maxCmdLength)
+	errStat := p.fs.Lstat(strconv.Itoa(pid), &statInfo)
+	cmdLine, kthread := p.readCmdLine(pid)
 	ppid, _ := p.getPpid(pid)
 
-	cmd := "???" // process probably terminated
-	if errCmdLine == nil {
-		for i := 0; i < len(cmdLine); i++ {
-			if cmdLine[i] == 0 {
-				cmdLine[i] = 32
-			}
-		}
-		cmd = string(cmdLine)
+	cmd := UnknownCMD // process probably terminated
+	var argv []string
+	if len(cmdLine) > 0 {
+		argv = splitArgv(cmdLine)
+		cmd = joinArgs(cmdLine)
+	} else if comm, err := p.getComm(pid); err == nil {
+		cmd = "[" + comm + "]"
 	}
 
 	uid := -1
@@ -92,37 +371,194 @@ func (p *PSScanner) processNewPid(pid int) {
 		uid = int(statInfo.Uid)
 	}
 
-	p.eventCh <- PSEvent{UID: uid, PID: pid, PPID: ppid, CMD: cmd}
+	pe := PSEvent{UID: uid, PID: pid, PPID: ppid, CMD: cmd, Argv: argv, KernelThread: kthread}
+	if p.ancestry > 0 && p.procs != nil {
+		pe.Ancestors = p.procs.ancestors(ppid, p.ancestry)
+	}
+	p.enrich(&pe)
+	p.send(pe)
+	return pe
+}
+
+// readCmdLine reads the command line of a process, trying again a few times while it is empty.
+// Kernel threads and zombies never have one, so they are not retried. Returns an empty
+// command line if it can't be read and whether the process is a kernel thread.
+func (p *PSScanner) readCmdLine(pid int) ([]byte, bool) {
+	for attempt := 1; ; attempt++ {
+		cmdLine, err := p.readFile(fmt.Sprintf("%d/cmdline", pid), p.maxCmdLength)
+		if err != nil || len(cmdLine) > 0 {
+			return cmdLine, false
+		}
+		if attempt == 1 {
+			state, flags, err := p.getState(pid)
+			if err != nil || state == "Z" {
+				return nil, false
+			}
+			if flags&pfKthread != 0 {
+				return nil, true
+			}
+		}
+		if attempt == cmdLineAttempts {
+			return nil, false
+		}
+		sleep(cmdLineRetryDelay)
+	}
+}
+
+// processRecheckedPid reads the command line of a known process again and reports a KindExec
+// event if it exec'ed or a KindChanged event if only its command line changed.
+// Returns the event updated with the current command.
+func (p *PSScanner) processRecheckedPid(pe PSEvent, execed bool) PSEvent {
+	cmdLine, err := p.readFile(fmt.Sprintf("%d/cmdline", pe.PID), p.maxCmdLength)
+	if err != nil || len(cmdLine) == 0 {
+		return pe
+	}
+	argv := splitArgv(cmdLine)
+	if !execed && reflect.DeepEqual(argv, pe.Argv) {
+		return pe
+	}
+
+	previous := pe.Command()
+	pe.CMD, pe.Argv = joinArgs(cmdLine), argv
+	if execed {
+		// setuid programs run as their owner
+		stat := syscall.Stat_t{}
+		if err := p.fs.Lstat(strconv.Itoa(pe.PID), &stat); err == nil {
+			pe.UID = int(stat.Uid)
+		}
+	}
+	p.enrich(&pe)
+	changed := pe
+	changed.Kind = KindChanged
+	if execed {
+		changed.Kind = KindExec
+	}
+	changed.Previous = previous
+	p.send(changed)
+	return pe
+}
+
+func (p *PSScanner) processExitedPid(pe PSEvent, lifetime time.Duration) {
+	pe.Kind = KindExit
+	pe.Lifetime = lifetime
+	p.send(pe)
+}
+
+// processPipeline reports processes connected by pipes as one event, which has the PID,
+// user and parent of the first one
+func (p *PSScanner) processPipeline(members []PSEvent) {
+	first := members[0]
+	pe := PSEvent{Kind: KindPipeline, UID: first.UID, PID: first.PID, PPID: first.PPID}
+	for _, m := range members {
+		pe.Pipeline = append(pe.Pipeline, PipelineMember{PID: m.PID, UID: m.UID, CMD: m.CMD, Argv: m.Argv})
+	}
+	pe.CMD = PipelineCommand(pe.Pipeline)
+	if p.ancestry > 0 && p.procs != nil {
+		pe.Ancestors = p.procs.ancestors(pe.PPID, p.ancestry)
+	}
+	p.send(pe)
+}
+
+func (p *PSScanner) processMissed(m Missed) {
+	p.send(PSEvent{Kind: KindMissed, UID: -1, PPID: -1, Missed: &m})
+}
+
+// send reports an event stamped with the time it was captured, which is when it is printed
+// only while the printer keeps up
+func (p *PSScanner) send(pe PSEvent) {
+	pe.Time = now()
+	p.eventCh <- pe
 }
 
 func (p *PSScanner) getPpid(pid int) (int, error) {
-	if !p.enablePpid {
+	// siblings in a pipeline are told apart by their parent
+	if !p.enablePpid && p.ancestry == 0 && !p.enrichment.Pipes {
 		return -1, nil
 	}
+	return p.procfs.getPpid(pid)
+}
 
-	stat, err := readFile(fmt.Sprintf("/proc/%d/stat", pid), 512)
-	if err != nil {
-		return -1, err
+// joinArgs joins the NUL separated arguments of a cmdline file with spaces
+func joinArgs(cmdLine []byte) string {
+	return string(bytes.ReplaceAll(cmdLine, []byte{0}, []byte{' '}))
+}
+
+// splitArgv splits the NUL separated contents of a cmdline file into arguments
+func splitArgv(cmdLine []byte) []string {
+	if len(cmdLine) == 0 {
+		return nil
 	}
+	s := strings.TrimSuffix(string(cmdLine), "\x00")
+	return strings.Split(s, "\x00")
+}
 
-	if m := ppidRegex.FindStringSubmatch(string(stat)); m != nil {
-		return strconv.Atoi(m[1])
+// ShellQuote renders arguments such that a shell would split them into the same argv.
+// Arguments with special characters are put in single quotes, arguments with control
+// characters, bidirectional overrides, backslashes or invalid UTF-8 in ANSI-C quotes, $'...',
+// with these escaped, so that the command can neither tamper with a terminal nor change when copied.
+func ShellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = quoteArg(arg)
 	}
-	return -1, errors.New("corrupt stat file")
+	return strings.Join(quoted, " ")
 }
 
-// no nonsense file reading
-func readFile(filename string, maxlen int) ([]byte, error) {
-	file, err := open(filename)
-	if err != nil {
-		return nil, err
+func quoteArg(arg string) string {
+	if arg == "" {
+		return "''"
 	}
-	defer file.Close()
+	if needsANSICQuotes(arg) {
+		return ansiCQuote(arg)
+	}
+	for _, c := range arg {
+		if !isShellSafe(c) {
+			return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return arg
+}
 
-	buffer := make([]byte, maxlen)
-	n, err := file.Read(buffer)
-	if err != io.EOF && err != nil {
-		return nil, err
+func needsANSICQuotes(arg string) bool {
+	if !utf8.ValidString(arg) {
+		return true
 	}
-	return buffer[:n], nil
+	for _, c := range arg {
+		if c == '\\' || unicode.IsControl(c) || unicode.Is(unicode.Bidi_Control, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func ansiCQuote(arg string) string {
+	var b strings.Builder
+	b.WriteString("$'")
+	for i := 0; i < len(arg); {
+		r, size := utf8.DecodeRuneInString(arg[i:])
+		switch {
+		case r == '\\' || r == '\'':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == utf8.RuneError && size == 1, unicode.IsControl(r), unicode.Is(unicode.Bidi_Control, r):
+			for _, c := range []byte(arg[i : i+size]) {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			}
+		default:
+			b.WriteString(arg[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+func isShellSafe(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("@%+=:,./-_", c)
 }
@@ -3,10 +3,8 @@ package psscanner
 import (
 	//"encoding/hex"
 	"errors"
-	"fmt"
-	"io"
 	"reflect"
-	"syscall"
+	"strings"
 	"testing"
 	"time"
 )
@@ -32,13 +30,14 @@ func TestRun(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer mockPidList(tt.pids, t)()
+			fs := newMockFS(t)
+			fs.mockPidList(tt.pids)
 			for _, pid := range tt.pids {
-				defer mockPidCmdLine(pid, []byte("the-command"), nil, nil, t)()
-				defer mockPidUid(pid, 0, errors.New("file not found"), t)()
+				fs.mockPidCmdLine(pid, []byte("the-command"), nil, nil)
+				fs.mockPidUid(pid, 0, errors.New("file not found"))
 			}
 
-			pss := NewPSScanner(false, 2048)
+			pss := NewPSScanner(false, 0, 0, 0, false, 2048, Enrichment{}, fs)
 			triggerCh := make(chan struct{})
 			eventCh, errCh := pss.Run(triggerCh)
 
@@ -67,17 +66,47 @@ func TestRun(t *testing.T) {
 					t.Errorf("Received unexpected error: %v", err)
 				}
 			}
+
+			// stops when the trigger channel is closed, before other tests mock globals
+			close(triggerCh)
+			for e := range eventCh {
+				t.Errorf("Received unexpected event: %s", e)
+			}
 		})
 	}
 }
 
+func TestRunReportsErrors(t *testing.T) {
+	pss := NewPSScanner(false, 0, 0, 0, false, 2048, Enrichment{}, newMockFS(t))
+	triggerCh := make(chan struct{})
+	eventCh, errCh := pss.Run(triggerCh)
+
+	triggerCh <- struct{}{}
+	select {
+	case err := <-errCh:
+		if err.Error() != "opening proc dir: open .: file does not exist" {
+			t.Errorf("Wrong error: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Errorf("Did not receive error in time")
+	}
+
+	close(triggerCh)
+	for e := range eventCh {
+		t.Errorf("Received unexpected event: %s", e)
+	}
+}
+
 var (
 	completeStat = []byte("1314 (some proc with) odd chars)) in name) R 5560 1314 5560 34821 1314 4194304 82 0 0 0 0 0 0 0 20 0 1 0 15047943 7790592 196 18446744073709551615 94260770430976 94260770462160 140725974097504 0 0 0 0 0 0 0 0 0 17 1 0 0 0 0 0 94260772559472 94260772561088 94260783992832 140725974106274 140725974106294 140725974106294 140725974110191 0\n")
 	partialStat  = []byte("1314 (ps) ")
+	kthreadStat  = []byte("2 (kthreadd) S 0 0 0 0 -1 2129984 0 0 0 0 0 0 0 0 20 0 1 0 2 0 0 18446744073709551615 0 0 0 0 0 0 0 2147483647 0 0 0 0 17 0 0 0 0 0 0 0 0 0 0 0 0 0 0\n")
 	invalidPpid  = []byte("1314 (ps) R XYZ 1314 5560 34821 1314 4194304 82 0 0 0 0 0 0 0 20 0 1 0 15047943 7790592 196 18446744073709551615 94260770430976 94260770462160 140725974097504 0 0 0 0 0 0 0 0 0 17 1 0 0 0 0 0 94260772559472 94260772561088 94260783992832 140725974106274 140725974106294 140725974106294 140725974110191 0\n")
 )
 
 func TestProcessNewPid(t *testing.T) {
+	clock := time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)
+	defer mockNow(clock)()
 	tests := []struct {
 		name           string
 		enablePpid     bool
@@ -111,6 +140,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  1,
 				PPID: -1,
 				CMD:  "abc 123",
+				Argv: []string{"abc", "123"},
 			},
 		},
 		{
@@ -131,10 +161,11 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  1,
 				PPID: 5560,
 				CMD:  "abc 123",
+				Argv: []string{"abc", "123"},
 			},
 		},
 		{
-			name:           "empty-cmd-ok",
+			name:           "empty-cmd-stat-comm",
 			enablePpid:     true,
 			truncate:       100,
 			pid:            1,
@@ -150,7 +181,28 @@ func TestProcessNewPid(t *testing.T) {
 				UID:  0,
 				PID:  1,
 				PPID: 5560,
-				CMD:  "",
+				CMD:  "[some proc with) odd chars)) in name]",
+			},
+		},
+		{
+			name:           "cmd-trailing-nul",
+			enablePpid:     false,
+			truncate:       100,
+			pid:            1,
+			cmdLine:        []byte("sh\x00-c\x00echo a b\x00"),
+			cmdLineErrRead: nil,
+			cmdLineErrOpen: nil,
+			stat:           completeStat,
+			statErrRead:    nil,
+			statErrOpen:    nil,
+			lstatUid:       0,
+			lstatErr:       nil,
+			expected: PSEvent{
+				UID:  0,
+				PID:  1,
+				PPID: -1,
+				CMD:  "sh -c echo a b ",
+				Argv: []string{"sh", "-c", "echo a b"},
 			},
 		},
 		{
@@ -171,6 +223,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  1,
 				PPID: -1,
 				CMD:  "abc 123 al",
+				Argv: []string{"abc", "123", "al"},
 			},
 		},
 		{
@@ -190,7 +243,7 @@ func TestProcessNewPid(t *testing.T) {
 				UID:  0,
 				PID:  2,
 				PPID: 5560,
-				CMD:  "???",
+				CMD:  "[some proc with) odd chars)) in name]",
 			},
 		},
 		{
@@ -210,9 +263,50 @@ func TestProcessNewPid(t *testing.T) {
 				UID:  0,
 				PID:  2,
 				PPID: 5560,
+				CMD:  "[some proc with) odd chars)) in name]",
+			},
+		},
+		{
+			name:           "cmd-and-stat-io-error",
+			enablePpid:     false,
+			truncate:       100,
+			pid:            2,
+			cmdLine:        nil,
+			cmdLineErrRead: errors.New("file-system-error"),
+			cmdLineErrOpen: nil,
+			stat:           nil,
+			statErrRead:    nil,
+			statErrOpen:    errors.New("file-system-error"),
+			lstatUid:       0,
+			lstatErr:       nil,
+			expected: PSEvent{
+				UID:  0,
+				PID:  2,
+				PPID: -1,
 				CMD:  "???",
 			},
 		},
+		{
+			name:           "kernel-thread",
+			enablePpid:     true,
+			truncate:       100,
+			pid:            2,
+			cmdLine:        []byte{},
+			cmdLineErrRead: nil,
+			cmdLineErrOpen: nil,
+			stat:           kthreadStat,
+			statErrRead:    nil,
+			statErrOpen:    nil,
+			lstatUid:       0,
+			lstatErr:       nil,
+			expected: PSEvent{
+				UID:          0,
+				PID:          2,
+				PPID:         0,
+				CMD:          "[kthreadd]",
+				KernelThread: true,
+			},
+		},
 		{
 			name:           "stat-io-error",
 			enablePpid:     true,
@@ -231,6 +325,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  2,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -251,6 +346,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  2,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -271,6 +367,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -291,6 +388,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: 5560,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -311,6 +409,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -331,6 +430,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -351,6 +451,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		/*{
@@ -371,6 +472,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -391,6 +493,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -411,6 +514,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -431,6 +535,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -451,6 +556,7 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},
 		{
@@ -471,19 +577,22 @@ func TestProcessNewPid(t *testing.T) {
 				PID:  3,
 				PPID: -1,
 				CMD:  "some cmd 123",
+				Argv: []string{"some", "cmd", "123"},
 			},
 		},*/
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			defer mockPidCmdLine(tt.pid, tt.cmdLine, tt.cmdLineErrRead, tt.cmdLineErrOpen, t)()
-			defer mockPidStat(tt.pid, tt.stat, tt.statErrRead, tt.statErrOpen, t)()
-			defer mockPidUid(tt.pid, tt.lstatUid, tt.lstatErr, t)()
+			fs := newMockFS(t)
+			fs.mockPidCmdLine(tt.pid, tt.cmdLine, tt.cmdLineErrRead, tt.cmdLineErrOpen)
+			fs.mockPidStat(tt.pid, tt.stat, tt.statErrRead, tt.statErrOpen)
+			fs.mockPidUid(tt.pid, tt.lstatUid, tt.lstatErr)
 
 			results := make(chan PSEvent, 1)
 
 			scanner := &PSScanner{
+				procfs:       newProcfs(fs),
 				enablePpid:   tt.enablePpid,
 				eventCh:      results,
 				maxCmdLength: tt.truncate,
@@ -501,6 +610,8 @@ func TestProcessNewPid(t *testing.T) {
 				if testing.Verbose() {
 					t.Logf("received event: %#v", event)
 				}
+				// stamped when captured
+				tt.expected.Time = clock
 				if !reflect.DeepEqual(event, tt.expected) {
 					t.Errorf("Event received but format is has unexpected values: got %#v but want %#v", event, tt.expected)
 				}
@@ -509,73 +620,100 @@ func TestProcessNewPid(t *testing.T) {
 	}
 }
 
-func mockPidStat(pid int, stat []byte, errRead error, errOpen error, t *testing.T) func() {
-	return mockFile(fmt.Sprintf("/proc/%d/stat", pid), stat, errRead, errOpen, t)
-}
+func TestProcessNewPidRetry(t *testing.T) {
+	fs := newMockFS(t)
+	fs.mockPidCmdLine(5, []byte{}, nil, nil)
+	fs.mockPidStat(5, completeStat, nil, nil)
+	fs.mockFile("5/comm", []byte("sh\n"), nil, nil)
+	fs.mockPidUid(5, 0, nil)
+	results := make(chan PSEvent, 2)
+	scanner := &PSScanner{procfs: newProcfs(fs), eventCh: results, maxCmdLength: 100}
 
-func mockPidCmdLine(pid int, cmdline []byte, errRead error, errOpen error, t *testing.T) func() {
-	return mockFile(fmt.Sprintf("/proc/%d/cmdline", pid), cmdline, errRead, errOpen, t)
-}
-
-type MockFile struct {
-	content []byte
-	err     error
-}
+	// the command line shows up on the second attempt
+	attempts := 1
+	defer mockSleep(func(d time.Duration) {
+		attempts++
+		fs.mockPidCmdLine(5, []byte("sleep\x001"), nil, nil)
+	})()
+	if pe := scanner.processNewPid(5); pe.CMD != "sleep 1" || attempts != 2 {
+		t.Errorf("Wrong command after %d attempts: %s", attempts, pe.CMD)
+	}
 
-func (f *MockFile) Close() error {
-	return nil
+	// and never does, so comm is used
+	fs.mockPidCmdLine(6, []byte{}, nil, nil)
+	fs.mockPidStat(6, completeStat, nil, nil)
+	fs.mockFile("6/comm", []byte("sh\n"), nil, nil)
+	attempts = 1
+	defer mockSleep(func(d time.Duration) { attempts++ })()
+	if pe := scanner.processNewPid(6); pe.CMD != "[sh]" || pe.Argv != nil || attempts != cmdLineAttempts {
+		t.Errorf("Wrong command after %d attempts: %s", attempts, pe.CMD)
+	}
 }
 
-func (f *MockFile) Read(p []byte) (int, error) {
-	return copy(p, f.content), f.err
-}
+func TestProcessRecheckedPid(t *testing.T) {
+	clock := time.Date(2018, 2, 18, 21, 1, 1, 0, time.UTC)
+	defer mockNow(clock)()
+	fs := newMockFS(t)
+	fs.mockPidCmdLine(5, []byte("sleep\x001"), nil, nil)
+	fs.mockLink("5/exe", "/usr/bin/sleep")
+	results := make(chan PSEvent, 2)
+	scanner := &PSScanner{procfs: newProcfs(fs), eventCh: results, maxCmdLength: 100, enrichment: Enrichment{Exe: true}}
 
-// Hook/chain a mocked file into the "open" variable
-func mockFile(name string, content []byte, errRead error, errOpen error, t *testing.T) func() {
-	oldopen := open
-	open = func(n string) (io.ReadCloser, error) {
-		if name == n {
-			if testing.Verbose() {
-				t.Logf("opening mocked file: %s", n)
-			}
-			return &MockFile{
-				content: content,
-				err:     errRead,
-			}, errOpen
-		}
-		return oldopen(n)
+	forked := PSEvent{UID: 0, PID: 5, PPID: -1, CMD: "sh -c sleep 1", Argv: []string{"sh", "-c", "sleep 1"}, Exe: "/bin/sh"}
+	pe := scanner.processRecheckedPid(forked, false)
+	expected := PSEvent{UID: 0, PID: 5, PPID: -1, CMD: "sleep 1", Argv: []string{"sleep", "1"}, Exe: "/usr/bin/sleep"}
+	if !reflect.DeepEqual(pe, expected) {
+		t.Errorf("Wrong event: got %+v but want %+v", pe, expected)
 	}
-	return func() {
-		open = oldopen
+	expected.Kind = KindChanged
+	expected.Previous = "sh -c 'sleep 1'"
+	expected.Time = clock
+	if changed := <-results; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Wrong changed event: got %+v but want %+v", changed, expected)
 	}
-}
 
-func mockPidUid(pid int, uid uint32, err error, t *testing.T) func() {
-	return mockLStat(fmt.Sprintf("/proc/%d", pid), uid, err, t)
-}
+	// exec'ed the same command again
+	pe = scanner.processRecheckedPid(pe, true)
+	expected.Kind, expected.Previous = KindExec, "sleep 1"
+	if changed := <-results; !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Wrong exec event: got %+v but want %+v", changed, expected)
+	}
 
-func mockLStat(name string, uid uint32, err error, t *testing.T) func() {
-	oldlstat := lstat
-	lstat = func(path string, stat *syscall.Stat_t) error {
-		if path == name {
-			if testing.Verbose() {
-				t.Logf("mocking lstat for %s", name)
-			}
-			stat.Uid = uid
-			return err
-		}
-		return oldlstat(path, stat)
+	// nothing changed
+	if again := scanner.processRecheckedPid(pe, false); !reflect.DeepEqual(again, pe) || len(results) != 0 {
+		t.Errorf("Unexpected change: %+v", again)
 	}
-	return func() {
-		lstat = oldlstat
+	// exited in the meantime
+	if gone := scanner.processRecheckedPid(PSEvent{PID: 6, CMD: "[sh]"}, false); gone.CMD != "[sh]" || len(results) != 0 {
+		t.Errorf("Unexpected change: %+v", gone)
+	}
+
+	// exec'ed a setuid program
+	fs.mockPidUid(5, 0, nil)
+	if pe := scanner.processRecheckedPid(PSEvent{UID: 1000, PID: 5, CMD: "sh"}, true); pe.UID != 0 {
+		t.Errorf("UID not updated after exec: %+v", pe)
+	}
+	if changed := <-results; changed.Kind != KindExec || changed.UID != 0 {
+		t.Errorf("Wrong exec event: %+v", changed)
 	}
 }
 
+func mockSleep(f func(d time.Duration)) func() {
+	old := sleep
+	sleep = f
+	return func() { sleep = old }
+}
+
 func TestNewPSScanner(t *testing.T) {
 	for _, tt := range []struct {
-		name   string
-		ppid   bool
-		cmdlen int
+		name       string
+		ppid       bool
+		ancestry   int
+		probe      int
+		rescan     time.Duration
+		recheck    bool
+		cmdlen     int
+		enrichment Enrichment
 	}{
 		{
 			name:   "without-ppid",
@@ -587,14 +725,48 @@ func TestNewPSScanner(t *testing.T) {
 			ppid:   true,
 			cmdlen: 5000,
 		},
+		{
+			name:       "with-enrichment",
+			ppid:       false,
+			cmdlen:     5000,
+			enrichment: Enrichment{Exe: true, IDs: true},
+		},
+		{
+			name:     "with-ancestry",
+			ppid:     false,
+			ancestry: 3,
+			cmdlen:   5000,
+		},
+		{
+			name:   "with-probe",
+			probe:  8,
+			cmdlen: 5000,
+		},
+		{
+			name:   "with-rescan",
+			rescan: time.Second,
+			cmdlen: 5000,
+		},
+		{
+			name:    "with-recheck",
+			recheck: true,
+			cmdlen:  5000,
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
+			fs := NewProcFS("/host/proc")
 			expected := &PSScanner{
+				procfs:       newProcfs(fs),
 				enablePpid:   tt.ppid,
+				ancestry:     tt.ancestry,
+				probe:        tt.probe,
+				rescan:       tt.rescan,
+				recheck:      tt.recheck,
 				eventCh:      nil,
 				maxCmdLength: tt.cmdlen,
+				enrichment:   tt.enrichment,
 			}
-			new := NewPSScanner(tt.ppid, tt.cmdlen)
+			new := NewPSScanner(tt.ppid, tt.ancestry, tt.probe, tt.rescan, tt.recheck, tt.cmdlen, tt.enrichment, fs)
 
 			if !reflect.DeepEqual(new, expected) {
 				t.Errorf("Unexpected scanner initialisation state: got %#v but want %#v", new, expected)
@@ -607,10 +779,12 @@ func TestNewPSScanner(t *testing.T) {
 func TestPSEvent(t *testing.T) {
 	tests := []struct {
 		name     string
+		kind     EventKind
 		uid      int
 		pid      int
 		ppid     int
 		cmd      string
+		lifetime time.Duration
 		expected string
 	}{
 		{
@@ -645,6 +819,16 @@ func TestPSEvent(t *testing.T) {
 			cmd:      "",
 			expected: "UID=999   PID=123    PPID=321    | ",
 		},
+		{
+			name:     "exit",
+			kind:     KindExit,
+			uid:      999,
+			pid:      123,
+			ppid:     -1,
+			cmd:      "some cmd",
+			lifetime: 1234567 * time.Microsecond,
+			expected: "UID=999   PID=123    | some cmd (lifetime ~1.235s)",
+		},
 		{
 			name:     "nouid",
 			uid:      -1,
@@ -658,10 +842,12 @@ func TestPSEvent(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ps := PSEvent{
-				UID:  tt.uid,
-				PID:  tt.pid,
-				PPID: tt.ppid,
-				CMD:  tt.cmd,
+				Kind:     tt.kind,
+				UID:      tt.uid,
+				PID:      tt.pid,
+				PPID:     tt.ppid,
+				CMD:      tt.cmd,
+				Lifetime: tt.lifetime,
 			}
 			if ps.String() != tt.expected {
 				t.Errorf("Expecting \"%s\", got \"%s\"", tt.expected, ps.String())
@@ -669,3 +855,92 @@ func TestPSEvent(t *testing.T) {
 		})
 	}
 }
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		argv     []string
+		expected string
+	}{
+		{argv: []string{"ls", "-la", "/tmp"}, expected: "ls -la /tmp"},
+		{argv: []string{"sh", "-c", "echo a b"}, expected: "sh -c 'echo a b'"},
+		{argv: []string{"echo", ""}, expected: "echo ''"},
+		{argv: []string{"echo", "it's"}, expected: `echo 'it'\''s'`},
+		{argv: []string{"grep", "$HOME", "a;b"}, expected: "grep '$HOME' 'a;b'"},
+		{argv: []string{"user@host:/path,x=1+2%"}, expected: "user@host:/path,x=1+2%"},
+		{argv: []string{"printf", "\x1b[2J"}, expected: `printf $'\x1b[2J'`},
+		{argv: []string{"printf", `\x1b[2J`}, expected: `printf $'\\x1b[2J'`},
+		{argv: []string{"echo", "it's\na\tb\r"}, expected: `echo $'it\'s\na\tb\r'`},
+		{argv: []string{"cat", "grüße\xff", "txt.\u202eexe"}, expected: `cat $'grüße\xff' $'txt.\xe2\x80\xaeexe'`},
+	}
+
+	for _, tt := range tests {
+		if got := ShellQuote(tt.argv); got != tt.expected {
+			t.Errorf("ShellQuote(%q): got %s but wanted %s", tt.argv, got, tt.expected)
+		}
+	}
+}
+
+func TestPSEventCommands(t *testing.T) {
+	tests := []struct {
+		pe       PSEvent
+		expected string
+	}{
+		{PSEvent{Kind: KindChanged, UID: 0, PID: 5, PPID: -1, CMD: "sleep 1", Argv: []string{"sleep", "1"}, Previous: "sh -c 'sleep 1'"}, "UID=0     PID=5      | sleep 1 (was sh -c 'sleep 1')"},
+		{PSEvent{Kind: KindExec, UID: 0, PID: 5, PPID: -1, CMD: "sleep 1", Argv: []string{"sleep", "1"}, Previous: "sh -c 'sleep 1'"}, "UID=0     PID=5      | sleep 1 (was sh -c 'sleep 1')"},
+		{PSEvent{UID: 0, PID: 2, PPID: 0, CMD: "[kthreadd]", KernelThread: true}, "UID=0     PID=2      PPID=0      | [kthreadd] (kernel thread)"},
+		{PSEvent{UID: 0, PID: 9, PPID: -1, CMD: "[sh]"}, "UID=0     PID=9      | [sh]"},
+	}
+	for _, tt := range tests {
+		if tt.pe.String() != tt.expected {
+			t.Errorf("Wrong string: got '%s' but want '%s'", tt.pe.String(), tt.expected)
+		}
+	}
+}
+
+func TestMissedString(t *testing.T) {
+	tests := []struct {
+		missed   Missed
+		expected string
+	}{
+		{Missed{From: 10, To: 14, Count: 5, Caught: 95, Allocated: 100}, "5 processes missed between PID 10 and 14 (caught 95.0% of 100 so far)"},
+		{Missed{From: 7, To: 7, Count: 1, Caught: 2, Allocated: 3}, "1 process missed with PID 7 (caught 66.7% of 3 so far)"},
+		{Missed{From: 7, To: 9, Count: 2, Caught: 0, Allocated: 2}, "2 processes missed between PID 7 and 9 (caught 0.0% of 2 so far)"},
+	}
+	for _, tt := range tests {
+		pe := PSEvent{Kind: KindMissed, UID: -1, PPID: -1, Missed: &tt.missed}
+		if pe.String() != tt.expected {
+			t.Errorf("Wrong string: got '%s' but want '%s'", pe.String(), tt.expected)
+		}
+	}
+	if rate := (Missed{}).CatchRate(); rate != 1 {
+		t.Errorf("Wrong catch rate without allocated pids: %f", rate)
+	}
+}
+
+func TestPSEventAncestors(t *testing.T) {
+	pe := PSEvent{UID: 0, PID: 24, PPID: 23, CMD: "passwd", Argv: []string{"passwd"}, Ancestors: []Ancestor{
+		{PID: 23, CMD: "sh -c echo x", Argv: []string{"sh", "-c", "echo x"}},
+		{PID: 22, CMD: "python3 reset.py", Exited: true},
+	}}
+	if expected := "UID=0     PID=24     PPID=23     | passwd <- [23] sh -c 'echo x' <- [22 exited] python3 reset.py"; pe.String() != expected {
+		t.Errorf("Expecting \"%s\", got \"%s\"", expected, pe.String())
+	}
+	if expected := "UID=0     PID=24     PPID=23     |    \\_ passwd"; pe.TreeString() != expected {
+		t.Errorf("Expecting \"%s\", got \"%s\"", expected, pe.TreeString())
+	}
+
+	pe.Ancestors = []Ancestor{{PID: 1, CMD: strings.Repeat("x", 100)}}
+	if expected := "UID=0     PID=24     PPID=23     | passwd <- [1] " + strings.Repeat("x", 80) + "..."; pe.String() != expected {
+		t.Errorf("Expecting \"%s\", got \"%s\"", expected, pe.String())
+	}
+
+	pe.Ancestors = nil
+	if expected := "UID=0     PID=24     PPID=23     | passwd"; pe.TreeString() != expected {
+		t.Errorf("Expecting \"%s\", got \"%s\"", expected, pe.TreeString())
+	}
+
+	pe.Kind, pe.Ancestors = KindExit, []Ancestor{{PID: 23, CMD: "sh"}}
+	if expected := "UID=0     PID=24     PPID=23     | passwd (lifetime ~0s)"; pe.TreeString() != expected {
+		t.Errorf("Expecting \"%s\", got \"%s\"", expected, pe.TreeString())
+	}
+}
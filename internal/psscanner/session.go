@@ -0,0 +1,124 @@
+package psscanner
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Session tells which login session and terminal a process belongs to. Commands typed
+// into an SSH or console login share its audit session and usually its TTY, cron jobs
+// get an audit session of their own without TTY and daemons have neither.
+type Session struct {
+	TTY  string `json:"tty,omitempty"` // controlling terminal, e.g., pts/0
+	SID  int    `json:"sid"`           // session ID, the PID of the session leader
+	PGRP int    `json:"pgrp"`          // process group, the job of a shell
+	// audit login UID and session ID set by pam_loginuid at login, -1 if not set
+	LoginUID  int `json:"loginuid"`
+	SessionID int `json:"sessionid"`
+}
+
+func (s Session) String() string {
+	var b strings.Builder
+	if s.TTY != "" {
+		fmt.Fprintf(&b, "TTY=%s ", s.TTY)
+	}
+	fmt.Fprintf(&b, "SID=%d PGRP=%d", s.SID, s.PGRP)
+	if s.LoginUID >= 0 {
+		fmt.Fprintf(&b, " LOGINUID=%d", s.LoginUID)
+	}
+	if s.SessionID >= 0 {
+		fmt.Fprintf(&b, " SESSIONID=%d", s.SessionID)
+	}
+	return b.String()
+}
+
+// Key identifies the login session for grouping commands, empty for processes outside of one.
+// The audit session survives su, sudo and setsid, the session ID only identifies a terminal.
+func (s Session) Key() string {
+	switch {
+	case s.SessionID >= 0:
+		return fmt.Sprintf("sessionid %d", s.SessionID)
+	case s.TTY != "":
+		return fmt.Sprintf("sid %d", s.SID)
+	}
+	return ""
+}
+
+// getSession reads session, process group and terminal from /proc/<pid>/stat
+// and the audit login UID and session from /proc/<pid>/loginuid and sessionid
+func (p *procfs) getSession(pid int) (*Session, error) {
+	stat, err := p.readFile(fmt.Sprintf("%d/stat", pid), 512)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := statFields(stat)
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) < 5 {
+		return nil, errors.New("corrupt stat file")
+	}
+	s := &Session{}
+	if s.PGRP, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("corrupt stat file: %v", err)
+	}
+	if s.SID, err = strconv.Atoi(fields[3]); err != nil {
+		return nil, fmt.Errorf("corrupt stat file: %v", err)
+	}
+	ttyNr, err := strconv.ParseUint(fields[4], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt stat file: %v", err)
+	}
+	s.TTY = ttyName(ttyNr)
+
+	if s.LoginUID, err = p.getAuditID(pid, "loginuid"); err != nil {
+		return nil, err
+	}
+	if s.SessionID, err = p.getAuditID(pid, "sessionid"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// getAuditID reads /proc/<pid>/loginuid or sessionid, -1 if unset (4294967295)
+// or if the kernel was built without audit support
+func (p *procfs) getAuditID(pid int, name string) (int, error) {
+	content, err := p.readFile(fmt.Sprintf("%d/%s", pid, name), 32)
+	if os.IsNotExist(err) {
+		return -1, nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	id, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 32)
+	if err != nil {
+		return -1, fmt.Errorf("corrupt %s '%s'", name, content)
+	}
+	if id == 1<<32-1 {
+		return -1, nil
+	}
+	return int(id), nil
+}
+
+// ttyName translates the device number of a controlling terminal from the stat file to
+// its name below /dev, see Documentation/admin-guide/devices.txt of the kernel
+func ttyName(nr uint64) string {
+	if nr == 0 {
+		return ""
+	}
+	major, minor := (nr>>8)&0xfff, (nr&0xff)|((nr>>12)&0xfff00)
+	switch {
+	case major >= 136 && major <= 143:
+		return fmt.Sprintf("pts/%d", (major-136)*256+minor)
+	case major == 4 && minor < 64:
+		return fmt.Sprintf("tty%d", minor)
+	case major == 4:
+		return fmt.Sprintf("ttyS%d", minor-64)
+	case major == 5 && minor == 1:
+		return "console"
+	}
+	return fmt.Sprintf("%d:%d", major, minor)
+}
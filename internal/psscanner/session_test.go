@@ -0,0 +1,73 @@
+package psscanner
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestGetSession(t *testing.T) {
+	fs := newMockFS(t)
+	// pgrp 4250, session 4200, tty_nr 34817 = pts/1
+	fs.mockPidStat(4250, []byte("4250 (vim) S 4201 4250 4200 34817 4250 4194304 0\n"), nil, nil)
+	fs.mockFile("4250/loginuid", []byte("1000"), nil, nil)
+	fs.mockFile("4250/sessionid", []byte("3"), nil, nil)
+	// a daemon without audit session
+	fs.mockPidStat(700, []byte("700 (sshd) S 1 700 700 0 -1 4194560 0\n"), nil, nil)
+	fs.mockFile("700/loginuid", []byte("4294967295"), nil, nil)
+	fs.mockFile("700/sessionid", nil, nil, os.ErrNotExist)
+
+	p := newProcfs(fs)
+	s, err := p.getSession(4250)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (&Session{TTY: "pts/1", SID: 4200, PGRP: 4250, LoginUID: 1000, SessionID: 3}); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Wrong session: got %+v but want %+v", s, expected)
+	}
+	if s.String() != "TTY=pts/1 SID=4200 PGRP=4250 LOGINUID=1000 SESSIONID=3" || s.Key() != "sessionid 3" {
+		t.Errorf("Wrong string '%s' or key '%s'", s, s.Key())
+	}
+
+	s, err = p.getSession(700)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := (&Session{SID: 700, PGRP: 700, LoginUID: -1, SessionID: -1}); !reflect.DeepEqual(s, expected) {
+		t.Errorf("Wrong session: got %+v but want %+v", s, expected)
+	}
+	if s.String() != "SID=700 PGRP=700" || s.Key() != "" {
+		t.Errorf("Wrong string '%s' or key '%s'", s, s.Key())
+	}
+
+	fs.mockPidStat(701, []byte("701 (x) S 1 701 701 0 -1 0 0\n"), nil, nil)
+	fs.mockFile("701/loginuid", []byte("x"), nil, nil)
+	if _, err := p.getSession(701); err == nil || err.Error() != "corrupt loginuid 'x'" {
+		t.Errorf("Wrong error: %v", err)
+	}
+	fs.mockPidStat(702, []byte("702 (x) S 1\n"), nil, nil)
+	if _, err := p.getSession(702); err == nil || err.Error() != "corrupt stat file" {
+		t.Errorf("Wrong error: %v", err)
+	}
+}
+
+func TestTTYName(t *testing.T) {
+	tests := []struct {
+		nr       uint64
+		expected string
+	}{
+		{0, ""},
+		{34816, "pts/0"},
+		{137<<8 | 5, "pts/261"},
+		{16<<20 | 136<<8 | 2, "pts/4098"},
+		{4<<8 | 1, "tty1"},
+		{4<<8 | 64, "ttyS0"},
+		{5<<8 | 1, "console"},
+		{204<<8 | 64, "204:64"},
+	}
+	for _, tt := range tests {
+		if name := ttyName(tt.nr); name != tt.expected {
+			t.Errorf("Wrong name of tty %d: got '%s' but want '%s'", tt.nr, name, tt.expected)
+		}
+	}
+}
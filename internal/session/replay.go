@@ -0,0 +1,129 @@
+package session
+
+import (
+	"io"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// hook for testing
+var sleep = time.Sleep
+
+// Player replays a recorded session. Its PSScanner and FSWatcher stand in for the
+// real ones, so events go through the same filtering and printing as live ones.
+// Events are delivered one at a time on unbuffered channels, which keeps their order.
+type Player struct {
+	r     *Reader
+	speed float64 // multiple of the original speed, 0 for as fast as possible
+
+	psEventCh chan psscanner.PSEvent
+	fsEventCh chan fswatcher.FSEvent
+	doneCh    chan struct{}
+	err       error
+}
+
+func NewPlayer(r *Reader, speed float64) *Player {
+	return &Player{
+		r:         r,
+		speed:     speed,
+		psEventCh: make(chan psscanner.PSEvent),
+		fsEventCh: make(chan fswatcher.FSEvent),
+		doneCh:    make(chan struct{}),
+	}
+}
+
+// Done is closed once all events were delivered or reading the session failed
+func (p *Player) Done() chan struct{} {
+	return p.doneCh
+}
+
+// Err returns the error that stopped replaying early, if any. Call it after Done is closed.
+func (p *Player) Err() error {
+	return p.err
+}
+
+func (p *Player) PSScanner() *PSScanner {
+	return &PSScanner{p: p}
+}
+
+func (p *Player) FSWatcher() *FSWatcher {
+	return &FSWatcher{p: p}
+}
+
+func (p *Player) play() {
+	defer close(p.doneCh)
+
+	var last time.Time
+	for {
+		pe, fe, err := p.r.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			p.err = err
+			return
+		}
+
+		t := eventTime(pe, fe)
+		if p.speed > 0 && !last.IsZero() && t.After(last) {
+			sleep(time.Duration(float64(t.Sub(last)) / p.speed))
+		}
+		last = t
+
+		if pe != nil {
+			p.psEventCh <- *pe
+		} else {
+			p.fsEventCh <- *fe
+		}
+	}
+}
+
+func eventTime(pe *psscanner.PSEvent, fe *fswatcher.FSEvent) time.Time {
+	if pe != nil {
+		return pe.Time
+	}
+	return fe.Time
+}
+
+// PSScanner delivers the recorded process events
+type PSScanner struct {
+	p *Player
+}
+
+// Run ignores scan triggers since there is nothing to scan
+func (s *PSScanner) Run(triggerCh chan struct{}) (chan psscanner.PSEvent, chan error) {
+	go func() {
+		for range triggerCh {
+		}
+	}()
+	return s.p.psEventCh, make(chan error)
+}
+
+// SetCountMissed does nothing, missed processes are replayed as they were recorded
+func (s *PSScanner) SetCountMissed(on bool) {}
+
+// FSWatcher delivers the recorded file system events
+type FSWatcher struct {
+	p *Player
+}
+
+func (w *FSWatcher) Init(rdirs, dirs []string) (chan error, chan struct{}) {
+	doneCh := make(chan struct{})
+	close(doneCh)
+	return make(chan error), doneCh
+}
+
+// Run never triggers scans. Replaying starts once the watcher is enabled.
+func (w *FSWatcher) Run() (chan struct{}, chan fswatcher.FSEvent, chan error) {
+	return make(chan struct{}), w.p.fsEventCh, make(chan error)
+}
+
+func (w *FSWatcher) Update(rdirs, dirs []string) (chan error, chan struct{}) {
+	return w.Init(rdirs, dirs)
+}
+
+func (w *FSWatcher) Enable() {
+	go w.p.play()
+}
@@ -0,0 +1,77 @@
+package session
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+func TestPlayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		speed  float64
+		sleeps []time.Duration
+	}{
+		{name: "fast", speed: 0, sleeps: nil},
+		{name: "original-speed", speed: 1, sleeps: []time.Duration{2 * time.Second, 500 * time.Millisecond}},
+		{name: "double-speed", speed: 2, sleeps: []time.Duration{time.Second, 250 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sleeps []time.Duration
+			defer mockSleep(&sleeps)()
+
+			buf := &closingBuffer{}
+			w, _ := NewWriter(buf)
+			w.RecordPS(psscanner.PSEvent{PID: 1, Time: t0})
+			w.RecordFS(fswatcher.FSEvent{Path: "/tmp/a", Time: t0.Add(2 * time.Second)})
+			w.RecordPS(psscanner.PSEvent{PID: 2, Time: t0.Add(2500 * time.Millisecond)})
+			r, _ := NewReader(buf)
+
+			p := NewPlayer(r, tt.speed)
+			fsw, pss := p.FSWatcher(), p.PSScanner()
+			_, fsEventCh, _ := fsw.Run()
+			triggerCh := make(chan struct{})
+			psEventCh, _ := pss.Run(triggerCh)
+			triggerCh <- struct{}{} // ignored
+			fsw.Enable()
+
+			events := make([]string, 0)
+			for done := false; !done; {
+				select {
+				case pe := <-psEventCh:
+					events = append(events, fmt.Sprintf("PS %d", pe.PID))
+				case fe := <-fsEventCh:
+					events = append(events, fmt.Sprintf("FS %s", fe.Path))
+				case <-p.Done():
+					done = true
+				case <-time.After(time.Second):
+					t.Fatalf("Replay did not finish")
+				}
+			}
+
+			if expected := []string{"PS 1", "FS /tmp/a", "PS 2"}; !reflect.DeepEqual(events, expected) {
+				t.Errorf("Wrong events: got %v but wanted %v", events, expected)
+			}
+			if !reflect.DeepEqual(sleeps, tt.sleeps) {
+				t.Errorf("Wrong sleeps: got %v but wanted %v", sleeps, tt.sleeps)
+			}
+			if p.Err() != nil {
+				t.Errorf("Unexpected error: %v", p.Err())
+			}
+		})
+	}
+}
+
+func mockSleep(sleeps *[]time.Duration) func() {
+	oldSleep := sleep
+	sleep = func(d time.Duration) { *sleeps = append(*sleeps, d) }
+	return func() {
+		sleep = oldSleep
+	}
+}
@@ -0,0 +1,160 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+// Version of the session file format. Files start with magic and version,
+// followed by a gob encoded Header and one gob encoded record per event.
+const Version uint16 = 1
+
+var magic = []byte("PSPYSESS")
+
+// hook for testing
+var now = time.Now
+
+// Header describes a recorded session
+type Header struct {
+	Host    string
+	Started time.Time
+}
+
+// record holds exactly one event
+type record struct {
+	PS *psscanner.PSEvent
+	FS *fswatcher.FSEvent
+}
+
+// Writer records events to a session file. Events are written unbuffered,
+// so nothing is lost if pspy gets killed.
+type Writer struct {
+	w    io.WriteCloser
+	enc  *gob.Encoder
+	path string // absolute path of the session file, if known
+}
+
+// Create starts a new session file, replacing an existing one. A new file is only readable
+// by its owner, as it records full command lines and environments, secrets included.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("creating session file: %v", err)
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("writing session file %s: %v", path, err)
+	}
+	w.path, _ = filepath.Abs(path)
+	return w, nil
+}
+
+// NewWriter writes the file header and returns a Writer for the events
+func NewWriter(w io.WriteCloser) (*Writer, error) {
+	header := make([]byte, len(magic)+2)
+	copy(header, magic)
+	binary.BigEndian.PutUint16(header[len(magic):], Version)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(&Header{Host: host, Started: now()}); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, enc: enc}, nil
+}
+
+// RecordPS writes a process event, stamped with the current time unless it has a time already
+func (w *Writer) RecordPS(pe psscanner.PSEvent) error {
+	if pe.Time.IsZero() {
+		pe.Time = now()
+	}
+	return w.enc.Encode(&record{PS: &pe})
+}
+
+// RecordFS writes a file system event, stamped with the current time unless it has a time already.
+// Events of the session file itself are skipped, as writing them would cause yet another event.
+func (w *Writer) RecordFS(fe fswatcher.FSEvent) error {
+	if w.path != "" && fe.Path == w.path {
+		return nil
+	}
+	if fe.Time.IsZero() {
+		fe.Time = now()
+	}
+	return w.enc.Encode(&record{FS: &fe})
+}
+
+func (w *Writer) Close() error {
+	return w.w.Close()
+}
+
+// Reader reads the events of a session file in the order they were recorded
+type Reader struct {
+	Header Header
+	r      io.ReadCloser
+	dec    *gob.Decoder
+}
+
+// Open opens a session file and reads its header
+func Open(path string) (*Reader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening session file: %v", err)
+	}
+	r, err := NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading session file %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// NewReader checks the file format and reads the header
+func NewReader(r io.ReadCloser) (*Reader, error) {
+	header := make([]byte, len(magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.Equal(header[:len(magic)], magic) {
+		return nil, fmt.Errorf("not a pspy session file")
+	}
+	if v := binary.BigEndian.Uint16(header[len(magic):]); v != Version {
+		return nil, fmt.Errorf("unsupported session file version %d, expected %d", v, Version)
+	}
+
+	sr := &Reader{r: r, dec: gob.NewDecoder(r)}
+	if err := sr.dec.Decode(&sr.Header); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	return sr, nil
+}
+
+// Next returns the next event, which is either a process or a file system event.
+// Returns io.EOF at the end of the session, also if the last event was cut off.
+func (r *Reader) Next() (*psscanner.PSEvent, *fswatcher.FSEvent, error) {
+	var rec record
+	if err := r.dec.Decode(&rec); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			// pspy was killed while writing
+			return nil, nil, io.EOF
+		}
+		return nil, nil, err
+	}
+	if (rec.PS == nil) == (rec.FS == nil) {
+		return nil, nil, fmt.Errorf("corrupt record")
+	}
+	return rec.PS, rec.FS, nil
+}
+
+func (r *Reader) Close() error {
+	return r.r.Close()
+}
@@ -0,0 +1,145 @@
+package session
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dominicbreuker/pspy/internal/fswatcher"
+	"github.com/dominicbreuker/pspy/internal/psscanner"
+)
+
+var t0 = time.Date(2018, 2, 18, 21, 1, 1, 123456789, time.UTC)
+
+func TestRoundTrip(t *testing.T) {
+	defer mockNow(t0)()
+	buf := &closingBuffer{}
+	w, err := NewWriter(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	pe := psscanner.PSEvent{UID: 0, PID: 23, PPID: -1, CMD: "echo \xff", Argv: []string{"echo", "\xff"}, UIDs: &psscanner.IDs{Real: 1000}}
+	fe := fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/\x1b[2J", Time: t0.Add(time.Second)}
+	if err := w.RecordPS(pe); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := w.RecordFS(fe); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !r.Header.Started.Equal(t0) {
+		t.Errorf("Wrong start time: %v", r.Header.Started)
+	}
+
+	gotPE, gotFE, err := r.Next()
+	pe.Time = t0 // stamped on recording
+	if err != nil || gotFE != nil || !reflect.DeepEqual(*gotPE, pe) {
+		t.Errorf("Wrong first event: got %+v, %+v, %v but wanted %+v", gotPE, gotFE, err, pe)
+	}
+	gotPE, gotFE, err = r.Next()
+	if err != nil || gotPE != nil || !reflect.DeepEqual(*gotFE, fe) {
+		t.Errorf("Wrong second event: got %+v, %+v, %v but wanted %+v", gotPE, gotFE, err, fe)
+	}
+	if _, _, err = r.Next(); err != io.EOF {
+		t.Errorf("Expected EOF but got %v", err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pspy.session")
+	w, err := Create(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Session file readable by others: mode %v", perm)
+	}
+}
+
+func TestSkipOwnEvents(t *testing.T) {
+	buf := &closingBuffer{}
+	w, _ := NewWriter(buf)
+	w.path = "/tmp/session.pspy"
+	n := buf.Len()
+
+	w.RecordFS(fswatcher.FSEvent{Op: "MODIFY", Path: "/tmp/session.pspy"})
+	if buf.Len() != n {
+		t.Errorf("Recorded an event of the session file")
+	}
+}
+
+func TestTruncatedSession(t *testing.T) {
+	buf := &closingBuffer{}
+	w, _ := NewWriter(buf)
+	w.RecordFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/a"})
+	w.RecordFS(fswatcher.FSEvent{Op: "CREATE", Path: "/tmp/b"})
+	buf.Truncate(buf.Len() - 3)
+
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, fe, err := r.Next(); err != nil || fe.Path != "/tmp/a" {
+		t.Errorf("Wrong first event: %+v, %v", fe, err)
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("Expected EOF for the cut off event but got %v", err)
+	}
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	version := make([]byte, 2)
+	binary.BigEndian.PutUint16(version, Version+1)
+
+	tests := []struct {
+		name    string
+		content []byte
+		err     string
+	}{
+		{name: "empty", content: []byte{}, err: "not a pspy session file"},
+		{name: "magic", content: []byte("#!/bin/sh\necho hi\n"), err: "not a pspy session file"},
+		{name: "version", content: append([]byte("PSPYSESS"), version...), err: "unsupported session file version 2, expected 1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(&closingBuffer{Buffer: *bytes.NewBuffer(tt.content)})
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("Wrong error: got %v but wanted %s", err, tt.err)
+			}
+		})
+	}
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+}
+
+func (b *closingBuffer) Close() error {
+	return nil
+}
+
+func mockNow(t time.Time) func() {
+	oldNow := now
+	now = func() time.Time { return t }
+	return func() {
+		now = oldNow
+	}
+}
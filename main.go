@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/dominicbreuker/pspy/cmd"
 )
@@ -10,6 +11,6 @@ var version string
 var commit string
 
 func main() {
-	fmt.Printf("pspy - version: %s - Commit SHA: %s\n", version, commit)
+	fmt.Fprintf(os.Stderr, "pspy - version: %s - Commit SHA: %s\n", version, commit)
 	cmd.Execute()
 }